@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// acl is a list of rules, tried in order; the first that matches a
+// request decides, and a request matching none is denied. A rule is a
+// CIDR prefix, a bare address, which matches just itself, "key NAME" for
+// requests signed with TSIG key NAME, "any", "none" or the name of a
+// configured ACL. A leading "!" turns a rule around.
+type acl []aclEntry
+
+type aclEntry struct {
+	ipnet  *net.IPNet
+	key    string // a key name's dnsName.key(), for "key NAME" entries
+	any    bool
+	nested acl // a named ACL
+	deny   bool
+}
+
+// Recursion is only offered to the local host unless configured.
+var defaultRecursionACL = []string{"127.0.0.0/8", "::1"}
+
+// parseACL reads entries that use no named ACLs.
+func parseACL(entries []string) (acl, error) {
+	return newACLSet(nil).parse(entries)
+}
+
+// aclSet holds the named ACLs of the configuration, parsed on first use.
+type aclSet struct {
+	defs   map[string][]string
+	parsed map[string]acl
+	busy   map[string]bool // being parsed, to catch loops
+}
+
+func newACLSet(defs map[string][]string) *aclSet {
+	return &aclSet{defs: defs, parsed: make(map[string]acl), busy: make(map[string]bool)}
+}
+
+// parse reads entries, which may name the ACLs of s. Nil entries give a
+// nil ACL, any others a non-nil one, so that callers can tell an unset
+// list from an empty one.
+func (s *aclSet) parse(entries []string) (acl, error) {
+	if entries == nil {
+		return nil, nil
+	}
+	a := acl{}
+	for _, e := range entries {
+		var ent aclEntry
+		rule := strings.TrimSpace(e)
+		if r, ok := strings.CutPrefix(rule, "!"); ok {
+			ent.deny, rule = true, strings.TrimSpace(r)
+		}
+		switch name, isKey := strings.CutPrefix(rule, "key "); {
+		case isKey:
+			n, err := parseName(strings.TrimSpace(name))
+			if err != nil {
+				return nil, newError("bad key name in ACL: " + e)
+			}
+			ent.key = n.key()
+		case rule == "any":
+			ent.any = true
+		case rule == "none":
+			ent.any, ent.deny = true, !ent.deny
+		case s.defs[rule] != nil:
+			nested, err := s.named(rule)
+			if err != nil {
+				return nil, err
+			}
+			ent.nested = nested
+		case !strings.Contains(rule, "/"):
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, newError("bad address in ACL: " + e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ent.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		default:
+			_, ipnet, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, newError("bad prefix in ACL: " + e)
+			}
+			ent.ipnet = ipnet
+		}
+		a = append(a, ent)
+	}
+	return a, nil
+}
+
+// named returns the ACL called name.
+func (s *aclSet) named(name string) (acl, error) {
+	if a, ok := s.parsed[name]; ok {
+		return a, nil
+	}
+	if s.busy[name] {
+		return nil, newError("ACL " + name + " includes itself")
+	}
+	s.busy[name] = true
+	defer delete(s.busy, name)
+	a, err := s.parse(s.defs[name])
+	if err != nil {
+		return nil, newError("ACL " + name + ": " + err.Error())
+	}
+	s.parsed[name] = a
+	return a, nil
+}
+
+// allows reports whether an unsigned request from ip is allowed.
+func (a acl) allows(ip net.IP) bool {
+	return a.allowsKey(ip, "")
+}
+
+// allowsKey reports whether a request from ip signed with key, "" for
+// none, is allowed.
+func (a acl) allowsKey(ip net.IP, key string) bool {
+	_, allowed := a.match(ip, key)
+	return allowed
+}
+
+// match finds the first rule matching a request and reports whether
+// there is one and whether it allows the request.
+func (a acl) match(ip net.IP, key string) (matched, allowed bool) {
+	for _, e := range a {
+		m, allow := false, true
+		switch {
+		case e.any:
+			m = true
+		case e.nested != nil:
+			m, allow = e.nested.match(ip, key)
+		case e.ipnet != nil:
+			m = ip != nil && e.ipnet.Contains(ip)
+		case e.key != "":
+			m = e.key == key
+		}
+		if m {
+			return true, allow != e.deny
+		}
+	}
+	return false, false
+}
+
+// openTo is allowsKey for lists that are open to everyone unless
+// configured: it allows anything when a is nil.
+func (a acl) openTo(ip net.IP, key string) bool {
+	return a == nil || a.allowsKey(ip, key)
+}
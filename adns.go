@@ -11,10 +11,12 @@ func main() {
 	var (
 		isRecursive     = flag.Bool("recursive", false, "Recursive Server")
 		isAuthoritative = flag.Bool("authoritative", false, "Authoritative Server")
+		isForward       = flag.Bool("forward", false, "Forwarding Server")
 		tcpFd           = flag.Int("tcpfd", -1, "TCP File Discriptor")
 		udpFd           = flag.Int("udpfd", -1, "UDP File Discriptor")
 		tcp             = flag.Int("tcp", -1, "TCP")
 		udp             = flag.Int("udp", -1, "UDP")
+		configPath      = flag.String("config", "", "Configuration File")
 	)
 
 	flag.Parse()
@@ -23,18 +25,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	if (*isRecursive && *isAuthoritative) || (!*isRecursive && !*isAuthoritative) {
-		fmt.Fprintln(os.Stderr, "Select either recursive or authoritative")
+	modes := 0
+	for _, m := range []bool{*isRecursive, *isAuthoritative, *isForward} {
+		if m {
+			modes++
+		}
+	}
+	hybrid := modes == 2 && *isRecursive && *isAuthoritative
+	if modes != 1 && !hybrid {
+		fmt.Fprintln(os.Stderr, "Select one of recursive, authoritative or forward; recursive and authoritative may be combined")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	var err error
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	switch {
+	case hybrid:
+		err = hybridMain(cfg, *udpFd, *tcpFd, *udp, *tcp)
 	case *isRecursive:
-		// err = recursiveMain(*udpFd, *tcpFd, *udp, *tcp)
+		err = recursiveMain(cfg, *udpFd, *tcpFd, *udp, *tcp)
 	case *isAuthoritative:
-		err = authoritativeMain(*udpFd, *tcpFd, *udp, *tcp)
+		err = authoritativeMain(cfg, *udpFd, *tcpFd, *udp, *tcp)
+	case *isForward:
+		err = forwardMain(cfg, *udpFd, *tcpFd, *udp, *tcp)
 	default:
 		panic("must not come here")
 	}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// Plain DNS over UDP without EDNS0 (RFC 1035 section 4.2.1).
+const maxUDPSize = 512
+
+// Longest CNAME chain followed inside our own zones.
+const maxCNAMEChain = 8
+
+type authServer struct {
+	zones *zoneSet
+	keys  tsigKeyring
+	rrl   *rateLimiter // nil when UDP responses are not limited
+}
+
+func (srv *authServer) tsigKeys() tsigKeyring {
+	return srv.keys
+}
+
+func (srv *authServer) rateLimiter() *rateLimiter {
+	return srv.rrl
+}
+
+// serve answers a query, a NOTIFY or an UPDATE. Failures become the matching RCODE
+// with every section but the question left empty.
+func (srv *authServer) serve(req *dnsMessage, client net.IP) *dnsMessage {
+	res := newResponse(req)
+	var err error
+	switch req.Opcode {
+	case opcodeNotify:
+		err = srv.notified(req, res, client)
+	case opcodeUpdate:
+		err = srv.update(req, res, client)
+	default:
+		err = srv.answer(req, res, client)
+	}
+	if err != nil {
+		log.Print(err)
+		res.Answer, res.Authority, res.Additional = nil, nil, nil
+		res.AA = false
+		res.Rcode = errorRcode(err)
+	}
+	return res
+}
+
+// newResponse starts a response echoing the ID, opcode, RD and question,
+// to be signed like the request.
+func newResponse(req *dnsMessage) *dnsMessage {
+	res := new(dnsMessage)
+	res.Id = req.Id
+	res.QR = true
+	res.Opcode = req.Opcode
+	res.RD = req.RD
+	res.Rcode = rcodeSuccess
+	res.Question = req.Question
+	res.tsig = req.tsig
+	return res
+}
+
+func (srv *authServer) answer(req *dnsMessage, res *dnsMessage, client net.IP) error {
+	if req.Opcode != opcodeQuery {
+		return newNotImplementedError("opcode not implemented")
+	}
+	if len(req.Question) != 1 {
+		return newFormatError("exactly one question is supported", headerLen)
+	}
+	q := req.Question[0]
+	switch q.Qtype {
+	case dnsTypeAXFR, dnsTypeIXFR:
+		return newNotImplementedError("zone transfers are only served over TCP")
+	}
+	if q.Qclass != dnsClassINET && q.Qclass != dnsClassANY {
+		return newRefusedError("class " + classString(q.Qclass) + " not served")
+	}
+	z := srv.zones.find(q.Qname)
+	if z == nil {
+		return newRefusedError(q.Qname.String() + " is not in a served zone")
+	}
+	if !z.query.openTo(client, req.keyName()) {
+		return newRefusedError("query for " + q.Qname.String() + " refused to " + client.String())
+	}
+	if !z.serving() {
+		return newRcodeError(z.origin.String()+" has no fresh copy", rcodeServerFailure)
+	}
+	res.AA = true
+	t := z.snapshot()
+	var p *prover
+	if req.dnssecOK() && z.signer != nil {
+		p = &prover{t: t, origin: z.origin, signer: z.signer, res: res, co: req.compactOK()}
+		if p.co && z.signer.compact {
+			res.setEDNS(ednsUDPSize, true)
+			res.opt().Ttl |= ednsCO
+		}
+	}
+	authLookup(z, t, q.Qname, q.Qtype, p, res)
+	return nil
+}
+
+// authLookup runs the algorithm of RFC 1034 section 4.3.2 against one
+// snapshot of a zone, filling in res. With a prover the signatures and
+// denial records of a signed zone go along (RFC 4035 section 3.1).
+func authLookup(z *zone, t *zoneTree, qname dnsName, qtype uint16, p *prover, res *dnsMessage) {
+	for chain := 0; chain < maxCNAMEChain; chain++ {
+		if cut := findCut(t, z.origin, qname, qtype); cut != nil {
+			res.Authority = append(res.Authority, cut.rrset(dnsTypeNS)...)
+			if len(res.Answer) == 0 {
+				res.AA = false
+			}
+			p.delegation(cut)
+			break
+		}
+
+		node := t.get(qname)
+		if node == nil {
+			ce := t.closestEncloser(qname)
+			if ce.labelCount() == qname.labelCount() {
+				// Empty non-terminal
+				addNegativeSOA(z, t, res)
+				p.soa()
+				p.nodata(qname, nil)
+				break
+			}
+			wild, ok := ce.prepend("*")
+			if node = t.get(wild); !ok || node == nil {
+				res.Rcode = rcodeNameError
+				addNegativeSOA(z, t, res)
+				p.soa()
+				p.nxdomain(qname, ce, wild)
+				break
+			}
+			p.expanded(qname, ce)
+		}
+
+		if qtype == dnsTypeANY {
+			for _, rrs := range node.rrsets {
+				res.Answer = append(res.Answer, withOwner(rrs, qname)...)
+			}
+			break
+		}
+		if rrs := node.rrset(qtype); rrs != nil {
+			res.Answer = append(res.Answer, withOwner(rrs, qname)...)
+			p.sigs(node, qtype, qname)
+			break
+		}
+		cname := node.rrset(dnsTypeCNAME)
+		if cname == nil {
+			addNegativeSOA(z, t, res)
+			p.soa()
+			p.nodata(qname, node)
+			break
+		}
+		res.Answer = append(res.Answer, withOwner(cname, qname)...)
+		p.sigs(node, dnsTypeCNAME, qname)
+		rd, ok := cname[0].rdata()
+		if !ok {
+			break
+		}
+		target := rd.(*dnsRdataName).Target
+		if !target.isSubdomainOf(z.origin) {
+			// The client resolves names outside the zone itself.
+			break
+		}
+		qname = target
+	}
+	addAdditional(t, res)
+}
+
+// findCut returns the delegation point above qname, nil when qname is
+// served by this zone. A DS query at the cut itself is answered by the
+// parent side.
+func findCut(t *zoneTree, origin, qname dnsName, qtype uint16) *zoneNode {
+	for i := origin.labelCount() + 1; i <= qname.labelCount(); i++ {
+		n := qname.suffix(i)
+		if i == qname.labelCount() && qtype == dnsTypeDS {
+			break
+		}
+		if node := t.get(n); node.rrset(dnsTypeNS) != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// withOwner copies rrs with the owner set to name, so wildcard answers
+// carry the query name and the question's case is kept.
+func withOwner(rrs []dnsRR, name dnsName) []dnsRR {
+	out := make([]dnsRR, len(rrs))
+	for i, rr := range rrs {
+		rr.Name = name
+		out[i] = rr
+	}
+	return out
+}
+
+// addNegativeSOA puts the SOA in the authority section with the TTL
+// lowered to the negative caching TTL (RFC 2308 section 3).
+func addNegativeSOA(z *zone, t *zoneTree, res *dnsMessage) {
+	rrs := t.get(z.origin).rrset(dnsTypeSOA)
+	if len(rrs) == 0 {
+		return
+	}
+	soa := rrs[0]
+	if rd, ok := soa.rdata(); ok && rd.(*dnsRdataSOA).Minttl < soa.Ttl {
+		soa.Ttl = rd.(*dnsRdataSOA).Minttl
+	}
+	res.Authority = append(res.Authority, soa)
+}
+
+// addAdditional adds addresses held in the zone for the names that
+// NS, MX and SRV records in the answer and authority sections point to.
+func addAdditional(t *zoneTree, res *dnsMessage) {
+	seen := make(map[string]bool)
+	for _, section := range [][]dnsRR{res.Answer, res.Authority} {
+		for i := range section {
+			var target dnsName
+			switch rd, _ := section[i].rdata(); rd := rd.(type) {
+			case *dnsRdataName:
+				if section[i].Type != dnsTypeNS {
+					continue
+				}
+				target = rd.Target
+			case *dnsRdataMX:
+				target = rd.Mx
+			case *dnsRdataSRV:
+				target = rd.Target
+			default:
+				continue
+			}
+			if seen[target.key()] {
+				continue
+			}
+			seen[target.key()] = true
+			node := t.get(target)
+			res.Additional = append(res.Additional, node.rrset(dnsTypeA)...)
+			res.Additional = append(res.Additional, node.rrset(dnsTypeAAAA)...)
+		}
+	}
+}
+
+// packResponse packs res to fit in limit octets: the additional section
+// but for the OPT record goes first, and if that is not enough the answer
+// is truncated (TC).
+func packResponse(res *dnsMessage, limit int) ([]byte, bool) {
+	resBytes, ok := res.Pack()
+	if !ok || len(resBytes) <= limit {
+		return resBytes, ok
+	}
+	opt := res.opt()
+	res.Additional = nil
+	if opt != nil {
+		res.Additional = []dnsRR{*opt}
+	}
+	if resBytes, ok = res.Pack(); !ok || len(resBytes) <= limit {
+		return resBytes, ok
+	}
+	res.TC = true
+	res.Answer, res.Authority = nil, nil
+	return res.Pack()
+}
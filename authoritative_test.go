@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testAuthZone = `$ORIGIN example.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 3600 1209600 300
+@	NS	ns
+ns	A	192.0.2.53
+www	A	192.0.2.1
+alias	CNAME	www
+*.wild	TXT	"wildcard"
+a.b.ent	A	192.0.2.2
+sub	NS	ns.sub
+ns.sub	A	192.0.2.54
+`
+
+func testAuthServer(t *testing.T) *authServer {
+	origin := mustParseName("example.")
+	rrs, err := parseZone(strings.NewReader(testAuthZone), "test", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := newZoneSet()
+	zs.add(newZone(origin, rrs))
+	return &authServer{zones: zs}
+}
+
+// testClient is where test queries come from.
+var testClient = net.ParseIP("192.0.2.100")
+
+func testQuery(name string, qtype uint16) *dnsMessage {
+	return &dnsMessage{
+		dnsHeader: dnsHeader{Id: 1},
+		Question:  []dnsQuestion{{mustParseName(name), qtype, dnsClassINET}},
+	}
+}
+
+func TestAuthServe(t *testing.T) {
+	srv := testAuthServer(t)
+	tests := []struct {
+		name                string
+		qtype               uint16
+		rcode               int
+		aa                  bool
+		answer, auth, extra int
+	}{
+		{"www.example.", dnsTypeA, rcodeSuccess, true, 1, 0, 0},
+		{"WWW.Example.", dnsTypeA, rcodeSuccess, true, 1, 0, 0},
+		{"www.example.", dnsTypeAAAA, rcodeSuccess, true, 0, 1, 0},
+		{"nx.example.", dnsTypeA, rcodeNameError, true, 0, 1, 0},
+		{"alias.example.", dnsTypeA, rcodeSuccess, true, 2, 0, 0},
+		{"x.y.wild.example.", dnsTypeTXT, rcodeSuccess, true, 1, 0, 0},
+		{"b.ent.example.", dnsTypeA, rcodeSuccess, true, 0, 1, 0},
+		{"host.sub.example.", dnsTypeA, rcodeSuccess, false, 0, 1, 1},
+		{"example.", dnsTypeNS, rcodeSuccess, true, 1, 0, 1},
+		{"example.org.", dnsTypeA, rcodeRefused, false, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		res := srv.serve(testQuery(tt.name, tt.qtype), testClient)
+		if res.Rcode != tt.rcode || res.AA != tt.aa || len(res.Answer) != tt.answer ||
+			len(res.Authority) != tt.auth || len(res.Additional) != tt.extra {
+			t.Errorf("%s %s: rcode %d aa %v sections %d/%d/%d", tt.name, typeString(tt.qtype),
+				res.Rcode, res.AA, len(res.Answer), len(res.Authority), len(res.Additional))
+		}
+	}
+
+	res := srv.serve(testQuery("x.y.wild.example.", dnsTypeTXT), testClient)
+	if res.Answer[0].Name.String() != "x.y.wild.example." {
+		t.Errorf("wildcard owner %v", res.Answer[0].Name)
+	}
+	res = srv.serve(testQuery("WWW.Example.", dnsTypeA), testClient)
+	if res.Answer[0].Name.String() != "WWW.Example." {
+		t.Errorf("case not preserved: %v", res.Answer[0].Name)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Automated updates of trust anchors (RFC 5011). With a state file
+// configured, the SEP keys of each anchor zone go through the states of
+// RFC 5011 section 4 and the file keeps them across restarts.
+
+const (
+	addHoldDown    = 30 * 24 * time.Hour
+	removeHoldDown = 30 * 24 * time.Hour
+	minRefresh     = time.Hour // also the retry time after a failure
+	maxRefresh     = 15 * 24 * time.Hour
+)
+
+// Key states. Keys in Start or Removed are not kept.
+const (
+	keyAddPend = "addpend"
+	keyValid   = "valid"
+	keyMissing = "missing"
+	keyRevoked = "revoked"
+)
+
+// anchorFile is the layout of the state file.
+type anchorFile struct {
+	Anchors []*anchorState `json:"anchors"`
+}
+
+type anchorState struct {
+	Zone        string       `json:"zone"`
+	Keys        []*anchorKey `json:"keys"`
+	LastRefresh time.Time    `json:"last_refresh"`
+	NextRefresh time.Time    `json:"next_refresh"`
+
+	zone       dnsName
+	refreshing bool
+}
+
+type anchorKey struct {
+	DNSKEY string    `json:"dnskey"` // rdata in zone file syntax, REVOKE clear
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"` // of the last change of state
+
+	key *dnsRdataDNSKEY
+}
+
+func (k *anchorKey) set(state string, now time.Time) {
+	k.State, k.Since = state, now
+}
+
+// sameKey compares keys whether or not one of them is revoked.
+func sameKey(a, b *dnsRdataDNSKEY) bool {
+	return a.Algorithm == b.Algorithm && bytes.Equal(a.PublicKey, b.PublicKey)
+}
+
+// loadAnchors reads the state file, if there is one yet, and makes the
+// trusted keys in it the anchors of their zones. Configured anchors not
+// in the file are bootstrapped at their first refresh.
+func (v *validator) loadAnchors(path string) error {
+	var f anchorFile
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return wrapError(err)
+	default:
+		if err := json.Unmarshal(data, &f); err != nil {
+			return newError(path + ": " + err.Error())
+		}
+	}
+
+	v.stateFile = path
+	v.managed = make(map[string]*anchorState)
+	for _, as := range f.Anchors {
+		zone, err := parseZoneName(as.Zone, rootName)
+		if err != nil {
+			return newError(path + ": " + err.Error())
+		}
+		as.zone = zone
+		for _, k := range as.Keys {
+			rrs, err := parseZone(strings.NewReader(zone.String()+" 0 IN DNSKEY "+k.DNSKEY), path, rootName)
+			if err != nil {
+				return err
+			}
+			rd, ok := rrs[0].rdata()
+			if !ok {
+				return newError(path + ": bad DNSKEY " + k.DNSKEY)
+			}
+			k.key = rd.(*dnsRdataDNSKEY)
+		}
+		if v.anchors[zone.key()] == nil {
+			v.anchors[zone.key()] = &trustAnchor{zone: zone}
+		}
+		v.managed[zone.key()] = as
+		v.applyAnchor(as)
+	}
+	for key, ta := range v.anchors {
+		if v.managed[key] == nil {
+			v.managed[key] = &anchorState{Zone: ta.zone.String(), zone: ta.zone}
+		}
+	}
+	return nil
+}
+
+// applyAnchor makes the Valid and Missing keys of as its zone's anchor.
+// Until a key got that far, the configured anchor stays in use.
+func (v *validator) applyAnchor(as *anchorState) {
+	var keys []*dnsRdataDNSKEY
+	pending := true
+	for _, k := range as.Keys {
+		switch k.State {
+		case keyValid, keyMissing:
+			keys = append(keys, k.key)
+			pending = false
+		case keyRevoked:
+			pending = false
+		}
+	}
+	if pending {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ta := v.anchors[as.zone.key()]
+	ta.ds, ta.keys = nil, keys
+	delete(v.keys, as.zone.key())
+}
+
+// anchorKeys returns what ta currently trusts.
+func (v *validator) anchorKeys(ta *trustAnchor) ([]*dnsRdataDS, []*dnsRdataDNSKEY) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return ta.ds, ta.keys
+}
+
+// saveAnchors writes the state file, replacing it only once the new one
+// is complete.
+func (v *validator) saveAnchors() error {
+	var f anchorFile
+	for _, as := range v.managed {
+		for _, k := range as.Keys {
+			rr := newRR(as.zone, dnsTypeDNSKEY, 0, k.key)
+			k.DNSKEY = rr.rdataString(false)
+		}
+		f.Anchors = append(f.Anchors, as)
+	}
+	sort.Slice(f.Anchors, func(i, j int) bool { return f.Anchors[i].Zone < f.Anchors[j].Zone })
+	data, err := json.MarshalIndent(&f, "", "\t")
+	if err != nil {
+		return wrapError(err)
+	}
+	tmp := v.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return wrapError(err)
+	}
+	if err := os.Rename(tmp, v.stateFile); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// refreshAnchor fetches the DNSKEY set of a managed anchor zone when the
+// refresh is due (RFC 5011 section 2.3) and records what changed.
+func (r *resolver) refreshAnchor(ctx context.Context, st *lookupState, as *anchorState) {
+	v := r.validator
+	now := v.now()
+	v.anchorMu.Lock()
+	if as.refreshing || now.Before(as.NextRefresh) {
+		v.anchorMu.Unlock()
+		return
+	}
+	as.refreshing = true
+	v.anchorMu.Unlock()
+
+	dss, trusted := v.anchorKeys(v.anchors[as.zone.key()])
+	res, _, err := r.iterate(ctx, st, as.zone, dnsTypeDNSKEY, 0)
+
+	v.anchorMu.Lock()
+	defer v.anchorMu.Unlock()
+	as.refreshing = false
+	if err != nil {
+		log.Printf("trust anchor refresh for %s: %v", as.zone, err)
+		as.NextRefresh = now.Add(minRefresh)
+		return
+	}
+	if err := as.update(res.Answer, dss, trusted, now); err != nil {
+		// Revocations may still have been recorded.
+		log.Printf("trust anchor refresh for %s: %v", as.zone, err)
+		as.NextRefresh = now.Add(minRefresh)
+	}
+	v.applyAnchor(as)
+	if err := v.saveAnchors(); err != nil {
+		log.Print(err)
+	}
+}
+
+// update applies the DNSKEY set in rrs, seen at now, to the key states.
+// Apart from revocations, which a key signs itself, changes are only
+// accepted from a set signed by a key trusted already.
+func (as *anchorState) update(rrs []dnsRR, dss []*dnsRdataDS, trusted []*dnsRdataDNSKEY, now time.Time) error {
+	var keyRRs []dnsRR
+	var keys []*dnsRdataDNSKEY
+	for _, rr := range rrs {
+		if rr.Type != dnsTypeDNSKEY || !rr.Name.equal(as.zone) {
+			continue
+		}
+		if rd, ok := rr.rdata(); ok {
+			keyRRs = append(keyRRs, rr)
+			keys = append(keys, rd.(*dnsRdataDNSKEY))
+		}
+	}
+	if len(keys) == 0 {
+		return newError("no DNSKEY set")
+	}
+	isTrusted := func(key *dnsRdataDNSKEY) bool {
+		for _, t := range trusted {
+			if sameKey(t, key) {
+				return true
+			}
+		}
+		for _, ds := range dss {
+			if dsMatches(ds, as.zone, key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	signed := make([]bool, len(keys))
+	var sig *dnsRdataRRSIG // by a trusted key
+	for _, sigRR := range sigsFor(rrs, as.zone, dnsTypeDNSKEY) {
+		rd, ok := sigRR.rdata()
+		if !ok {
+			continue
+		}
+		s := rd.(*dnsRdataRRSIG)
+		if !s.SignerName.equal(as.zone) || !sigValidAt(s, now) {
+			continue
+		}
+		for i, key := range keys {
+			if signed[i] || key.Algorithm != s.Algorithm || keyTag(key) != s.KeyTag ||
+				verifyRRSIG(s, key, keyRRs) != nil {
+				continue
+			}
+			signed[i] = true
+			if key.Flags&dnskeyRevoke == 0 && isTrusted(key) {
+				sig = s
+			}
+		}
+	}
+
+	bootstrap := true
+	for _, k := range as.Keys {
+		if k.State == keyValid || k.State == keyMissing {
+			bootstrap = false
+		}
+	}
+	find := func(key *dnsRdataDNSKEY) *anchorKey {
+		for _, k := range as.Keys {
+			if sameKey(k.key, key) {
+				return k
+			}
+		}
+		return nil
+	}
+	seen := make(map[*anchorKey]bool)
+	for i, key := range keys {
+		if key.Flags&dnskeySEP == 0 {
+			continue
+		}
+		k := find(key)
+		if key.Flags&dnskeyRevoke != 0 {
+			if k != nil && signed[i] {
+				if k.State != keyRevoked {
+					k.set(keyRevoked, now)
+				}
+				seen[k] = true
+			}
+			continue
+		}
+		if sig == nil {
+			continue
+		}
+		switch {
+		case k == nil:
+			k = &anchorKey{key: key}
+			k.set(keyAddPend, now)
+			if bootstrap && isTrusted(key) {
+				k.State = keyValid
+			}
+			as.Keys = append(as.Keys, k)
+		case k.State == keyAddPend && !now.Before(k.Since.Add(addHoldDown)):
+			k.set(keyValid, now)
+		case k.State == keyMissing:
+			k.set(keyValid, now)
+		}
+		seen[k] = true
+	}
+
+	var kept []*anchorKey
+	for _, k := range as.Keys {
+		switch {
+		case sig != nil && !seen[k] && k.State == keyAddPend:
+			continue // back to Start
+		case sig != nil && !seen[k] && k.State == keyValid:
+			k.set(keyMissing, now)
+		case k.State == keyRevoked && !now.Before(k.Since.Add(removeHoldDown)):
+			continue // Removed
+		}
+		kept = append(kept, k)
+	}
+	as.Keys = kept
+	if sig == nil {
+		return newError("DNSKEY set of " + as.zone.String() + " is not signed by a trust anchor")
+	}
+	as.LastRefresh = now
+	as.NextRefresh = now.Add(refreshInterval(sig, now))
+	return nil
+}
+
+// refreshInterval is the active refresh time of RFC 5011 section 2.3.
+func refreshInterval(sig *dnsRdataRRSIG, now time.Time) time.Duration {
+	d := min(maxRefresh, time.Duration(sig.OrigTTL)*time.Second/2)
+	if left := time.Unix(int64(sig.Expiration), 0).Sub(now) / 2; left < d {
+		d = left
+	}
+	return max(minRefresh, d)
+}
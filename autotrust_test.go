@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testSEPKey struct {
+	priv crypto.Signer
+	key  *dnsRdataDNSKEY
+}
+
+func newTestSEPKey(t *testing.T) *testSEPKey {
+	priv, key := testKey(t, algED25519)
+	key.Flags |= dnskeySEP
+	return &testSEPKey{priv, key}
+}
+
+// revoked returns the key with the REVOKE flag set.
+func (k *testSEPKey) revoked() *testSEPKey {
+	key := *k.key
+	key.Flags |= dnskeyRevoke
+	return &testSEPKey{k.priv, &key}
+}
+
+// testKeySet returns the root DNSKEY set of keys signed by signers.
+func testKeySet(t *testing.T, now time.Time, keys []*testSEPKey, signers ...*testSEPKey) []dnsRR {
+	var rrs []dnsRR
+	for _, k := range keys {
+		rrs = append(rrs, newRR(rootName, dnsTypeDNSKEY, 172800, k.key))
+	}
+	var sigs []dnsRR
+	for _, k := range signers {
+		sigs = append(sigs, testSign(t, k.priv, k.key, rootName, rrs, now))
+	}
+	return append(rrs, sigs...)
+}
+
+func (as *anchorState) stateOf(key *dnsRdataDNSKEY) string {
+	for _, k := range as.Keys {
+		if sameKey(k.key, key) {
+			return k.State
+		}
+	}
+	return ""
+}
+
+func TestAnchorStates(t *testing.T) {
+	a, b, c, stranger := newTestSEPKey(t), newTestSEPKey(t), newTestSEPKey(t), newTestSEPKey(t)
+	ds, _ := newDS(rootName, a.key, digestSHA256)
+	as := &anchorState{Zone: ".", zone: rootName}
+	day := 24 * time.Hour
+	now := time.Now()
+
+	steps := []struct {
+		what    string
+		after   time.Duration
+		keys    []*testSEPKey
+		signers []*testSEPKey
+		ok      bool
+		want    map[*testSEPKey]string
+	}{
+		{"bootstrap from the DS", 0, []*testSEPKey{a}, []*testSEPKey{a}, true,
+			map[*testSEPKey]string{a: keyValid}},
+		{"new keys wait", day, []*testSEPKey{a, b, c}, []*testSEPKey{a}, true,
+			map[*testSEPKey]string{a: keyValid, b: keyAddPend, c: keyAddPend}},
+		{"a key gone before the hold-down", 10 * day, []*testSEPKey{a, b}, []*testSEPKey{a}, true,
+			map[*testSEPKey]string{a: keyValid, b: keyAddPend, c: ""}},
+		{"untrusted set", day, []*testSEPKey{stranger}, []*testSEPKey{stranger}, false,
+			map[*testSEPKey]string{a: keyValid, b: keyAddPend, stranger: ""}},
+		{"hold-down over", 20 * day, []*testSEPKey{a, b}, []*testSEPKey{a}, true,
+			map[*testSEPKey]string{a: keyValid, b: keyValid}},
+		{"missing", day, []*testSEPKey{b}, []*testSEPKey{b}, true,
+			map[*testSEPKey]string{a: keyMissing, b: keyValid}},
+		{"back", day, []*testSEPKey{a, b}, []*testSEPKey{b}, true,
+			map[*testSEPKey]string{a: keyValid, b: keyValid}},
+		{"revoked without self-signature", day, []*testSEPKey{a.revoked(), b}, []*testSEPKey{b}, true,
+			map[*testSEPKey]string{a: keyMissing, b: keyValid}},
+		{"revoked", day, []*testSEPKey{a.revoked(), b}, []*testSEPKey{a.revoked(), b}, true,
+			map[*testSEPKey]string{a: keyRevoked, b: keyValid}},
+		{"revoked key no longer trusted", day, []*testSEPKey{a, c}, []*testSEPKey{a}, false,
+			map[*testSEPKey]string{a: keyRevoked, c: ""}},
+		{"removed", 30 * day, []*testSEPKey{b}, []*testSEPKey{b}, true,
+			map[*testSEPKey]string{a: "", b: keyValid}},
+	}
+	for _, step := range steps {
+		now = now.Add(step.after)
+		var trusted []*dnsRdataDNSKEY
+		for _, k := range as.Keys {
+			if k.State == keyValid || k.State == keyMissing {
+				trusted = append(trusted, k.key)
+			}
+		}
+		dss := []*dnsRdataDS{ds}
+		if len(trusted) > 0 {
+			dss = nil
+		}
+		err := as.update(testKeySet(t, now, step.keys, step.signers...), dss, trusted, now)
+		if (err == nil) != step.ok {
+			t.Errorf("%s: %v", step.what, err)
+		}
+		for k, want := range step.want {
+			if got := as.stateOf(k.key); got != want {
+				t.Errorf("%s: key %d is %q, want %q", step.what, keyTag(k.key), got, want)
+			}
+		}
+	}
+}
+
+func TestAnchorFile(t *testing.T) {
+	a, b := newTestSEPKey(t), newTestSEPKey(t)
+	ds, _ := newDS(rootName, a.key, digestSHA256)
+	rr := newRR(rootName, dnsTypeDS, 0, ds)
+	cfg := &config{DNSSEC: dnssecConfig{
+		TrustAnchors:    []string{rr.String()},
+		TrustAnchorFile: "root.json",
+	}, dir: t.TempDir()}
+
+	v, err := newValidator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := v.managed[rootName.key()]
+	if as == nil {
+		t.Fatal("root anchor not managed")
+	}
+	now := time.Now().Truncate(time.Second)
+	if err := as.update(testKeySet(t, now, []*testSEPKey{a, b}, a), []*dnsRdataDS{ds}, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	v.applyAnchor(as)
+	if err := v.saveAnchors(); err != nil {
+		t.Fatal(err)
+	}
+	// Half of what is left of the signature's day, not half the TTL.
+	if next := as.NextRefresh.Sub(now); next != 12*time.Hour {
+		t.Errorf("next refresh in %v", next)
+	}
+
+	v, err = newValidator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := v.anchors[rootName.key()]
+	dss, keys := v.anchorKeys(ta)
+	if len(dss) != 0 || len(keys) != 1 || !sameKey(keys[0], a.key) {
+		t.Errorf("anchor after reload: %v %v", dss, keys)
+	}
+	if got := v.managed[rootName.key()].stateOf(b.key); got != keyAddPend {
+		t.Errorf("second key is %q after reload", got)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(cfg.dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("left behind %v", tmp)
+	}
+}
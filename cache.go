@@ -0,0 +1,407 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// RRset cache for the resolver.
+
+// Trustworthiness of cached data, lowest first (RFC 2181 section 5.4.1).
+// Data never replaces cached data of a higher rank that is still valid.
+const (
+	trustAdditional    = iota + 1 // additional section, glue
+	trustAuthority                // authority section of a non-authoritative answer
+	trustAnswer                   // answer section of a non-authoritative answer
+	trustAuthAuthority            // authority section of an authoritative answer
+	trustAuthAnswer               // answer section of an authoritative answer
+)
+
+const (
+	defaultCacheSize      = 100000 // RRsets
+	defaultCacheMaxTTL    = 86400
+	defaultCacheNegMaxTTL = 10800 // RFC 2308 section 5
+)
+
+// Negative entries for NXDOMAIN are kept under this type: the name does
+// not exist for any type.
+const nxdomainType = 0
+
+type cacheKey struct {
+	name   string // dnsName.key()
+	rrtype uint16
+	class  uint16
+}
+
+// cacheEntry is an RRset with its RRSIGs, or for a negative entry the
+// SOA and denial of existence records that came with the NXDOMAIN or
+// NODATA answer. status says whether validation found it secure; data
+// picked up on the way to an answer is left unchecked.
+type cacheEntry struct {
+	key      cacheKey
+	rrs      []dnsRR
+	sigs     []dnsRR
+	trust    int
+	status   secStatus
+	expires  time.Time
+	negative bool
+	rcode    int
+}
+
+// rrCache holds RRsets up to a fixed number, dropping the least recently
+// used first.
+type rrCache struct {
+	size      int
+	minTTL    uint32
+	maxTTL    uint32
+	negMaxTTL uint32
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+func newRRCache(cfg cacheConfig) *rrCache {
+	c := &rrCache{
+		size:      cfg.Size,
+		minTTL:    cfg.MinTTL,
+		maxTTL:    cfg.MaxTTL,
+		negMaxTTL: cfg.NegMaxTTL,
+		now:       time.Now,
+		entries:   make(map[cacheKey]*list.Element),
+		lru:       list.New(),
+	}
+	if c.size <= 0 {
+		c.size = defaultCacheSize
+	}
+	if c.maxTTL == 0 {
+		c.maxTTL = defaultCacheMaxTTL
+	}
+	if c.negMaxTTL == 0 {
+		c.negMaxTTL = defaultCacheNegMaxTTL
+	}
+	return c
+}
+
+// get returns the RRset for name/rrtype if it is cached with at least
+// minTrust. The records are copies with the TTL counted down.
+func (c *rrCache) get(name dnsName, rrtype uint16, minTrust int) ([]dnsRR, int, bool) {
+	e := c.fetch(name, rrtype, minTrust, false)
+	if e == nil {
+		return nil, 0, false
+	}
+	return e.rrs, e.trust, true
+}
+
+// fetch returns a copy of a positive entry with the TTLs counted down.
+// With checked, data that has not been through validation is ignored.
+func (c *rrCache) fetch(name dnsName, rrtype uint16, minTrust int, checked bool) *cacheEntry {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.lookup(cacheKey{name.key(), rrtype, dnsClassINET}, now)
+	if e == nil || e.negative || e.trust < minTrust || (checked && e.status == secUnchecked) {
+		metricCacheMisses.Add(1)
+		return nil
+	}
+	metricCacheHits.Add(1)
+	return e.counted(now)
+}
+
+// counted copies e with the TTLs set to what is left of them.
+func (e *cacheEntry) counted(now time.Time) *cacheEntry {
+	ttl := remainingTTL(now, e.expires)
+	out := *e
+	out.rrs = withTTL(e.rrs, ttl)
+	out.sigs = withTTL(e.sigs, ttl)
+	return &out
+}
+
+// getNegative reports a cached NXDOMAIN for name or any name above it
+// (RFC 8020), or a cached NODATA for name/rrtype, with the SOA and proofs
+// to put in the authority section.
+func (c *rrCache) getNegative(name dnsName, rrtype uint16) (int, []dnsRR, secStatus, bool) {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	usable := func(e *cacheEntry) bool {
+		return e != nil && e.negative && e.status != secUnchecked
+	}
+	e := c.lookup(cacheKey{name.key(), rrtype, dnsClassINET}, now)
+	for n := name; !usable(e); n = n.parent() {
+		if e = c.lookup(cacheKey{n.key(), nxdomainType, dnsClassINET}, now); usable(e) {
+			break
+		}
+		if n.isRoot() {
+			return 0, nil, 0, false
+		}
+	}
+	metricCacheNegativeHits.Add(1)
+	e = e.counted(now)
+	return e.rcode, append(e.rrs, e.sigs...), e.status, true
+}
+
+// lookup finds a live entry and marks it used. c.mu is held.
+func (c *rrCache) lookup(key cacheKey, now time.Time) *cacheEntry {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return e
+}
+
+// put caches one RRset and the RRSIGs over it. The TTL of the set is the
+// lowest of its records, clamped to the configured range; a TTL of zero
+// is not cached.
+func (c *rrCache) put(rrs, sigs []dnsRR, trust int, status secStatus) {
+	if len(rrs) == 0 {
+		return
+	}
+	ttl := rrs[0].Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Ttl < ttl {
+			ttl = rr.Ttl
+		}
+	}
+	ttl = c.clamp(ttl, c.maxTTL)
+	c.insert(&cacheEntry{
+		key:    cacheKey{rrs[0].Name.key(), rrs[0].Type, rrs[0].Class},
+		rrs:    withTTL(rrs, ttl),
+		sigs:   withTTL(sigs, ttl),
+		trust:  trust,
+		status: status,
+	})
+}
+
+// putNegative caches an NXDOMAIN or NODATA answer for name/rrtype with
+// the records proving it. It lives for the SOA TTL or MINIMUM, whichever
+// is lower (RFC 2308 section 5).
+func (c *rrCache) putNegative(name dnsName, rrtype uint16, rcode int, soa dnsRR, proof []dnsRR, trust int, status secStatus) {
+	rd, ok := soa.rdata()
+	if !ok {
+		return
+	}
+	ttl := soa.Ttl
+	if m := rd.(*dnsRdataSOA).Minttl; m < ttl {
+		ttl = m
+	}
+	if rcode == rcodeNameError {
+		rrtype = nxdomainType
+	}
+	ttl = c.clamp(ttl, c.negMaxTTL)
+	c.insert(&cacheEntry{
+		key:      cacheKey{name.key(), rrtype, dnsClassINET},
+		rrs:      withTTL([]dnsRR{soa}, ttl),
+		sigs:     withTTL(proof, ttl),
+		trust:    trust,
+		status:   status,
+		negative: true,
+		rcode:    rcode,
+	})
+}
+
+func (c *rrCache) insert(e *cacheEntry) {
+	ttl := e.rrs[0].Ttl
+	if ttl == 0 {
+		return
+	}
+	now := c.now()
+	e.expires = now.Add(time.Duration(ttl) * time.Second)
+	key := e.key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		old := elem.Value.(*cacheEntry)
+		if old.trust > e.trust && now.Before(old.expires) {
+			return
+		}
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		metricCacheEvictions.Add(1)
+	}
+}
+
+func (c *rrCache) clamp(ttl, maxTTL uint32) uint32 {
+	// RFC 2181 section 8: values with the top bit set mean zero.
+	if ttl > 1<<31-1 {
+		ttl = 0
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+func (c *rrCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *rrCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// answer fills in result for qname/qtype from cached answers, not glue,
+// or from a cached negative answer. When only a CNAME is cached it is
+// added to result and its target returned. result.AD is cleared unless
+// everything used is secure.
+func (c *rrCache) answer(qname dnsName, qtype uint16, result *dnsMessage) (dnsName, bool) {
+	if qtype == dnsTypeANY {
+		return "", false
+	}
+	if e := c.fetch(qname, qtype, trustAnswer, true); e != nil {
+		result.Rcode = rcodeSuccess
+		result.Answer = append(append(result.Answer, e.rrs...), e.sigs...)
+		result.AD = result.AD && e.status == secSecure
+		return "", true
+	}
+	if rcode, authority, status, ok := c.getNegative(qname, qtype); ok {
+		result.Rcode = rcode
+		result.Authority = append(result.Authority, authority...)
+		result.AD = result.AD && status == secSecure
+		return "", true
+	}
+	if qtype == dnsTypeCNAME {
+		return "", false
+	}
+	e := c.fetch(qname, dnsTypeCNAME, trustAnswer, true)
+	if e == nil {
+		return "", false
+	}
+	rd, ok := e.rrs[0].rdata()
+	if !ok {
+		return "", false
+	}
+	result.Answer = append(append(result.Answer, e.rrs[0]), e.sigs...)
+	result.AD = result.AD && e.status == secSecure
+	return rd.(*dnsRdataName).Target, false
+}
+
+// cacheResponse stores the RRsets of a response from a server for zone,
+// with the given validation status. Records outside the zone are not
+// believed and are left out.
+func (c *rrCache) cacheResponse(res *dnsMessage, zone dnsName, status secStatus) {
+	answer, authority := trustAnswer, trustAuthority
+	if res.AA {
+		answer, authority = trustAuthAnswer, trustAuthAuthority
+	}
+	for _, s := range []struct {
+		rrs   []dnsRR
+		trust int
+	}{
+		{res.Answer, answer},
+		{res.Authority, authority},
+		{res.Additional, trustAdditional},
+	} {
+		for _, rrs := range splitRRsets(s.rrs) {
+			if rrs[0].Type != dnsTypeRRSIG && rrs[0].Name.isSubdomainOf(zone) {
+				c.put(rrs, sigsFor(s.rrs, rrs[0].Name, rrs[0].Type), s.trust, status)
+			}
+		}
+	}
+	c.cacheNegative(res, zone, authority, status)
+}
+
+// cacheNegative stores an NXDOMAIN or NODATA response under the name the
+// CNAME chain in the answer ends at. Without an SOA from the zone the
+// response is a referral or broken, and is not cached.
+func (c *rrCache) cacheNegative(res *dnsMessage, zone dnsName, trust int, status secStatus) {
+	if len(res.Question) != 1 || (res.Rcode != rcodeSuccess && res.Rcode != rcodeNameError) {
+		return
+	}
+	q := res.Question[0]
+	if q.Qtype == dnsTypeANY {
+		return
+	}
+	name, answered := chainEnd(res, q.Qname, q.Qtype)
+	if answered || !name.isSubdomainOf(zone) {
+		return
+	}
+	for _, rr := range res.Authority {
+		if rr.Type == dnsTypeSOA && name.isSubdomainOf(rr.Name) && rr.Name.isSubdomainOf(zone) {
+			c.putNegative(name, q.Qtype, res.Rcode, rr, denialRecords(res.Authority), trust, status)
+			return
+		}
+	}
+}
+
+// chainEnd follows the CNAME chain for qname in the answer section to
+// its last name, and reports whether that name has qtype data there.
+func chainEnd(res *dnsMessage, qname dnsName, qtype uint16) (dnsName, bool) {
+	name := qname
+chain:
+	for seen := 0; seen < maxCNAMEChain; seen++ {
+		for _, rr := range res.Answer {
+			if !rr.Name.equal(name) {
+				continue
+			}
+			if rr.Type == qtype || qtype == dnsTypeANY {
+				return name, true
+			}
+			if rr.Type == dnsTypeCNAME {
+				rd, ok := rr.rdata()
+				if !ok {
+					break chain
+				}
+				name = rd.(*dnsRdataName).Target
+				continue chain
+			}
+		}
+		break
+	}
+	return name, false
+}
+
+// splitRRsets groups records by owner, type and class, keeping the order
+// in which the sets first appear.
+func splitRRsets(rrs []dnsRR) [][]dnsRR {
+	var sets [][]dnsRR
+	index := make(map[cacheKey]int)
+	for _, rr := range rrs {
+		key := cacheKey{rr.Name.key(), rr.Type, rr.Class}
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], rr)
+	}
+	return sets
+}
+
+// withTTL copies rrs with every TTL set to ttl.
+func withTTL(rrs []dnsRR, ttl uint32) []dnsRR {
+	out := make([]dnsRR, len(rrs))
+	for i, rr := range rrs {
+		rr.Ttl = ttl
+		out[i] = rr
+	}
+	return out
+}
+
+// remainingTTL rounds up, so nothing is handed out with TTL 0 before it
+// has actually expired.
+func remainingTTL(now, expires time.Time) uint32 {
+	d := expires.Sub(now)
+	return uint32((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func testCache(size int, minTTL, maxTTL uint32) (*rrCache, *testClock) {
+	clock := &testClock{time.Unix(1000000000, 0)}
+	c := newRRCache(cacheConfig{Size: size, MinTTL: minTTL, MaxTTL: maxTTL})
+	c.now = clock.now
+	return c, clock
+}
+
+func testA(name string, ttl uint32, last byte) dnsRR {
+	return newRR(mustParseName(name), dnsTypeA, ttl, &dnsRdataA{[]byte{192, 0, 2, last}})
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, clock := testCache(10, 0, 0)
+	c.put([]dnsRR{testA("www.example.", 300, 1), testA("www.example.", 100, 2)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("zero.example.", 0, 1)}, nil, trustAuthAnswer, secSecure)
+
+	rrs, _, ok := c.get(mustParseName("WWW.example."), dnsTypeA, trustAnswer)
+	if !ok || len(rrs) != 2 || rrs[0].Ttl != 100 || rrs[1].Ttl != 100 {
+		t.Fatalf("fresh: %v %v", ok, rrs)
+	}
+	clock.t = clock.t.Add(40*time.Second + time.Millisecond)
+	if rrs, _, _ := c.get(mustParseName("www.example."), dnsTypeA, trustAnswer); rrs[0].Ttl != 60 {
+		t.Errorf("after 40s: TTL %d", rrs[0].Ttl)
+	}
+	clock.t = clock.t.Add(60 * time.Second)
+	if _, _, ok := c.get(mustParseName("www.example."), dnsTypeA, trustAnswer); ok {
+		t.Error("expired RRset returned")
+	}
+	if _, _, ok := c.get(mustParseName("zero.example."), dnsTypeA, 0); ok {
+		t.Error("TTL 0 cached")
+	}
+}
+
+func TestCacheClamp(t *testing.T) {
+	c, _ := testCache(10, 30, 3600)
+	c.put([]dnsRR{testA("low.example.", 5, 1)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("high.example.", 604800, 1)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("neg.example.", 1<<31, 1)}, nil, trustAuthAnswer, secSecure)
+	for name, want := range map[string]uint32{"low.example.": 30, "high.example.": 3600, "neg.example.": 30} {
+		rrs, _, ok := c.get(mustParseName(name), dnsTypeA, 0)
+		if !ok || rrs[0].Ttl != want {
+			t.Errorf("%s: %v %v, want TTL %d", name, ok, rrs, want)
+		}
+	}
+}
+
+func TestCacheTrust(t *testing.T) {
+	c, clock := testCache(10, 0, 0)
+	name := mustParseName("ns.example.")
+	c.put([]dnsRR{testA("ns.example.", 300, 1)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("ns.example.", 300, 2)}, nil, trustAdditional, secSecure)
+	if rrs, trust, _ := c.get(name, dnsTypeA, 0); trust != trustAuthAnswer || rrs[0].Rdata[3] != 1 {
+		t.Errorf("glue replaced an authoritative answer: trust %d", trust)
+	}
+
+	c.put([]dnsRR{testA("glue.example.", 300, 1)}, nil, trustAdditional, secSecure)
+	if _, _, ok := c.get(mustParseName("glue.example."), dnsTypeA, trustAnswer); ok {
+		t.Error("glue returned as an answer")
+	}
+	c.put([]dnsRR{testA("glue.example.", 300, 2)}, nil, trustAnswer, secSecure)
+	if rrs, _, ok := c.get(mustParseName("glue.example."), dnsTypeA, trustAnswer); !ok || rrs[0].Rdata[3] != 2 {
+		t.Error("answer did not replace glue")
+	}
+
+	// Once expired, lower ranked data is accepted again.
+	clock.t = clock.t.Add(time.Hour)
+	c.put([]dnsRR{testA("ns.example.", 300, 3)}, nil, trustAdditional, secSecure)
+	if rrs, _, ok := c.get(name, dnsTypeA, 0); !ok || rrs[0].Rdata[3] != 3 {
+		t.Error("expired answer kept")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c, _ := testCache(3, 0, 0)
+	c.put([]dnsRR{testA("a.example.", 300, 1)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("b.example.", 300, 1)}, nil, trustAuthAnswer, secSecure)
+	c.put([]dnsRR{testA("c.example.", 300, 1)}, nil, trustAuthAnswer, secSecure)
+	c.get(mustParseName("a.example."), dnsTypeA, 0)
+	c.put([]dnsRR{testA("d.example.", 300, 1)}, nil, trustAuthAnswer, secSecure)
+	if c.len() != 3 {
+		t.Errorf("%d entries", c.len())
+	}
+	for name, want := range map[string]bool{"a.example.": true, "b.example.": false, "c.example.": true, "d.example.": true} {
+		if _, _, ok := c.get(mustParseName(name), dnsTypeA, 0); ok != want {
+			t.Errorf("%s cached: %v", name, ok)
+		}
+	}
+}
+
+func TestCacheResponseBailiwick(t *testing.T) {
+	c, _ := testCache(10, 0, 0)
+	res := &dnsMessage{
+		Authority:  []dnsRR{newRR(mustParseName("example."), dnsTypeNS, 300, &dnsRdataName{mustParseName("ns.example.")})},
+		Additional: []dnsRR{testA("ns.example.", 300, 1), testA("www.other.", 300, 1)},
+	}
+	c.cacheResponse(res, mustParseName("example."), secSecure)
+	if _, trust, ok := c.get(mustParseName("example."), dnsTypeNS, 0); !ok || trust != trustAuthority {
+		t.Errorf("NS: %v trust %d", ok, trust)
+	}
+	if _, _, ok := c.get(mustParseName("www.other."), dnsTypeA, 0); ok {
+		t.Error("out-of-bailiwick record cached")
+	}
+}
+
+func testSOA(zone string, ttl, minimum uint32) dnsRR {
+	origin := mustParseName(zone)
+	ns, _ := origin.prepend("ns")
+	mbox, _ := origin.prepend("hostmaster")
+	return newRR(origin, dnsTypeSOA, ttl, &dnsRdataSOA{ns, mbox, 1, 7200, 3600, 1209600, minimum})
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, clock := testCache(10, 0, 0)
+	c.putNegative(mustParseName("nx.example."), dnsTypeA, rcodeNameError, testSOA("example.", 3600, 300), nil, trustAuthAuthority, secSecure)
+	c.putNegative(mustParseName("www.example."), dnsTypeAAAA, rcodeSuccess, testSOA("example.", 60, 300), nil, trustAuthAuthority, secSecure)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ok    bool
+		rcode int
+		ttl   uint32
+	}{
+		{"nx.example.", dnsTypeA, true, rcodeNameError, 300},
+		{"nx.example.", dnsTypeMX, true, rcodeNameError, 300},
+		{"a.b.NX.example.", dnsTypeTXT, true, rcodeNameError, 300}, // RFC 8020
+		{"www.example.", dnsTypeAAAA, true, rcodeSuccess, 60},
+		{"www.example.", dnsTypeA, false, 0, 0},
+		{"example.", dnsTypeA, false, 0, 0},
+	}
+	for _, tt := range tests {
+		rcode, soa, _, ok := c.getNegative(mustParseName(tt.name), tt.qtype)
+		if ok != tt.ok || (ok && (rcode != tt.rcode || len(soa) != 1 || soa[0].Ttl != tt.ttl)) {
+			t.Errorf("%s %s: %v rcode %d %v", tt.name, typeString(tt.qtype), ok, rcode, soa)
+		}
+	}
+	if _, _, ok := c.get(mustParseName("www.example."), dnsTypeAAAA, 0); ok {
+		t.Error("negative entry returned as an RRset")
+	}
+
+	clock.t = clock.t.Add(61 * time.Second)
+	if _, _, _, ok := c.getNegative(mustParseName("www.example."), dnsTypeAAAA); ok {
+		t.Error("NODATA outlived the SOA TTL")
+	}
+	clock.t = clock.t.Add(240 * time.Second)
+	if _, _, _, ok := c.getNegative(mustParseName("nx.example."), dnsTypeA); ok {
+		t.Error("NXDOMAIN outlived the SOA MINIMUM")
+	}
+}
+
+func TestCacheNegativeResponse(t *testing.T) {
+	c, _ := testCache(10, 0, 0)
+	zone := mustParseName("example.")
+	res := &dnsMessage{
+		dnsHeader: dnsHeader{AA: true, Rcode: rcodeNameError},
+		Question:  []dnsQuestion{{mustParseName("alias.example."), dnsTypeA, dnsClassINET}},
+		Answer:    []dnsRR{newRR(mustParseName("alias.example."), dnsTypeCNAME, 300, &dnsRdataName{mustParseName("gone.example.")})},
+		Authority: []dnsRR{testSOA("example.", 3600, 300)},
+	}
+	c.cacheResponse(res, zone, secSecure)
+	if rcode, _, _, ok := c.getNegative(mustParseName("gone.example."), dnsTypeA); !ok || rcode != rcodeNameError {
+		t.Error("NXDOMAIN at the end of the chain not cached")
+	}
+	if _, _, _, ok := c.getNegative(mustParseName("alias.example."), dnsTypeA); ok {
+		t.Error("NXDOMAIN cached for the CNAME owner")
+	}
+
+	// A referral has no SOA and says nothing negative.
+	ref := &dnsMessage{
+		Question:  []dnsQuestion{{mustParseName("www.sub.example."), dnsTypeA, dnsClassINET}},
+		Authority: []dnsRR{newRR(mustParseName("sub.example."), dnsTypeNS, 300, &dnsRdataName{mustParseName("ns.sub.example.")})},
+	}
+	c.cacheResponse(ref, zone, secSecure)
+	if _, _, _, ok := c.getNegative(mustParseName("www.sub.example."), dnsTypeA); ok {
+		t.Error("referral cached as NODATA")
+	}
+}
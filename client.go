@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// Outgoing queries, used by the resolver and the forwarder.
+
+// Largest response accepted over UDP.
+const maxUDPResponse = 4096
+
+// newQuery builds a query with a random ID.
+func newQuery(qname dnsName, qtype uint16, rd bool) *dnsMessage {
+	var id [2]byte
+	rand.Read(id[:])
+	q := new(dnsMessage)
+	q.Id = binary.BigEndian.Uint16(id[:])
+	q.RD = rd
+	q.Question = []dnsQuestion{{qname, qtype, dnsClassINET}}
+	return q
+}
+
+// withPort adds the DNS port to addr unless it has one.
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// exchange sends q to server ("host:port") and returns the response,
+// retrying over TCP when the UDP answer is truncated.
+func exchange(ctx context.Context, server string, q *dnsMessage, timeout time.Duration) (*dnsMessage, error) {
+	res, err := exchangeUDP(ctx, server, q, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.TC {
+		return exchangeTCP(ctx, server, q, timeout)
+	}
+	return res, nil
+}
+
+func exchangeUDP(ctx context.Context, server string, q *dnsMessage, timeout time.Duration) (*dnsMessage, error) {
+	reqBytes, err := packQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn, timeout)
+
+	if _, err := conn.Write(reqBytes); err != nil {
+		return nil, wrapError(err)
+	}
+	buf := make([]byte, maxUDPResponse)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		// Ignore anything that does not answer our question; a
+		// spoofed packet must not end the wait for the real one. A
+		// TSIG error does answer it.
+		if res, err := parseResponse(q, buf[:n]); err == nil || tsigRejected(err) {
+			return res, err
+		}
+	}
+}
+
+func exchangeTCP(ctx context.Context, server string, q *dnsMessage, timeout time.Duration) (*dnsMessage, error) {
+	reqBytes, err := packQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn, timeout)
+
+	if err := writeTCPMessage(conn, reqBytes); err != nil {
+		return nil, err
+	}
+	resBytes, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(q, resBytes)
+}
+
+func setDeadline(ctx context.Context, conn net.Conn, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+}
+
+// packQuery packs q, signed when it carries a TSIG state.
+func packQuery(q *dnsMessage) ([]byte, error) {
+	reqBytes, ok := q.Pack()
+	if !ok {
+		return nil, newError("failed pack query")
+	}
+	if q.tsig != nil {
+		reqBytes = q.tsig.sign(reqBytes)
+	}
+	return reqBytes, nil
+}
+
+// parseResponse unpacks resBytes and checks that it answers q, and is
+// signed by q's TSIG key if q was.
+func parseResponse(q *dnsMessage, resBytes []byte) (*dnsMessage, error) {
+	res := new(dnsMessage)
+	if err := res.Unpack(resBytes); err != nil {
+		return nil, err
+	}
+	if res.Id != q.Id || !res.QR {
+		return nil, newError("response does not match the query ID")
+	}
+	if len(res.Question) != 1 || !res.Question[0].Qname.equal(q.Question[0].Qname) ||
+		res.Question[0].Qtype != q.Question[0].Qtype || res.Question[0].Qclass != q.Question[0].Qclass {
+		return nil, newError("response does not match the question")
+	}
+	if q.tsig != nil {
+		if err := q.tsig.verifyResponse(resBytes, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// TCP messages are preceded by a two octet length (RFC 1035 4.2.2).
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := w.Write(buf); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, wrapError(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, wrapError(err)
+	}
+	return msg, nil
+}
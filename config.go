@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// config is read from the JSON file given with --config. Relative paths
+// inside it are relative to the file itself.
+type config struct {
+	Zones     []zoneConfig  `json:"zones"`
+	RootHints []string      `json:"root_hints"`
+	Cache     cacheConfig   `json:"cache"`
+	Forward   forwardConfig `json:"forward"`
+
+	// Named ACLs, which the lists below and those of the zones can use
+	// by name.
+	ACLs map[string][]string `json:"acls"`
+
+	// Clients that may query; everyone when unset.
+	AllowQuery []string `json:"allow_query"`
+
+	// Clients that may recurse; when unset, in hybrid mode the local
+	// host, otherwise those allowed to query.
+	RecursionACL []string `json:"recursion_acl"`
+
+	// Defaults for the zones' lists of the same name.
+	AllowTransfer []string `json:"allow_transfer"`
+	AllowUpdate   []string `json:"allow_update"`
+	AllowNotify   []string `json:"allow_notify"`
+
+	// "relaxed" (default), "strict" or "off"
+	QnameMinimisation string `json:"qname_minimisation"`
+
+	DNSSEC dnssecConfig `json:"dnssec"`
+
+	// Keys for signed transfers, updates and NOTIFYs; ACLs name them as
+	// "key NAME".
+	TSIGKeys []tsigKeyConfig `json:"tsig_keys"`
+
+	// Limits the rate of UDP responses of the authoritative server when
+	// set.
+	RateLimit *rateLimitConfig `json:"rate_limit"`
+
+	dir  string
+	acls *aclSet
+}
+
+// dnssecConfig controls validation in the resolver. Trust anchors are DS
+// or DNSKEY records in zone file syntax; the root KSKs when unset.
+type dnssecConfig struct {
+	Validation           string   `json:"validation"` // "on" (default) or "off"
+	TrustAnchors         []string `json:"trust_anchors"`
+	NegativeTrustAnchors []string `json:"negative_trust_anchors"`
+
+	// Keeps the anchors up to date by RFC 5011 when set.
+	TrustAnchorFile string `json:"trust_anchor_file"`
+}
+
+// cacheConfig bounds the resolver cache. Zero values pick the defaults.
+type cacheConfig struct {
+	Size      int    `json:"size"`    // RRsets
+	MinTTL    uint32 `json:"min_ttl"` // seconds
+	MaxTTL    uint32 `json:"max_ttl"`
+	NegMaxTTL uint32 `json:"negative_max_ttl"`
+}
+
+// forwardConfig lists the upstreams for --forward. Rules send the names
+// under a domain elsewhere; everything else goes to Upstreams.
+type forwardConfig struct {
+	Upstreams []string            `json:"upstreams"`
+	Strategy  string              `json:"strategy"` // "failover" or "parallel"
+	Rules     []forwardRuleConfig `json:"rules"`
+}
+
+type forwardRuleConfig struct {
+	Domain    string   `json:"domain"`
+	Upstreams []string `json:"upstreams"`
+	Strategy  string   `json:"strategy"`
+}
+
+type tsigKeyConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"` // "hmac-sha256" (default), "hmac-sha384" or "hmac-sha512"
+	Secret    string `json:"secret"`    // base64
+}
+
+// rateLimitConfig sets up response rate limiting. The NXDOMAIN and
+// error rates are the response rate when unset; a rate of zero does not
+// limit. Zero values of the rest pick the defaults: a 15 second window,
+// a slip of 2, and netblocks of /24 and /56.
+type rateLimitConfig struct {
+	ResponsesPerSecond uint32   `json:"responses_per_second"`
+	NXDomainsPerSecond uint32   `json:"nxdomains_per_second"`
+	ErrorsPerSecond    uint32   `json:"errors_per_second"`
+	Window             uint32   `json:"window"` // seconds
+	Slip               *int     `json:"slip"`   // every slip-th dropped response goes out truncated; 0 for none
+	IPv4PrefixLength   int      `json:"ipv4_prefix_length"`
+	IPv6PrefixLength   int      `json:"ipv6_prefix_length"`
+	Exempt             []string `json:"exempt_clients"` // an ACL
+	LogOnly            bool     `json:"log_only"`       // count and log, but send everything
+}
+
+// rateLimiter returns the configured rate limiter, nil for none.
+func (cfg *config) rateLimiter() (*rateLimiter, error) {
+	rc := cfg.RateLimit
+	if rc == nil {
+		return nil, nil
+	}
+	if rc.IPv4PrefixLength < 0 || rc.IPv4PrefixLength > 32 || rc.IPv6PrefixLength < 0 || rc.IPv6PrefixLength > 128 {
+		return nil, newError("bad rate_limit prefix length")
+	}
+	if rc.Slip != nil && *rc.Slip < 0 {
+		return nil, newError("bad rate_limit slip")
+	}
+	exempt, err := cfg.acl(rc.Exempt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimiter(rc, exempt), nil
+}
+
+type zoneConfig struct {
+	Origin string         `json:"origin"`
+	File   string         `json:"file"`   // changes are journaled in File + ".jnl"
+	DNSSEC *signingConfig `json:"dnssec"` // signs the zone when set
+
+	// Clients that may query the zone. Like the lists below it falls
+	// back on the global one of the same name; when that is unset too,
+	// everyone may query.
+	AllowQuery []string `json:"allow_query"`
+
+	// Secondaries that may transfer the zone; nobody when unset.
+	AllowTransfer []string `json:"allow_transfer"`
+
+	// Clients that may send dynamic updates; nobody when unset.
+	AllowUpdate []string `json:"allow_update"`
+
+	// Makes this a secondary zone copied from these servers ("address"
+	// or "address:port"). File is then where the copy is kept, if
+	// anywhere.
+	Primaries []string `json:"primaries"`
+
+	// Who may NOTIFY a secondary zone; when unset the primaries, or
+	// whoever holds Key.
+	AllowNotify []string `json:"allow_notify"`
+
+	// Secondaries sent a NOTIFY whenever the serial changes.
+	Notify []string `json:"notify"`
+
+	// The TSIG key that signs transfers from the primaries and NOTIFYs
+	// to the secondaries. A secondary then takes NOTIFY only signed
+	// with it.
+	Key string `json:"key"`
+}
+
+// signingConfig sets up online signing of a zone. Zero values pick the
+// defaults: ECDSAP256SHA256, NSEC, signatures valid for 14 days and
+// renewed when a quarter of that is left, keys that never roll, an hour
+// for changes to propagate and two days for the parent to follow CDS.
+type signingConfig struct {
+	Algorithm   string       `json:"algorithm"`
+	KeyDir      string       `json:"key_dir"`  // the configuration's directory when unset
+	Validity    uint32       `json:"validity"` // seconds, like all times below
+	Refresh     uint32       `json:"refresh"`
+	NSEC3       *nsec3Config `json:"nsec3"`   // NSEC3 instead of NSEC when set
+	Compact     bool         `json:"compact"` // denial signed per query (RFC 9824), no chain
+	ZSKLifetime uint32       `json:"zsk_lifetime"`
+	KSKLifetime uint32       `json:"ksk_lifetime"`
+	Propagation uint32       `json:"propagation"`
+	ParentDelay uint32       `json:"parent_delay"` // includes the parent's DS TTL
+}
+
+type nsec3Config struct {
+	Iterations uint16 `json:"iterations"`
+	Salt       string `json:"salt"`    // hex
+	OptOut     bool   `json:"opt_out"` // leave unsigned delegations out of the chain
+}
+
+func loadConfig(path string) (*config, error) {
+	cfg := new(config)
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, newError(path + ": " + err.Error())
+	}
+	switch cfg.QnameMinimisation {
+	case "", qnameMinRelaxed, qnameMinStrict, qnameMinOff:
+	default:
+		return nil, newError(path + ": unknown qname_minimisation " + cfg.QnameMinimisation)
+	}
+	switch cfg.DNSSEC.Validation {
+	case "", "on", "off":
+	default:
+		return nil, newError(path + ": unknown dnssec validation " + cfg.DNSSEC.Validation)
+	}
+	cfg.dir = filepath.Dir(path)
+	for name := range cfg.ACLs {
+		if name == "any" || name == "none" || strings.ContainsAny(name, "!/ ") || net.ParseIP(name) != nil {
+			return nil, newError(path + ": bad ACL name " + name)
+		}
+		if _, err := cfg.acl([]string{name}, nil); err != nil {
+			return nil, newError(path + ": " + err.Error())
+		}
+	}
+	return cfg, nil
+}
+
+// acl parses entries, or global when entries is unset, which may use the
+// named ACLs. The result is nil when both are unset.
+func (cfg *config) acl(entries, global []string) (acl, error) {
+	if cfg.acls == nil {
+		cfg.acls = newACLSet(cfg.ACLs)
+	}
+	if entries == nil {
+		entries = global
+	}
+	return cfg.acls.parse(entries)
+}
+
+// path resolves a file name from the configuration.
+func (cfg *config) path(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(cfg.dir, name)
+}
+
+// loadKeys reads the TSIG keys.
+func (cfg *config) loadKeys() (tsigKeyring, error) {
+	keys := make(tsigKeyring)
+	for _, kc := range cfg.TSIGKeys {
+		k, err := newTSIGKey(kc.Name, kc.Algorithm, kc.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if keys[k.name.key()] != nil {
+			return nil, newError("TSIG key " + kc.Name + " defined twice")
+		}
+		keys[k.name.key()] = k
+	}
+	return keys, nil
+}
+
+// loadZones reads every configured zone file.
+func (cfg *config) loadZones(keys tsigKeyring) (*zoneSet, error) {
+	zs := newZoneSet()
+	for _, zc := range cfg.Zones {
+		z, err := zc.load(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := zc.loadAccess(cfg, z, keys); err != nil {
+			return nil, err
+		}
+		zs.add(z)
+	}
+	return zs, nil
+}
+
+func (zc *zoneConfig) load(cfg *config) (*zone, error) {
+	origin, err := parseZoneName(zc.Origin, rootName)
+	if err != nil {
+		return nil, err
+	}
+	if len(zc.Primaries) > 0 {
+		return zc.loadSecondary(cfg, origin)
+	}
+	rrs, err := loadZoneFile(cfg.path(zc.File), origin)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkZone(origin, rrs); err != nil {
+		return nil, err
+	}
+	z := newZone(origin, rrs)
+	z.file = cfg.path(zc.File)
+	if err := z.openJournal(z.file + ".jnl"); err != nil {
+		return nil, err
+	}
+	z.setNotify(zc.Notify)
+	if zc.DNSSEC != nil {
+		dir := cfg.path(zc.DNSSEC.KeyDir)
+		if dir == "" {
+			dir = cfg.path(".")
+		}
+		if z.signer, err = newZoneSigner(origin, zc.DNSSEC, dir); err != nil {
+			return nil, err
+		}
+		if err := z.resign(); err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
+func (zc *zoneConfig) loadSecondary(cfg *config, origin dnsName) (*zone, error) {
+	if zc.DNSSEC != nil {
+		return nil, newError("secondary zone " + origin.String() + " cannot be signed here")
+	}
+	z, err := newSecondaryZone(origin, cfg.path(zc.File), zc.Primaries)
+	if err != nil {
+		return nil, err
+	}
+	z.setNotify(zc.Notify)
+	return z, nil
+}
+
+// loadAccess sets up the key of z and who may do what with it.
+func (zc *zoneConfig) loadAccess(cfg *config, z *zone, keys tsigKeyring) error {
+	if zc.Key != "" {
+		name, err := parseName(zc.Key)
+		if err != nil {
+			return err
+		}
+		key := keys.get(name)
+		if key == nil {
+			return newError("zone " + zc.Origin + " uses unknown TSIG key " + zc.Key)
+		}
+		z.setKey(key)
+	}
+	var err error
+	if z.query, err = cfg.acl(zc.AllowQuery, cfg.AllowQuery); err != nil {
+		return err
+	}
+	if z.transfer, err = cfg.acl(zc.AllowTransfer, cfg.AllowTransfer); err != nil {
+		return err
+	}
+	if z.updaters, err = cfg.acl(zc.AllowUpdate, cfg.AllowUpdate); err != nil {
+		return err
+	}
+	notifiers, err := cfg.acl(zc.AllowNotify, cfg.AllowNotify)
+	if err != nil {
+		return err
+	}
+	if notifiers != nil && z.secondary != nil {
+		z.secondary.notifiers = notifiers
+	}
+	return nil
+}
+
+// checkZone rejects data that cannot be served: records outside the
+// zone and a missing or duplicated SOA.
+func checkZone(origin dnsName, rrs []dnsRR) error {
+	soa := 0
+	for i := range rrs {
+		rr := &rrs[i]
+		if !rr.Name.isSubdomainOf(origin) {
+			return newError(rr.Name.String() + " is outside zone " + origin.String())
+		}
+		if rr.Type == dnsTypeSOA {
+			if !rr.Name.equal(origin) {
+				return newError("SOA not at the apex of " + origin.String())
+			}
+			soa++
+		}
+	}
+	if soa != 1 {
+		return newError("zone " + origin.String() + " needs exactly one SOA")
+	}
+	return nil
+}
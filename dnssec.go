@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"hash"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DNSSEC record formats and the cryptography shared by validation and
+// signing (RFC 4034, RFC 4035, RFC 5155).
+
+// DNSKEY flags
+const (
+	dnskeyZone   = 1 << 8
+	dnskeyRevoke = 1 << 7 // RFC 5011
+	dnskeySEP    = 1
+)
+
+// Algorithms we implement (RFC 8624 section 3.1)
+const (
+	algRSASHA256       = 8
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+const (
+	nsec3HashSHA1 = 1
+	nsec3OptOut   = 1 // NSEC3 flags
+
+	// Zones using more iterations are treated as insecure (RFC 9276).
+	maxNSEC3Iterations = 150
+)
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type dnsRdataDS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (rd *dnsRdataDS) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.KeyTag, "KeyTag", "") &&
+		f(&rd.Algorithm, "Algorithm", "") &&
+		f(&rd.DigestType, "DigestType", "") &&
+		f(&rd.Digest, "Digest", "")
+}
+
+type dnsRdataDNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (rd *dnsRdataDNSKEY) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Flags, "Flags", "") &&
+		f(&rd.Protocol, "Protocol", "") &&
+		f(&rd.Algorithm, "Algorithm", "") &&
+		f(&rd.PublicKey, "PublicKey", "base64")
+}
+
+type dnsRdataRRSIG struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTTL     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  dnsName
+	Signature   []byte
+}
+
+func (rd *dnsRdataRRSIG) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return rd.walkHeader(f) && f(&rd.Signature, "Signature", "base64")
+}
+
+// walkHeader walks everything but the signature, which is the part of
+// the RRSIG that is itself signed.
+func (rd *dnsRdataRRSIG) walkHeader(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.TypeCovered, "TypeCovered", "type") &&
+		f(&rd.Algorithm, "Algorithm", "") &&
+		f(&rd.Labels, "Labels", "") &&
+		f(&rd.OrigTTL, "OrigTTL", "") &&
+		f(&rd.Expiration, "Expiration", "time") &&
+		f(&rd.Inception, "Inception", "time") &&
+		f(&rd.KeyTag, "KeyTag", "") &&
+		f(&rd.SignerName, "SignerName", "domain")
+}
+
+type rrsigHeader struct{ *dnsRdataRRSIG }
+
+func (h rrsigHeader) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return h.walkHeader(f)
+}
+
+type dnsRdataNSEC struct {
+	NextDomain dnsName
+	TypeBitmap []byte
+}
+
+func (rd *dnsRdataNSEC) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.NextDomain, "NextDomain", "domain") && f(&rd.TypeBitmap, "TypeBitmap", "bitmap")
+}
+
+type dnsRdataNSEC3 struct {
+	HashAlg    uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+	NextHashed []byte
+	TypeBitmap []byte
+}
+
+func (rd *dnsRdataNSEC3) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.HashAlg, "HashAlg", "") &&
+		f(&rd.Flags, "Flags", "") &&
+		f(&rd.Iterations, "Iterations", "") &&
+		f(&rd.Salt, "Salt", "salt") &&
+		f(&rd.NextHashed, "NextHashed", "base32") &&
+		f(&rd.TypeBitmap, "TypeBitmap", "bitmap")
+}
+
+type dnsRdataNSEC3PARAM struct {
+	HashAlg    uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+}
+
+func (rd *dnsRdataNSEC3PARAM) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.HashAlg, "HashAlg", "") &&
+		f(&rd.Flags, "Flags", "") &&
+		f(&rd.Iterations, "Iterations", "") &&
+		f(&rd.Salt, "Salt", "salt")
+}
+
+// sigsFor picks the RRSIGs over name/t out of rrs.
+func sigsFor(rrs []dnsRR, name dnsName, t uint16) []dnsRR {
+	var sigs []dnsRR
+	for _, rr := range rrs {
+		if rr.Type != dnsTypeRRSIG || !rr.Name.equal(name) || len(rr.Rdata) < 2 {
+			continue
+		}
+		if binary.BigEndian.Uint16(rr.Rdata) == t {
+			sigs = append(sigs, rr)
+		}
+	}
+	return sigs
+}
+
+// denialRecords picks the NSEC and NSEC3 records of an authority section
+// and the RRSIGs there.
+func denialRecords(rrs []dnsRR) []dnsRR {
+	var out []dnsRR
+	for _, rr := range rrs {
+		switch rr.Type {
+		case dnsTypeNSEC, dnsTypeNSEC3, dnsTypeRRSIG:
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// packRdata returns the wire form of rd.
+func packRdata(rd Walker) ([]byte, bool) {
+	// Most rdata is small; only retry with the largest buffer on failure.
+	buf := make([]byte, 512)
+	off, ok := packWalker(rd, buf, 0)
+	if !ok {
+		buf = make([]byte, 0xffff)
+		if off, ok = packWalker(rd, buf, 0); !ok {
+			return nil, false
+		}
+	}
+	return append([]byte(nil), buf[:off]...), true
+}
+
+// keyTag computes the key tag of RFC 4034 appendix B.
+func keyTag(key *dnsRdataDNSKEY) uint16 {
+	b, _ := packRdata(key)
+	var ac uint32
+	for i, c := range b {
+		if i&1 == 0 {
+			ac += uint32(c) << 8
+		} else {
+			ac += uint32(c)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// dsDigest hashes owner and key as a DS record of digestType does.
+func dsDigest(owner dnsName, key *dnsRdataDNSKEY, digestType uint8) ([]byte, bool) {
+	var h hash.Hash
+	switch digestType {
+	case digestSHA1:
+		h = sha1.New()
+	case digestSHA256:
+		h = sha256.New()
+	case digestSHA384:
+		h = sha512.New384()
+	default:
+		return nil, false
+	}
+	b, ok := packRdata(key)
+	if !ok {
+		return nil, false
+	}
+	h.Write([]byte(owner.canonical()))
+	h.Write(b)
+	return h.Sum(nil), true
+}
+
+// newDS returns the DS record that refers to key.
+func newDS(owner dnsName, key *dnsRdataDNSKEY, digestType uint8) (*dnsRdataDS, bool) {
+	digest, ok := dsDigest(owner, key, digestType)
+	if !ok {
+		return nil, false
+	}
+	return &dnsRdataDS{keyTag(key), key.Algorithm, digestType, digest}, true
+}
+
+// dsMatches reports whether ds refers to key.
+func dsMatches(ds *dnsRdataDS, owner dnsName, key *dnsRdataDNSKEY) bool {
+	if ds.KeyTag != keyTag(key) || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	digest, ok := dsDigest(owner, key, ds.DigestType)
+	return ok && bytes.Equal(digest, ds.Digest)
+}
+
+// canonicalRdata lowercases the names inside rdata of the types listed
+// in RFC 4034 section 6.2 as amended by RFC 6840 section 5.1.
+func canonicalRdata(rr *dnsRR) []byte {
+	switch rr.Type {
+	case dnsTypeNS, dnsTypeCNAME, dnsTypeSOA, dnsTypePTR, dnsTypeMX,
+		dnsTypeSRV, dnsTypeDNAME, dnsTypeRRSIG:
+	default:
+		return rr.Rdata
+	}
+	rd, ok := rr.rdata()
+	if !ok {
+		return rr.Rdata
+	}
+	rd.Walk(func(field interface{}, name, tag string) bool {
+		if n, ok := field.(*dnsName); ok {
+			*n = n.canonical()
+		}
+		return true
+	})
+	b, ok := packRdata(rd)
+	if !ok {
+		return rr.Rdata
+	}
+	return b
+}
+
+// signedData builds what an RRSIG signs: its own rdata up to the
+// signature, then the RRset in canonical form and order (RFC 4034
+// section 3.1.8.1).
+func signedData(sig *dnsRdataRRSIG, rrs []dnsRR) ([]byte, bool) {
+	hdr := *sig
+	hdr.SignerName = sig.SignerName.canonical()
+	data, ok := packRdata(rrsigHeader{&hdr})
+	if !ok {
+		return nil, false
+	}
+
+	// Owner name, with the wildcard restored for expanded answers.
+	owner := rrs[0].Name.canonical()
+	if n := owner.labelCount(); int(sig.Labels) < n {
+		owner, _ = owner.suffix(int(sig.Labels)).prepend("*")
+	} else if int(sig.Labels) > n {
+		return nil, false
+	}
+
+	rdatas := make([][]byte, 0, len(rrs))
+	for i := range rrs {
+		rdatas = append(rdatas, canonicalRdata(&rrs[i]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	var fixed [10]byte
+	for i, rd := range rdatas {
+		if i > 0 && bytes.Equal(rd, rdatas[i-1]) {
+			continue // duplicates count once
+		}
+		binary.BigEndian.PutUint16(fixed[0:], rrs[0].Type)
+		binary.BigEndian.PutUint16(fixed[2:], rrs[0].Class)
+		binary.BigEndian.PutUint32(fixed[4:], sig.OrigTTL)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rd)))
+		data = append(data, owner...)
+		data = append(data, fixed[:]...)
+		data = append(data, rd...)
+	}
+	return data, true
+}
+
+// sigValidAt checks the validity period with serial number arithmetic
+// (RFC 4034 section 3.1.5).
+func sigValidAt(sig *dnsRdataRRSIG, now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(sig.Expiration-t) >= 0 && int32(t-sig.Inception) >= 0
+}
+
+// verifyRRSIG checks that sig by key covers rrs, all of one RRset.
+func verifyRRSIG(sig *dnsRdataRRSIG, key *dnsRdataDNSKEY, rrs []dnsRR) error {
+	if len(rrs) == 0 || sig.TypeCovered != rrs[0].Type {
+		return newError("RRSIG does not cover the RRset")
+	}
+	// A revoked key still signs its own revocation (RFC 5011); callers
+	// leave such keys out everywhere else.
+	if key.Protocol != 3 || key.Flags&dnskeyZone == 0 {
+		return newError("not a usable zone key")
+	}
+	if sig.Algorithm != key.Algorithm || sig.KeyTag != keyTag(key) {
+		return newError("RRSIG is not by this key")
+	}
+	data, ok := signedData(sig, rrs)
+	if !ok {
+		return newError("bad RRSIG labels")
+	}
+
+	switch key.Algorithm {
+	case algRSASHA256:
+		pub, ok := rsaPublicKey(key.PublicKey)
+		if !ok {
+			return newError("bad RSA key")
+		}
+		h := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig.Signature); err != nil {
+			return wrapError(err)
+		}
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, size := elliptic.P256(), 32
+		var digest []byte
+		if key.Algorithm == algECDSAP384SHA384 {
+			curve, size = elliptic.P384(), 48
+			h := sha512.Sum384(data)
+			digest = h[:]
+		} else {
+			h := sha256.Sum256(data)
+			digest = h[:]
+		}
+		if len(key.PublicKey) != 2*size || len(sig.Signature) != 2*size {
+			return newError("bad ECDSA key or signature length")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		r := new(big.Int).SetBytes(sig.Signature[:size])
+		s := new(big.Int).SetBytes(sig.Signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return newError("ECDSA signature does not verify")
+		}
+	case algED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return newError("bad Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig.Signature) {
+			return newError("Ed25519 signature does not verify")
+		}
+	default:
+		return newError("unsupported algorithm " + strconv.Itoa(int(key.Algorithm)))
+	}
+	return nil
+}
+
+// algorithmSupported reports whether verifyRRSIG knows alg.
+func algorithmSupported(alg uint8) bool {
+	switch alg {
+	case algRSASHA256, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+// rsaPublicKey decodes the RFC 3110 format.
+func rsaPublicKey(b []byte) (*rsa.PublicKey, bool) {
+	if len(b) < 1 {
+		return nil, false
+	}
+	elen, off := int(b[0]), 1
+	if elen == 0 {
+		if len(b) < 3 {
+			return nil, false
+		}
+		elen, off = int(b[1])<<8|int(b[2]), 3
+	}
+	if elen == 0 || elen > 4 || off+elen >= len(b) {
+		return nil, false
+	}
+	e := 0
+	for _, c := range b[off : off+elen] {
+		e = e<<8 | int(c)
+	}
+	n := new(big.Int).SetBytes(b[off+elen:])
+	if n.BitLen() < 1024 {
+		return nil, false
+	}
+	return &rsa.PublicKey{N: n, E: e}, true
+}
+
+// Signature times are printed as YYYYMMDDHHmmSS in UTC (RFC 4034
+// section 3.2).
+const sigTimeFormat = "20060102150405"
+
+func formatSigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(sigTimeFormat)
+}
+
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == len(sigTimeFormat) {
+		t, err := time.Parse(sigTimeFormat, s)
+		if err != nil {
+			return 0, wrapError(err)
+		}
+		return uint32(t.Unix()), nil
+	}
+	i, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return uint32(i), nil
+}
+
+// typeBitmap encodes types as the windowed bitmap of NSEC and NSEC3
+// (RFC 4034 section 4.1.2).
+func typeBitmap(types []uint16) []byte {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var out []byte
+	var window [32]byte
+	cur, length := -1, 0
+	flush := func() {
+		if length > 0 {
+			out = append(out, byte(cur), byte(length))
+			out = append(out, window[:length]...)
+		}
+		window = [32]byte{}
+		length = 0
+	}
+	for _, t := range sorted {
+		if int(t>>8) != cur {
+			flush()
+			cur = int(t >> 8)
+		}
+		i := int(t&0xff) / 8
+		window[i] |= 0x80 >> (t & 7)
+		if i+1 > length {
+			length = i + 1
+		}
+	}
+	flush()
+	return out
+}
+
+// bitmapTypes decodes a type bitmap; ok is false when it is malformed.
+func bitmapTypes(b []byte) (types []uint16, ok bool) {
+	last := -1
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || b[1] > 32 || len(b) < 2+int(b[1]) || int(b[0]) <= last {
+			return types, false
+		}
+		last = int(b[0])
+		for i, c := range b[2 : 2+int(b[1])] {
+			for bit := 0; bit < 8; bit++ {
+				if c&(0x80>>bit) != 0 {
+					types = append(types, uint16(b[0])<<8|uint16(i*8+bit))
+				}
+			}
+		}
+		b = b[2+int(b[1]):]
+	}
+	return types, true
+}
+
+func bitmapHas(b []byte, t uint16) bool {
+	for len(b) >= 2 && len(b) >= 2+int(b[1]) {
+		if b[0] == byte(t>>8) {
+			i := int(t&0xff) / 8
+			return i < int(b[1]) && b[2+i]&(0x80>>(t&7)) != 0
+		}
+		b = b[2+int(b[1]):]
+	}
+	return false
+}
+
+// nsec3Hash is the iterated hash of RFC 5155 section 5.
+func nsec3Hash(name dnsName, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(name.canonical()))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+// nsecCovers reports whether an NSEC from owner to next proves that
+// name, strictly between them, does not exist. The last NSEC of a zone
+// points back to the apex.
+func nsecCovers(owner, next, name dnsName) bool {
+	if compareName(owner, next) < 0 {
+		return compareName(owner, name) < 0 && compareName(name, next) < 0
+	}
+	return compareName(owner, name) < 0 || compareName(name, next) < 0
+}
+
+// hashCovers is nsecCovers for NSEC3 hashes.
+func hashCovers(owner, next, h []byte) bool {
+	if bytes.Compare(owner, next) < 0 {
+		return bytes.Compare(owner, h) < 0 && bytes.Compare(h, next) < 0
+	}
+	return bytes.Compare(owner, h) < 0 || bytes.Compare(h, next) < 0
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey generates a zone signing key.
+func testKey(t *testing.T, alg uint8) (crypto.Signer, *dnsRdataDNSKEY) {
+	t.Helper()
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case algRSASHA256:
+		priv, err = rsa.GenerateKey(rand.Reader, 1024) // fast, just large enough
+	case algECDSAP256SHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algECDSAP384SHA384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case algED25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newSigningKey(priv, dnskeyZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.priv, k.dnskey
+}
+
+// testSign returns an RRSIG over rrs valid for a day around now.
+func testSign(t *testing.T, priv crypto.Signer, key *dnsRdataDNSKEY, signer dnsName, rrs []dnsRR, now time.Time) dnsRR {
+	t.Helper()
+	k := &signingKey{dnskey: key, tag: keyTag(key), priv: priv}
+	sig, err := signRRset(k, signer, rrs, uint32(now.Add(-time.Hour).Unix()), uint32(now.Add(24*time.Hour).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestKeyTagAndDS(t *testing.T) {
+	// 0x0101 + 0x0308 + 0xffff + 0xffff, with the carry folded in
+	key := &dnsRdataDNSKEY{Flags: 257, Protocol: 3, Algorithm: algRSASHA256, PublicKey: []byte{0xff, 0xff, 0xff, 0xff}}
+	if tag := keyTag(key); tag != 0x0409 {
+		t.Errorf("key tag %#x, want 0x409", tag)
+	}
+	_, key = testKey(t, algED25519)
+	for _, dt := range []uint8{digestSHA1, digestSHA256, digestSHA384} {
+		ds, ok := newDS(mustParseName("example.com."), key, dt)
+		if !ok || ds.KeyTag != keyTag(key) {
+			t.Fatalf("digest type %d: %v", dt, ds)
+		}
+		if !dsMatches(ds, mustParseName("EXAMPLE.com."), key) {
+			t.Errorf("digest type %d: DS does not match its key", dt)
+		}
+		if dsMatches(ds, mustParseName("other.example.com."), key) {
+			t.Errorf("digest type %d: DS matches under another owner", dt)
+		}
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+	for name, want := range map[string]string{
+		"example.":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.":   "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"*.w.example.": "r53bq7cc2uvmubfu5ocmm6pers9tk9en",
+	} {
+		got := strings.ToLower(base32Hex.EncodeToString(nsec3Hash(mustParseName(name), 12, salt)))
+		if got != want {
+			t.Errorf("%s: %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDNSSECRecordText(t *testing.T) {
+	zone := `$ORIGIN example.
+$TTL 3600
+@	DNSKEY	257 3 13 dGVzdA==
+@	DS	12345 13 2 0123456789abcdef
+@	RRSIG	A 13 1 3600 20240201000000 20240101000000 12345 example. c2lnbmF0dXJl
+@	NSEC	a.example. A NS SOA RRSIG NSEC DNSKEY TYPE65000
+0p9mhaveqvm6t7vbl5lop2u3t2rp3tom	NSEC3	1 1 12 AABBCCDD 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR NS SOA MX RRSIG DNSKEY NSEC3PARAM
+b	NSEC3	1 0 0 - 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR
+@	NSEC3PARAM	1 0 0 -
+`
+	rrs, err := parseZone(strings.NewReader(zone), "test", rootName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(zone), "\n")[2:]
+	for i, rr := range rrs {
+		fields := strings.Fields(lines[i])
+		want := strings.Join(fields[2:], " ")
+		if got := rr.rdataString(false); got != want {
+			t.Errorf("got  %s\nwant %s", got, want)
+		}
+		rd, ok := rr.rdata()
+		if !ok {
+			t.Errorf("%s: rdata does not unpack", rr.String())
+			continue
+		}
+		if packed, ok := packRdata(rd); !ok || string(packed) != string(rr.Rdata) {
+			t.Errorf("%s: rdata does not pack back", rr.String())
+		}
+	}
+}
+
+func TestTypeBitmap(t *testing.T) {
+	types := []uint16{dnsTypeA, dnsTypeNS, dnsTypeSOA, dnsTypeRRSIG, dnsTypeNSEC, 1234, 65000}
+	b := typeBitmap(types)
+	got, ok := bitmapTypes(b)
+	if !ok || len(got) != len(types) {
+		t.Fatalf("round trip: %v %v", got, ok)
+	}
+	for i := range types {
+		if got[i] != types[i] {
+			t.Errorf("type %d: %d, want %d", i, got[i], types[i])
+		}
+	}
+	if !bitmapHas(b, 1234) || bitmapHas(b, dnsTypeMX) || bitmapHas(b, 65001) {
+		t.Error("bitmapHas")
+	}
+	// A window with a zero length is invalid.
+	if _, ok := bitmapTypes([]byte{0, 0}); ok {
+		t.Error("accepted an empty window")
+	}
+}
+
+func TestVerifyRRSIG(t *testing.T) {
+	zone := mustParseName("example.")
+	now := time.Now()
+	rrs := []dnsRR{testA("www.example.", 300, 1), testA("www.example.", 300, 2)}
+	for _, alg := range []uint8{algRSASHA256, algECDSAP256SHA256, algECDSAP384SHA384, algED25519} {
+		priv, key := testKey(t, alg)
+		sigRR := testSign(t, priv, key, zone, rrs, now)
+		rd, _ := sigRR.rdata()
+		sig := rd.(*dnsRdataRRSIG)
+		// Order and case of the RRset do not matter.
+		reordered := []dnsRR{testA("WWW.example.", 300, 2), testA("www.example.", 300, 1)}
+		if err := verifyRRSIG(sig, key, reordered); err != nil {
+			t.Errorf("algorithm %d: %v", alg, err)
+		}
+		if err := verifyRRSIG(sig, key, rrs[:1]); err == nil {
+			t.Errorf("algorithm %d: verified a changed RRset", alg)
+		}
+		if !sigValidAt(sig, now) || sigValidAt(sig, now.Add(48*time.Hour)) {
+			t.Errorf("algorithm %d: validity period", alg)
+		}
+	}
+}
+
+// testZoneValidator trusts key for zone without asking anyone.
+func testZoneValidator(t *testing.T, zone dnsName, key *dnsRdataDNSKEY, nta ...string) *resolver {
+	t.Helper()
+	v, err := newValidator(&config{DNSSEC: dnssecConfig{
+		TrustAnchors:         []string{zone.String() + " DNSKEY 257 3 " + strconv.Itoa(int(key.Algorithm)) + " " + base64.StdEncoding.EncodeToString(key.PublicKey)},
+		NegativeTrustAnchors: nta,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.storeKeys(&zoneKeys{zone: zone, status: secSecure, keys: []*dnsRdataDNSKEY{key}, expires: time.Now().Add(time.Hour)})
+	return &resolver{validator: v, cache: newRRCache(cacheConfig{})}
+}
+
+func testNSEC(owner, next string, types ...uint16) dnsRR {
+	return newRR(mustParseName(owner), dnsTypeNSEC, 300, &dnsRdataNSEC{mustParseName(next), typeBitmap(types)})
+}
+
+func TestValidate(t *testing.T) {
+	zone := mustParseName("example.")
+	now := time.Now()
+	priv, key := testKey(t, algECDSAP256SHA256)
+	sign := func(rrs ...dnsRR) []dnsRR {
+		return append(rrs, testSign(t, priv, key, zone, rrs, now))
+	}
+	soa := sign(testSOA("example.", 3600, 300))
+	www := sign(testA("www.example.", 300, 1))
+	wild := testA("*.example.", 300, 9)
+	expanded := testSign(t, priv, key, zone, []dnsRR{wild}, now)
+	wild.Name = mustParseName("x.example.")
+	expanded.Name = wild.Name
+	forged := www[1]
+	forged.Name = mustParseName("ftp.example.")
+	apexNSEC := sign(testNSEC("example.", "www.example.", dnsTypeSOA, dnsTypeNS, dnsTypeRRSIG, dnsTypeNSEC))
+	wwwNSEC := sign(testNSEC("www.example.", "example.", dnsTypeA, dnsTypeRRSIG, dnsTypeNSEC))
+	subNSEC := sign(testNSEC("sub.example.", "www.example.", dnsTypeNS, dnsTypeRRSIG, dnsTypeNSEC))
+	dnameNSEC := sign(testNSEC("alias.example.", "sub.example.", dnsTypeDNAME, dnsTypeRRSIG, dnsTypeNSEC))
+	// The last NSEC of a child zone wraps around to its apex.
+	child := mustParseName("evil.example.")
+	childPriv, childKey := testKey(t, algECDSAP256SHA256)
+	childNSEC := []dnsRR{testNSEC("z.evil.example.", "a.evil.example.", dnsTypeA, dnsTypeRRSIG, dnsTypeNSEC)}
+	childNSEC = append(childNSEC, testSign(t, childPriv, childKey, child, childNSEC, now))
+
+	concat := func(sets ...[]dnsRR) []dnsRR {
+		var out []dnsRR
+		for _, s := range sets {
+			out = append(out, s...)
+		}
+		return out
+	}
+	tests := []struct {
+		what      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answer    []dnsRR
+		authority []dnsRR
+		want      secStatus
+	}{
+		{"signed answer", "www.example.", dnsTypeA, rcodeSuccess, www, nil, secSecure},
+		{"no RRSIG", "www.example.", dnsTypeA, rcodeSuccess, www[:1], nil, secBogus},
+		{"changed answer", "ftp.example.", dnsTypeA, rcodeSuccess,
+			[]dnsRR{testA("ftp.example.", 300, 1), forged}, nil, secBogus},
+		{"wildcard with proof", "x.example.", dnsTypeA, rcodeSuccess,
+			[]dnsRR{wild, expanded}, wwwNSEC, secSecure},
+		{"wildcard without proof", "x.example.", dnsTypeA, rcodeSuccess,
+			[]dnsRR{wild, expanded}, nil, secBogus},
+		{"wildcard with unsigned proof", "x.example.", dnsTypeA, rcodeSuccess,
+			[]dnsRR{wild, expanded}, wwwNSEC[:1], secBogus},
+		{"NODATA", "www.example.", dnsTypeMX, rcodeSuccess, nil, concat(soa, wwwNSEC), secSecure},
+		{"NODATA for existing type", "www.example.", dnsTypeA, rcodeSuccess, nil, concat(soa, wwwNSEC), secBogus},
+		// "zzz" sorts after www, the last name; "*" right after the apex.
+		{"NXDOMAIN", "zzz.example.", dnsTypeA, rcodeNameError, nil, concat(soa, wwwNSEC, apexNSEC), secSecure},
+		{"NXDOMAIN without wildcard proof", "zzz.example.", dnsTypeA, rcodeNameError, nil, concat(soa, wwwNSEC), secBogus},
+		// The parent side of a cut denies only the DS there, and a DNAME
+		// nothing below it.
+		{"NODATA at a cut", "sub.example.", dnsTypeA, rcodeSuccess, nil, concat(soa, subNSEC), secBogus},
+		{"NODATA below a cut", "host.sub.example.", dnsTypeAAAA, rcodeSuccess, nil, concat(soa, subNSEC), secBogus},
+		{"NXDOMAIN below a cut", "host.sub.example.", dnsTypeA, rcodeNameError, nil, concat(soa, subNSEC), secBogus},
+		{"no DS at a cut", "sub.example.", dnsTypeDS, rcodeSuccess, nil, concat(soa, subNSEC), secSecure},
+		{"NXDOMAIN below a DNAME", "x.alias.example.", dnsTypeA, rcodeNameError, nil, concat(soa, dnameNSEC), secBogus},
+		// A zone denies names of its own only.
+		{"NXDOMAIN in a child zone", "zz.evil.example.", dnsTypeA, rcodeNameError, nil, concat(soa, childNSEC), secSecure},
+		{"NXDOMAIN forged by a child zone", "aaa.example.", dnsTypeA, rcodeNameError, nil, concat(soa, childNSEC), secBogus},
+		{"unsigned denial", "zzz.example.", dnsTypeA, rcodeNameError, nil, soa[:1], secBogus},
+		{"outside the anchor", "www.other.", dnsTypeA, rcodeSuccess, []dnsRR{testA("www.other.", 300, 1)}, nil, secInsecure},
+		{"negative trust anchor", "www.broken.example.", dnsTypeA, rcodeSuccess, []dnsRR{testA("www.broken.example.", 300, 1)}, nil, secInsecure},
+	}
+	r := testZoneValidator(t, zone, key, "broken.example.")
+	r.validator.storeKeys(&zoneKeys{zone: child, status: secSecure, keys: []*dnsRdataDNSKEY{childKey}, expires: now.Add(time.Hour)})
+	for _, tt := range tests {
+		res := &dnsMessage{Answer: tt.answer, Authority: tt.authority}
+		res.Rcode = tt.rcode
+		zone := zone
+		if tt.qname == "www.other." {
+			zone = mustParseName("other.")
+		}
+		got, err := r.validate(context.Background(), &lookupState{}, res, zone, mustParseName(tt.qname), tt.qtype, 0)
+		if got != tt.want {
+			t.Errorf("%s: status %d, want %d (%v)", tt.what, got, tt.want, err)
+		}
+	}
+}
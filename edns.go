@@ -0,0 +1,63 @@
+package main
+
+// EDNS(0) (RFC 6891). The OPT pseudo-record sits in the additional
+// section: its class is the requester's UDP payload size and its TTL
+// holds the extended RCODE, the version and the flags.
+
+const (
+	ednsDO      = 1 << 15 // DNSSEC OK (RFC 3225)
+	ednsCO      = 1 << 14 // compact answers OK (RFC 9824)
+	ednsUDPSize = 1232    // what we advertise and answer up to
+)
+
+// opt returns the OPT record of msg, nil without EDNS.
+func (msg *dnsMessage) opt() *dnsRR {
+	for i := range msg.Additional {
+		if msg.Additional[i].Type == dnsTypeOPT {
+			return &msg.Additional[i]
+		}
+	}
+	return nil
+}
+
+// udpSize is the largest UDP response the sender of msg accepts.
+func (msg *dnsMessage) udpSize() int {
+	opt := msg.opt()
+	if opt == nil || opt.Class < maxUDPSize {
+		return maxUDPSize
+	}
+	return int(opt.Class)
+}
+
+// dnssecOK reports whether the DO bit is set.
+func (msg *dnsMessage) dnssecOK() bool {
+	opt := msg.opt()
+	return opt != nil && opt.Ttl&ednsDO != 0
+}
+
+// compactOK reports whether the CO bit is set: the sender takes NXDOMAIN
+// with compact denial of existence.
+func (msg *dnsMessage) compactOK() bool {
+	opt := msg.opt()
+	return opt != nil && opt.Ttl&ednsCO != 0
+}
+
+// setEDNS adds an OPT record, replacing any present.
+func (msg *dnsMessage) setEDNS(size uint16, do bool) {
+	msg.clearEDNS()
+	opt := dnsRR{dnsRRHeader: dnsRRHeader{Name: rootName, Type: dnsTypeOPT, Class: size}}
+	if do {
+		opt.Ttl = ednsDO
+	}
+	msg.Additional = append(msg.Additional, opt)
+}
+
+func (msg *dnsMessage) clearEDNS() {
+	var rrs []dnsRR
+	for _, rr := range msg.Additional {
+		if rr.Type != dnsTypeOPT {
+			rrs = append(rrs, rr)
+		}
+	}
+	msg.Additional = rrs
+}
@@ -6,25 +6,150 @@ import (
 	"runtime"
 )
 
+// errorCategory classifies a failure by what the client should be told.
+type errorCategory int
+
+const (
+	errInternal       errorCategory = iota // answered with SERVFAIL
+	errFormat                              // answered with FORMERR
+	errRefused                             // answered with REFUSED
+	errNotImplemented                      // answered with NOTIMP
+	errRcode                               // an expected outcome with its own RCODE
+)
+
+var errorCategoryNames = [...]string{
+	errInternal:       "internal",
+	errFormat:         "format",
+	errRefused:        "refused",
+	errNotImplemented: "notimp",
+	errRcode:          "rcode",
+}
+
+var rcodeNames = map[int]string{
+	rcodeSuccess:        "NOERROR",
+	rcodeFormatError:    "FORMERR",
+	rcodeServerFailure:  "SERVFAIL",
+	rcodeNameError:      "NXDOMAIN",
+	rcodeNotImplemented: "NOTIMP",
+	rcodeRefused:        "REFUSED",
+	rcodeYXDomain:       "YXDOMAIN",
+	rcodeYXRRSet:        "YXRRSET",
+	rcodeNXRRSet:        "NXRRSET",
+	rcodeNotAuth:        "NOTAUTH",
+	rcodeNotZone:        "NOTZONE",
+}
+
+func (c errorCategory) String() string {
+	if int(c) < len(errorCategoryNames) {
+		return errorCategoryNames[c]
+	}
+	return fmt.Sprintf("category%d", int(c))
+}
+
+// rcode returns the response code for the category.
+func (c errorCategory) rcode() int {
+	switch c {
+	case errFormat:
+		return rcodeFormatError
+	case errRefused:
+		return rcodeRefused
+	case errNotImplemented:
+		return rcodeNotImplemented
+	}
+	return rcodeServerFailure
+}
+
 type errorWrapper struct {
-	err  error
-	file string
-	line int
+	err      error
+	file     string
+	line     int
+	category errorCategory
+	rcode    int // explicit RCODE, -1 to use the category's one
+	offset   int // offset into the offending message, -1 if unknown
 }
 
 // Implementation of ``error''.
 func (e *errorWrapper) Error() string {
-	return fmt.Sprintf("%s at %s:%d", e.err.Error(), e.file, e.line)
+	label := e.category.String()
+	if e.category == errRcode {
+		label = rcodeNames[e.rcode]
+		if label == "" {
+			label = fmt.Sprintf("rcode%d", e.rcode)
+		}
+	}
+	s := fmt.Sprintf("%s: %s", label, e.err.Error())
+	if e.offset >= 0 {
+		s += fmt.Sprintf(" (offset %d)", e.offset)
+	}
+	return fmt.Sprintf("%s at %s:%d", s, e.file, e.line)
+}
+
+// Unwrap gives errors.Is and errors.As access to the original error.
+func (e *errorWrapper) Unwrap() error {
+	return e.err
+}
+
+// Rcode returns the response code a handler should answer with.
+func (e *errorWrapper) Rcode() int {
+	if e.rcode >= 0 {
+		return e.rcode
+	}
+	return e.category.rcode()
 }
 
 // Acts as croak of Perl
 func newError(msg string) error {
 	_, file, line, _ := runtime.Caller(1)
-	return &errorWrapper{errors.New(msg), file, line}
+	return &errorWrapper{errors.New(msg), file, line, errInternal, -1, -1}
 }
 
-// Append file name and line number
+// Append file name and line number.
+// The category, RCODE and offset of a wrapped errorWrapper are inherited.
 func wrapError(err error) error {
 	_, file, line, _ := runtime.Caller(1)
-	return &errorWrapper{err, file, line}
+	e := &errorWrapper{err, file, line, errInternal, -1, -1}
+	var inner *errorWrapper
+	if errors.As(err, &inner) {
+		e.category, e.rcode, e.offset = inner.category, inner.rcode, inner.offset
+	}
+	return e
+}
+
+// newFormatError reports a malformed message detected at offset off.
+func newFormatError(msg string, off int) error {
+	_, file, line, _ := runtime.Caller(1)
+	return &errorWrapper{errors.New(msg), file, line, errFormat, -1, off}
+}
+
+// newRefusedError reports a request denied by policy.
+func newRefusedError(msg string) error {
+	_, file, line, _ := runtime.Caller(1)
+	return &errorWrapper{errors.New(msg), file, line, errRefused, -1, -1}
+}
+
+// newNotImplementedError reports a request kind the server does not support.
+func newNotImplementedError(msg string) error {
+	_, file, line, _ := runtime.Caller(1)
+	return &errorWrapper{errors.New(msg), file, line, errNotImplemented, -1, -1}
+}
+
+// newRcodeError reports an expected outcome answered with an explicit
+// RCODE, e.g. NXRRSET, NOTAUTH or SERVFAIL for a zone without data. It
+// is logged under the RCODE's name, apart from internal failures.
+func newRcodeError(msg string, rcode int) error {
+	_, file, line, _ := runtime.Caller(1)
+	return &errorWrapper{errors.New(msg), file, line, errRcode, rcode, -1}
+}
+
+// errorRcode converts any error into the response code to answer with.
+// Errors not created by this file are internal failures.
+func errorRcode(err error) int {
+	if err == nil {
+		return rcodeSuccess
+	}
+	var e *errorWrapper
+	if errors.As(err, &e) {
+		return e.Rcode()
+	}
+	return rcodeServerFailure
 }
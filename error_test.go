@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorRcodes(t *testing.T) {
+	tests := []struct {
+		err    error
+		prefix string
+		rcode  int
+	}{
+		{newError("broken"), "internal: ", rcodeServerFailure},
+		{newFormatError("short header", 3), "format: ", rcodeFormatError},
+		{newRefusedError("not here"), "refused: ", rcodeRefused},
+		{newNotImplementedError("no IQUERY"), "notimp: ", rcodeNotImplemented},
+		{newRcodeError("www.example. has no MX", rcodeNXRRSet), "NXRRSET: ", rcodeNXRRSet},
+		{wrapError(newRcodeError("bad key", rcodeNotAuth)), "NOTAUTH: ", rcodeNotAuth},
+	}
+	for _, tt := range tests {
+		if !strings.HasPrefix(tt.err.Error(), tt.prefix) || errorRcode(tt.err) != tt.rcode {
+			t.Errorf("%v: rcode %d, want %q and %d", tt.err, errorRcode(tt.err), tt.prefix, tt.rcode)
+		}
+	}
+}
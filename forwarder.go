@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Forwarding resolver for --forward: queries go to upstream resolvers,
+// chosen per domain, and the answers are cached as in --recursive.
+
+const (
+	forwardTimeout     = 2 * time.Second
+	upstreamMaxFails   = 3                // consecutive failures before an upstream is skipped
+	upstreamDownPeriod = 30 * time.Second // how long it is skipped
+)
+
+// Ways of using the upstreams of a rule.
+const (
+	strategyFailover = "failover" // in the configured order, next on failure
+	strategyParallel = "parallel" // all at once, the fastest answer wins
+)
+
+func forwardMain(cfg *config, udpFd int, tcpFd int, udp int, tcp int) error {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+
+	if udpFd < 0 && udp < 0 {
+		return newError("Select UDP as udp or udpfd")
+	}
+
+	f, err := newForwarder(cfg)
+	if err != nil {
+		return err
+	}
+	allowed, err := cfg.acl(cfg.RecursionACL, cfg.AllowQuery)
+	if err != nil {
+		return err
+	}
+	srv := &recursiveServer{resolver: f, allowed: allowed}
+	log.Printf("forward started pid:%d udpFd:%d tcpFd:%d rules:%d", os.Getpid(), udpFd, tcpFd, len(f.rules))
+
+	return listenAndServe(udpFd, tcpFd, udp, tcp, srv)
+}
+
+// upstream is one resolver we forward to, with its health.
+type upstream struct {
+	addr string
+
+	mu        sync.Mutex
+	fails     int
+	downUntil time.Time
+	srtt      time.Duration // smoothed round trip time
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+func (u *upstream) success(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails = 0
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt = (7*u.srtt + rtt) / 8
+	}
+}
+
+func (u *upstream) failure(now time.Time) {
+	metricForwardFailures.Add(1)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.fails++; u.fails >= upstreamMaxFails {
+		if !now.Before(u.downUntil) {
+			log.Printf("upstream %s marked down", u.addr)
+		}
+		u.downUntil = now.Add(upstreamDownPeriod)
+	}
+}
+
+// forwardRule sends the names under domain to its upstreams.
+type forwardRule struct {
+	domain    dnsName
+	upstreams []*upstream
+	strategy  string
+}
+
+type forwarder struct {
+	rules   []*forwardRule // most specific domain first; the root rule is the default
+	cache   *rrCache
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func newForwarder(cfg *config) (*forwarder, error) {
+	f := &forwarder{
+		cache:   newRRCache(cfg.Cache),
+		timeout: forwardTimeout,
+		now:     time.Now,
+	}
+	fc := cfg.Forward
+	if len(fc.Upstreams) > 0 {
+		rule, err := newForwardRule(".", fc.Upstreams, fc.Strategy)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+	}
+	for _, rc := range fc.Rules {
+		strategy := rc.Strategy
+		if strategy == "" {
+			strategy = fc.Strategy
+		}
+		rule, err := newForwardRule(rc.Domain, rc.Upstreams, strategy)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+	}
+	if len(f.rules) == 0 {
+		return nil, newError("no upstreams configured for forwarding")
+	}
+	sort.SliceStable(f.rules, func(i, j int) bool {
+		return f.rules[i].domain.labelCount() > f.rules[j].domain.labelCount()
+	})
+	return f, nil
+}
+
+func newForwardRule(domain string, addrs []string, strategy string) (*forwardRule, error) {
+	name, err := parseZoneName(domain, rootName)
+	if err != nil {
+		return nil, err
+	}
+	switch strategy {
+	case "":
+		strategy = strategyFailover
+	case strategyFailover, strategyParallel:
+	default:
+		return nil, newError("unknown forwarding strategy " + strategy)
+	}
+	if len(addrs) == 0 {
+		return nil, newError("no upstreams for " + name.String())
+	}
+	rule := &forwardRule{domain: name, strategy: strategy}
+	for _, addr := range addrs {
+		rule.upstreams = append(rule.upstreams, &upstream{addr: withPort(addr)})
+	}
+	return rule, nil
+}
+
+// rule returns the most specific rule covering qname.
+func (f *forwarder) rule(qname dnsName) *forwardRule {
+	for _, rule := range f.rules {
+		if qname.isSubdomainOf(rule.domain) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// resolve answers from the cache when it holds the whole answer, and
+// otherwise asks the upstreams for qname.
+func (f *forwarder) resolve(ctx context.Context, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	result := new(dnsMessage)
+	name := qname
+	for chain := 0; chain < maxCNAMEChain; chain++ {
+		next, done := f.cache.answer(name, qtype, result)
+		if done {
+			return result, nil
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	rule := f.rule(qname)
+	if rule == nil {
+		return nil, newRefusedError("no forwarding rule for " + qname.String())
+	}
+	var res *dnsMessage
+	var err error
+	if rule.strategy == strategyParallel {
+		res, err = f.parallel(ctx, rule, qname, qtype)
+	} else {
+		res, err = f.failover(ctx, rule, qname, qtype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Upstreams are trusted for the names the rule sends them, no more.
+	f.cache.cacheResponse(res, rule.domain, secInsecure)
+	result = new(dnsMessage)
+	result.Rcode = res.Rcode
+	result.Answer = res.Answer
+	result.Authority = res.Authority
+	return result, nil
+}
+
+// candidates lists the healthy upstreams of rule, or all of them when
+// none is healthy.
+func (f *forwarder) candidates(rule *forwardRule) []*upstream {
+	now := f.now()
+	var ups []*upstream
+	for _, u := range rule.upstreams {
+		if u.healthy(now) {
+			ups = append(ups, u)
+		}
+	}
+	if len(ups) == 0 {
+		return rule.upstreams
+	}
+	return ups
+}
+
+func (f *forwarder) failover(ctx context.Context, rule *forwardRule, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	var lastErr error
+	for _, u := range f.candidates(rule) {
+		res, err := f.ask(ctx, u, qname, qtype)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (f *forwarder) parallel(ctx context.Context, rule *forwardRule, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type reply struct {
+		res *dnsMessage
+		err error
+	}
+	ups := f.candidates(rule)
+	replies := make(chan reply, len(ups))
+	for _, u := range ups {
+		go func(u *upstream) {
+			res, err := f.ask(ctx, u, qname, qtype)
+			replies <- reply{res, err}
+		}(u)
+	}
+	var lastErr error
+	for range ups {
+		r := <-replies
+		if r.err == nil {
+			return r.res, nil
+		}
+		lastErr = r.err
+	}
+	return nil, lastErr
+}
+
+// ask sends one query to u and records how u did. SERVFAIL and REFUSED
+// count as failures.
+func (f *forwarder) ask(ctx context.Context, u *upstream, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	metricForwardQueries.Add(1)
+	start := f.now()
+	res, err := exchange(ctx, u.addr, newQuery(qname, qtype, true), f.timeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			u.failure(f.now())
+		}
+		return nil, err
+	}
+	if res.Rcode != rcodeSuccess && res.Rcode != rcodeNameError {
+		u.failure(f.now())
+		return nil, newError(u.addr + " answered with RCODE " + strconv.Itoa(res.Rcode))
+	}
+	u.success(f.now().Sub(start))
+	return res, nil
+}
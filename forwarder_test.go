@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func testForwarder(t *testing.T, fc forwardConfig) *forwarder {
+	f, err := newForwarder(&config{Forward: fc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.timeout = 500 * time.Millisecond
+	return f
+}
+
+func TestForwardRules(t *testing.T) {
+	port := startTestHierarchy(t, testHierarchy, nil)
+	f := testForwarder(t, forwardConfig{
+		Upstreams: []string{net.JoinHostPort("127.0.0.2", port)},
+		Rules: []forwardRuleConfig{
+			{Domain: "other", Upstreams: []string{net.JoinHostPort("127.0.0.3", port)}},
+		},
+	})
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"www.example.", "www.example.\t3600\tIN\tA\t192.0.2.1"},
+		{"www.other.", "www.other.\t3600\tIN\tA\t192.0.2.2"},
+	} {
+		res, err := f.resolve(ctx, mustParseName(tt.name), dnsTypeA)
+		if err != nil || len(res.Answer) != 1 || res.Answer[0].String() != tt.want {
+			t.Errorf("%s: %v %v", tt.name, err, res)
+		}
+	}
+
+	// Answered from the cache now.
+	before := metricForwardQueries.Value()
+	if res, err := f.resolve(ctx, mustParseName("www.other."), dnsTypeA); err != nil || len(res.Answer) != 1 {
+		t.Errorf("cached: %v %v", err, res)
+	}
+	if res, err := f.resolve(ctx, mustParseName("nx.example."), dnsTypeA); err != nil || res.Rcode != rcodeNameError {
+		t.Errorf("nx: %v %v", err, res)
+	}
+	if res, err := f.resolve(ctx, mustParseName("nx.example."), dnsTypeA); err != nil || res.Rcode != rcodeNameError {
+		t.Errorf("cached nx: %v %v", err, res)
+	}
+	if n := metricForwardQueries.Value() - before; n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+}
+
+func TestForwardFailover(t *testing.T) {
+	port := startTestHierarchy(t, testHierarchy, nil)
+	dead := net.JoinHostPort("127.0.0.9", port)
+	for _, strategy := range []string{strategyFailover, strategyParallel} {
+		f := testForwarder(t, forwardConfig{
+			Upstreams: []string{dead, net.JoinHostPort("127.0.0.2", port)},
+			Strategy:  strategy,
+		})
+		for _, name := range []string{"www.example.", "ns.example.", "example."} {
+			res, err := f.resolve(context.Background(), mustParseName(name), dnsTypeA)
+			if err != nil || res.Rcode != rcodeSuccess {
+				t.Errorf("%s %s: %v %v", strategy, name, err, res)
+			}
+		}
+		if strategy == strategyFailover && f.rules[0].upstreams[0].healthy(f.now()) {
+			t.Errorf("%s: dead upstream still healthy", strategy)
+		}
+		if ups := f.candidates(f.rules[0]); strategy == strategyFailover && len(ups) != 1 {
+			t.Errorf("%s: %d candidates", strategy, len(ups))
+		}
+	}
+}
+
+func TestForwardConfigErrors(t *testing.T) {
+	for _, fc := range []forwardConfig{
+		{},
+		{Upstreams: []string{"192.0.2.1"}, Strategy: "random"},
+		{Rules: []forwardRuleConfig{{Domain: "corp."}}},
+	} {
+		if _, err := newForwarder(&config{Forward: fc}); err == nil {
+			t.Errorf("%+v accepted", fc)
+		}
+	}
+}
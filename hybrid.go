@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+)
+
+// Hybrid mode (--authoritative with --recursive): the configured zones
+// are served to whoever their query ACLs allow, and clients on the
+// recursion ACL get the rest of the DNS resolved for them.
+
+func hybridMain(cfg *config, udpFd int, tcpFd int, udp int, tcp int) error {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+
+	if udpFd < 0 && udp < 0 {
+		return newError("Select UDP as udp or udpfd")
+	}
+
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		return err
+	}
+	zones, err := cfg.loadZones(keys)
+	if err != nil {
+		return err
+	}
+	recursion, err := cfg.acl(cfg.RecursionACL, defaultRecursionACL)
+	if err != nil {
+		return err
+	}
+	rrl, err := cfg.rateLimiter()
+	if err != nil {
+		return err
+	}
+	r, err := newResolver(cfg)
+	if err != nil {
+		return err
+	}
+	srv := &hybridServer{
+		auth:      &authServer{zones: zones, keys: keys, rrl: rrl},
+		recursive: &recursiveServer{resolver: r},
+		recursion: recursion,
+	}
+	go zones.keepSigned()
+	go zones.keepJournalsCompact()
+	zones.keepSecondariesFresh()
+	log.Printf("hybrid started pid:%d udpFd:%d tcpFd:%d zones:%d", os.Getpid(), udpFd, tcpFd, len(zones.zones))
+
+	return listenAndServe(udpFd, tcpFd, udp, tcp, srv)
+}
+
+type hybridServer struct {
+	auth      *authServer
+	recursive *recursiveServer
+	recursion acl
+}
+
+func (srv *hybridServer) tsigKeys() tsigKeyring {
+	return srv.auth.tsigKeys()
+}
+
+func (srv *hybridServer) rateLimiter() *rateLimiter {
+	return srv.auth.rateLimiter()
+}
+
+// transfer serves zone transfers of the local zones.
+func (srv *hybridServer) transfer(req *dnsMessage, client net.IP, send func(*dnsMessage) error) error {
+	return srv.auth.transfer(req, client, send)
+}
+
+// serve answers from the local zones whenever the question falls in one,
+// even for clients that may recurse; everything else is resolved for
+// those clients and refused to others.
+func (srv *hybridServer) serve(req *dnsMessage, client net.IP) *dnsMessage {
+	allowed := srv.recursion.allowsKey(client, req.keyName())
+	if len(req.Question) != 1 || srv.auth.zones.find(req.Question[0].Qname) != nil || !req.RD {
+		res := srv.auth.serve(req, client)
+		res.RA = allowed
+		return res
+	}
+	if !allowed {
+		res := newResponse(req)
+		res.Rcode = rcodeRefused
+		return res
+	}
+	return srv.recursive.serve(req, client)
+}
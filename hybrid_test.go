@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a, err := parseACL([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":     true,
+		"11.0.0.1":     false,
+		"192.0.2.1":    true,
+		"192.0.2.2":    false,
+		"2001:db8::53": true,
+		"::1":          true,
+		"::2":          false,
+	} {
+		if got := a.allows(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: %v", addr, got)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		if _, err := parseACL([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestNamedACL(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "example.zone"), []byte(testAuthZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf := `{
+		"tsig_keys": [{"name": "xfr.", "secret": "c2VjcmV0"}],
+		"acls": {
+			"lan": ["!10.1.0.0/16", "10.0.0.0/8"],
+			"secondaries": ["lan", "key xfr."]
+		},
+		"allow_query": ["!192.0.2.66", "any"],
+		"allow_transfer": ["none"],
+		"zones": [{"origin": "example.", "file": "example.zone", "allow_transfer": ["!10.2.0.1", "secondaries"]}]
+	}`
+	path := filepath.Join(dir, "adns.json")
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones, err := cfg.loadZones(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zones.get(mustParseName("example."))
+	xfr := mustParseName("xfr.").key()
+	for _, c := range []struct {
+		addr, key string
+		want      bool
+	}{
+		{"10.0.0.1", "", true},
+		{"10.1.0.1", "", false},
+		{"10.2.0.1", "", false},
+		{"10.2.0.1", xfr, false}, // the first match decides
+		{"198.51.100.1", xfr, true},
+		{"198.51.100.1", "", false},
+	} {
+		if got := z.transfer.allowsKey(net.ParseIP(c.addr), c.key); got != c.want {
+			t.Errorf("transfer to %s with key %q: %v", c.addr, c.key, got)
+		}
+	}
+
+	srv := &authServer{zones: zones, keys: keys}
+	if res := srv.serve(testQuery("www.example.", dnsTypeA), net.ParseIP("192.0.2.66")); res.Rcode != rcodeRefused {
+		t.Errorf("query from a denied client: rcode %d", res.Rcode)
+	}
+	if res := srv.serve(testQuery("www.example.", dnsTypeA), testClient); res.Rcode != rcodeSuccess {
+		t.Errorf("query from an allowed client: rcode %d", res.Rcode)
+	}
+
+	// Unknown names and loops are configuration errors.
+	for _, acls := range []string{`{"a": ["b"]}`, `{"a": ["b"], "b": ["!a"]}`, `{"any": []}`} {
+		if err := os.WriteFile(path, []byte(`{"acls": `+acls+`}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("%s accepted", acls)
+		}
+	}
+}
+
+func TestHybridServe(t *testing.T) {
+	recursion, _ := parseACL(defaultRecursionACL)
+	srv := &hybridServer{
+		auth:      testAuthServer(t),
+		recursive: &recursiveServer{resolver: testResolver(t)},
+		recursion: recursion,
+	}
+	local := net.ParseIP("127.0.0.1")
+	tests := []struct {
+		name   string
+		client net.IP
+		rd     bool
+		rcode  int
+		aa, ra bool
+		answer string
+	}{
+		// The local zone wins over what the Internet says.
+		{"ns.example.", local, true, rcodeSuccess, true, true, "192.0.2.53"},
+		{"ns.example.", testClient, false, rcodeSuccess, true, false, "192.0.2.53"},
+		{"www.other.", local, true, rcodeSuccess, false, true, "192.0.2.2"},
+		{"www.other.", testClient, true, rcodeRefused, false, false, ""},
+		{"www.other.", local, false, rcodeRefused, false, true, ""},
+	}
+	for _, tt := range tests {
+		req := testQuery(tt.name, dnsTypeA)
+		req.RD = tt.rd
+		res := srv.serve(req, tt.client)
+		answer := ""
+		if len(res.Answer) > 0 {
+			answer = net.IP(res.Answer[0].Rdata).String()
+		}
+		if res.Rcode != tt.rcode || res.AA != tt.aa || res.RA != tt.ra || answer != tt.answer {
+			t.Errorf("%s from %v: rcode %d AA %v RA %v answer %q", tt.name, tt.client, res.Rcode, res.AA, res.RA, answer)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Internationalized domain names. Only presentation format is affected:
+// Unicode labels are turned into A-labels ("xn--" + punycode) before a
+// name is parsed, and A-labels may be shown as Unicode when printing.
+// The wire codec never sees anything but ASCII.
+//
+// The UTS #46 mapping step is approximated by lowercasing and by mapping
+// the ideographic full stops to ".". NFC normalization needs tables the
+// standard library does not carry, so input is expected to be NFC already.
+
+const acePrefix = "xn--"
+
+// Punycode parameters (RFC 3492 section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// idnaToASCII converts a presentation-format name holding Unicode labels
+// into one holding only A-labels. Pure ASCII input is returned untouched,
+// escapes included.
+func idnaToASCII(s string) (string, error) {
+	if isASCII(s) {
+		return s, nil
+	}
+	s = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(s)
+	labels := strings.Split(s, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		ace, err := idnaLabelToASCII(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = ace
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func idnaLabelToASCII(label string) (string, error) {
+	if !utf8.ValidString(label) {
+		return "", newError("invalid UTF-8 in label " + label)
+	}
+	label = strings.ToLower(label)
+	if err := idnaCheckLabel(label); err != nil {
+		return "", err
+	}
+	encoded, ok := punyEncode(label)
+	if !ok {
+		return "", newError("cannot punycode label " + label)
+	}
+	ace := acePrefix + encoded
+	if len(ace) > maxLabelLen {
+		return "", newError("A-label longer than 63 octets: " + ace)
+	}
+	return ace, nil
+}
+
+// idnaCheckLabel applies the IDNA2008 rules that can be checked with the
+// unicode package: letters, marks, digits and hyphens only, no leading
+// combining mark, no hyphen at either end or in positions 3 and 4.
+func idnaCheckLabel(label string) error {
+	if label == "" {
+		return newError("empty label")
+	}
+	if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return newError("label begins or ends with a hyphen: " + label)
+	}
+	if r := []rune(label); len(r) >= 4 && r[2] == '-' && r[3] == '-' {
+		return newError("label has hyphens in positions 3 and 4: " + label)
+	}
+	for i, r := range label {
+		switch {
+		case i == 0 && unicode.Is(unicode.M, r):
+			return newError("label begins with a combining mark: " + label)
+		case r == '-', unicode.IsLetter(r), unicode.IsDigit(r), unicode.Is(unicode.M, r):
+		default:
+			return newError("disallowed code point " + string(r) + " in label " + label)
+		}
+	}
+	return nil
+}
+
+// idnaLabelToUnicode returns the U-label for an A-label, or the label
+// itself when it is not a valid A-label.
+func idnaLabelToUnicode(label string) string {
+	if len(label) <= len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+		return label
+	}
+	decoded, ok := punyDecode(strings.ToLower(label[len(acePrefix):]))
+	if !ok || isASCII(decoded) || idnaCheckLabel(decoded) != nil {
+		return label
+	}
+	// Only canonical encodings are shown decoded.
+	if reencoded, ok := punyEncode(decoded); !ok || !strings.EqualFold(acePrefix+reencoded, label) {
+		return label
+	}
+	return decoded
+}
+
+// unicodeString is String with A-labels shown as U-labels.
+func (n dnsName) unicodeString() string {
+	if n.isRoot() {
+		return "."
+	}
+	var b strings.Builder
+	for _, label := range n.labels() {
+		if u := idnaLabelToUnicode(label); u != label {
+			b.WriteString(u)
+		} else {
+			s := dnsName(string(byte(len(label)))+label) + rootName
+			b.WriteString(strings.TrimSuffix(s.String(), "."))
+		}
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+// punyEncode implements the encoding procedure of RFC 3492 section 6.3.
+func punyEncode(s string) (string, bool) {
+	input := []rune(s)
+	var out []byte
+	for _, r := range input {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	h := len(out)
+	b := h
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h < len(input) {
+		m := int(unicode.MaxRune) + 1
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m-n)*(h+1) > (1<<31-1)-delta {
+			return "", false
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) == n {
+				q := delta
+				for k := punyBase; ; k += punyBase {
+					t := punyThreshold(k, bias)
+					if q < t {
+						break
+					}
+					out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+					q = (q - t) / (punyBase - t)
+				}
+				out = append(out, punyDigit(q))
+				bias = punyAdapt(delta, h+1, h == b)
+				delta = 0
+				h++
+			}
+		}
+		delta++
+		n++
+	}
+	return string(out), true
+}
+
+// punyDecode implements the decoding procedure of RFC 3492 section 6.2.
+func punyDecode(s string) (string, bool) {
+	var output []rune
+	pos := 0
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for _, c := range s[:i] {
+			if c >= 0x80 {
+				return "", false
+			}
+			output = append(output, c)
+		}
+		pos = i + 1
+	}
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", false
+			}
+			c := s[pos]
+			pos++
+			var digit int
+			switch {
+			case 'a' <= c && c <= 'z':
+				digit = int(c - 'a')
+			case 'A' <= c && c <= 'Z':
+				digit = int(c - 'A')
+			case '0' <= c && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", false
+			}
+			if digit > (1<<31-1-i)/w {
+				return "", false
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > (1<<31-1)/(punyBase-t) {
+				return "", false
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		if i/(len(output)+1) > int(unicode.MaxRune)-n {
+			return "", false
+		}
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > unicode.MaxRune || (0xd800 <= n && n <= 0xdfff) {
+			return "", false
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), true
+}
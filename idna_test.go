@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestPunycode(t *testing.T) {
+	// Samples from RFC 3492 section 7.1 and common labels.
+	tests := []struct{ unicode, ascii string }{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+		{"3年b組金八先生", "3b-ww4c5e180e575a65lsy2b"},
+	}
+	for _, tt := range tests {
+		got, ok := punyEncode(tt.unicode)
+		if !ok || got != tt.ascii {
+			t.Errorf("encode %s: got %q, want %q", tt.unicode, got, tt.ascii)
+		}
+		back, ok := punyDecode(tt.ascii)
+		if !ok || back != tt.unicode {
+			t.Errorf("decode %s: got %q, want %q", tt.ascii, back, tt.unicode)
+		}
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	ascii, err := idnaToASCII("Bücher。Example.com.")
+	if err != nil || ascii != "xn--bcher-kva.Example.com." {
+		t.Errorf("got %q, %v", ascii, err)
+	}
+	n := mustParseName("xn--bcher-kva.example.")
+	if s := n.unicodeString(); s != "bücher.example." {
+		t.Errorf("got %q", s)
+	}
+	// Case does not matter in an A-label, as nowhere else in a name.
+	if s := mustParseName("xn--BCHER-kva.example.").unicodeString(); s != "bücher.example." {
+		t.Errorf("got %q", s)
+	}
+	// Not a valid encoding: shown as is.
+	if s := mustParseName("xn--zz.example.").unicodeString(); s != "xn--zz.example." {
+		t.Errorf("got %q", s)
+	}
+	// Positions 3 and 4 count code points, not bytes.
+	if _, err := idnaToASCII("ü--x."); err != nil {
+		t.Errorf("ü--x.: %v", err)
+	}
+	for _, bad := range []string{"-ü.", "ü-.", "a☃.", "\u0301a.", "éé--x."} {
+		if _, err := idnaToASCII(bad); err == nil {
+			t.Errorf("%q converted", bad)
+		}
+	}
+}
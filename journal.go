@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Primary zones keep their changes in a journal file beside the zone
+// file, one block per serial change in master file syntax: the old SOA,
+// the records deleted, the new SOA and the records added, as in IXFR. A
+// blank line ends each block, so one torn by a crash is recognised and
+// dropped. On startup the journal is replayed on top of the zone file,
+// which also gives IXFR its history back. Now and then the zone file is
+// written out afresh and the journal emptied.
+
+const journalCompactInterval = 15 * time.Minute
+
+// openJournal replays the journal at path on top of the data of z and
+// records further changes there.
+func (z *zone) openJournal(path string) error {
+	diffs, good, torn, err := readJournal(path, z.origin)
+	if err != nil {
+		return err
+	}
+	if torn {
+		// Drop the torn block, so that new ones follow whole ones.
+		log.Printf("%s: dropping a torn change of %s", path, z.origin)
+		if err := os.Truncate(path, good); err != nil {
+			return wrapError(err)
+		}
+	}
+	_, soa, ok := z.soa()
+	if !ok {
+		return newError(z.origin.String() + " has no SOA")
+	}
+	cur, replayed := soa.Serial, 0
+	for _, d := range diffs {
+		from, _ := soaSerial(d.from)
+		to, _ := soaSerial(d.to)
+		if !serialBefore(cur, to) {
+			continue // compacted into the zone file before a crash
+		}
+		if from != cur {
+			return newError(fmt.Sprintf("%s: journal of %s jumps from serial %d to %d", path, z.origin, cur, from))
+		}
+		if err := z.update(func(x *zoneTxn) error { return applyDiffs(z.origin, x, []*zoneDiff{d}) }); err != nil {
+			return err
+		}
+		cur, replayed = to, replayed+1
+	}
+	if replayed > 0 {
+		log.Printf("%s: replayed %d changes of %s up to serial %d", path, replayed, z.origin, cur)
+	}
+	z.journalFile, z.journalDirty = path, len(diffs) > 0
+	return nil
+}
+
+// readJournal parses the journal at path. It returns the whole blocks,
+// how many bytes they take up and whether a torn one follows.
+func readJournal(path string, origin dnsName) ([]*zoneDiff, int64, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, wrapError(err)
+	}
+	var diffs []*zoneDiff
+	var good int64
+	text := string(data)
+	for {
+		block, rest, ok := strings.Cut(text, "\n\n")
+		if !ok {
+			break
+		}
+		rrs, err := parseZone(strings.NewReader(block), path, origin)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		d, ok := journalDiff(rrs)
+		if !ok {
+			return nil, 0, false, newError(path + ": bad journal block")
+		}
+		diffs = append(diffs, d)
+		good += int64(len(block) + 2)
+		text = rest
+	}
+	return diffs, good, text != "", nil
+}
+
+// journalDiff reads a block: SOA, deletions, SOA, additions.
+func journalDiff(rrs []dnsRR) (*zoneDiff, bool) {
+	if len(rrs) < 2 || rrs[0].Type != dnsTypeSOA {
+		return nil, false
+	}
+	d := &zoneDiff{from: rrs[0]}
+	i := 1
+	for ; i < len(rrs) && rrs[i].Type != dnsTypeSOA; i++ {
+		d.deleted = append(d.deleted, rrs[i])
+	}
+	if i == len(rrs) {
+		return nil, false
+	}
+	d.to = rrs[i]
+	for _, rr := range rrs[i+1:] {
+		if rr.Type == dnsTypeSOA {
+			return nil, false
+		}
+		d.added = append(d.added, rr)
+	}
+	return d, true
+}
+
+// applyDiffs carries out diffs, which must start at the serial of x.
+func applyDiffs(origin dnsName, x *zoneTxn, diffs []*zoneDiff) error {
+	for _, d := range diffs {
+		for _, rr := range d.deleted {
+			x.deleteRR(rr)
+		}
+		for _, rr := range d.added {
+			if !rr.Name.isSubdomainOf(origin) {
+				return newError(rr.Name.String() + " is outside zone " + origin.String())
+			}
+			x.addRR(rr)
+		}
+		x.deleteRRset(origin, dnsTypeSOA)
+		x.addRR(d.to)
+	}
+	return nil
+}
+
+// writeJournal appends the change from old to t to the journal file of
+// z, leaving out what the signer adds. A change the serial does not show
+// cannot be journaled; the zone file is written out at once instead. The
+// caller holds z.mu and must not publish t unless this succeeds.
+func (z *zone) writeJournal(old, t *zoneTree) error {
+	fromSOA, toSOA := old.get(z.origin).rrset(dnsTypeSOA), t.get(z.origin).rrset(dnsTypeSOA)
+	if len(fromSOA) == 0 || len(toSOA) == 0 {
+		return nil
+	}
+	d, _ := diffTrees(old, t)
+	if z.signer != nil {
+		unsigned := func(rr dnsRR) bool { return isSignerType(rr.Type) }
+		d.deleted = slices.DeleteFunc(d.deleted, unsigned)
+		d.added = slices.DeleteFunc(d.added, unsigned)
+	}
+	from, _ := soaSerial(fromSOA[0])
+	to, _ := soaSerial(toSOA[0])
+	if from == to {
+		if len(d.deleted)+len(d.added) > 0 {
+			return z.compactLocked(t)
+		}
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString(fromSOA[0].String() + "\n")
+	for _, rr := range d.deleted {
+		b.WriteString(rr.String() + "\n")
+	}
+	b.WriteString(toSOA[0].String() + "\n")
+	for _, rr := range d.added {
+		b.WriteString(rr.String() + "\n")
+	}
+	b.WriteString("\n")
+	if err := appendFile(z.journalFile, b.String()); err != nil {
+		return newError("journal of " + z.origin.String() + ": " + err.Error())
+	}
+	z.journalDirty = true
+	return nil
+}
+
+// appendFile adds s to the file at path and waits for it to reach the
+// disk.
+func appendFile(path, s string) error {
+	return writeFileSync(path, s, os.O_APPEND)
+}
+
+// writeFileSync writes s to the file at path, opened with flag on top of
+// O_WRONLY|O_CREATE, and waits for it to reach the disk.
+func writeFileSync(path, s string, flag int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0o644)
+	if err != nil {
+		return wrapError(err)
+	}
+	_, err = f.WriteString(s)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// syncDir waits for the entries of the directory at path to reach the
+// disk, e.g. after a rename.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return wrapError(err)
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// compact writes the data of z to its zone file and empties the journal.
+func (z *zone) compact() {
+	if z.journalFile == "" {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.compactLocked(z.snapshot()); err != nil {
+		log.Printf("compacting %s: %v", z.origin, err)
+	}
+}
+
+// compactLocked is compact with z.mu held, for data t. The journal is
+// emptied only once the zone file is on disk; a crash between the two
+// steps leaves blocks the zone file already holds, which the replay
+// skips.
+func (z *zone) compactLocked(t *zoneTree) error {
+	var omit []uint16
+	if z.signer != nil {
+		omit = signerTypes
+	}
+	if err := writeZoneFile(z.file, z.origin, t, omit); err != nil {
+		return err
+	}
+	if err := os.Truncate(z.journalFile, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return wrapError(err)
+	}
+	z.journalDirty = false
+	return nil
+}
+
+// keepJournalsCompact writes out the zones in zs whose journals hold
+// changes. It does not return.
+func (zs *zoneSet) keepJournalsCompact() {
+	for range time.Tick(journalCompactInterval) {
+		for _, z := range zs.zones {
+			z.mu.Lock()
+			if z.journalFile != "" && z.journalDirty {
+				if err := z.compactLocked(z.snapshot()); err != nil {
+					log.Printf("compacting %s: %v", z.origin, err)
+				}
+			}
+			z.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZoneJournal(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "example.zone")
+	if err := os.WriteFile(file, []byte(testAuthZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	origin := mustParseName("example.")
+	// start loads the zone as a restarted server would.
+	start := func() *zone {
+		t.Helper()
+		rrs, err := loadZoneFile(file, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z := newZone(origin, rrs)
+		z.file = file
+		if err := z.openJournal(file + ".jnl"); err != nil {
+			t.Fatal(err)
+		}
+		return z
+	}
+	has := func(z *zone, name string) bool {
+		return z.snapshot().get(mustParseName(name)) != nil
+	}
+
+	z := start()
+	bumpSerial(t, z, nil, testA("one.example.", 300, 1))
+	bumpSerial(t, z, []dnsRR{testA("one.example.", 300, 1)}, testA("two.example.", 300, 2))
+	z = start()
+	if _, soa, _ := z.soa(); soa.Serial != 3 || has(z, "one.example.") || !has(z, "two.example.") {
+		t.Fatalf("after replay: serial %d", soa.Serial)
+	}
+	// IXFR reaches back to before the restart.
+	if diffs, ok := z.journal.since(1); !ok || len(diffs) != 2 {
+		t.Errorf("journal since serial 1: %d changes", len(diffs))
+	}
+
+	// A block torn by a crash is dropped, and later ones still count.
+	f, err := os.OpenFile(file+".jnl", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("example.\t3600\tIN\tSOA\tns1.example. host")
+	f.Close()
+	z = start()
+	bumpSerial(t, z, nil, testA("three.example.", 300, 3))
+	z = start()
+	if _, soa, _ := z.soa(); soa.Serial != 4 || !has(z, "three.example.") {
+		t.Errorf("after a torn block: serial %d", soa.Serial)
+	}
+
+	// Compaction moves the changes into the zone file. A crash before
+	// the journal is emptied leaves changes that replay skips.
+	saved, err := os.ReadFile(file + ".jnl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.compact()
+	if info, err := os.Stat(file + ".jnl"); err != nil || info.Size() != 0 {
+		t.Error("journal not emptied by compaction")
+	}
+	if err := os.WriteFile(file+".jnl", saved, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	z = start()
+	if _, soa, _ := z.soa(); soa.Serial != 4 || !has(z, "two.example.") || !has(z, "three.example.") {
+		t.Errorf("after compaction: serial %d", soa.Serial)
+	}
+	bumpSerial(t, z, nil, testA("four.example.", 300, 4))
+	if z = start(); !has(z, "four.example.") {
+		t.Error("change after compaction lost")
+	}
+}
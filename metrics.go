@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Counters exported through expvar (/debug/vars when an HTTP server runs).
+var (
+	metricUDPReceived   = expvar.NewInt("udp_received")
+	metricUDPResponses  = expvar.NewInt("udp_responses")
+	metricUDPShort      = expvar.NewInt("udp_dropped_short")
+	metricUDPNotQuery   = expvar.NewInt("udp_dropped_qr")
+	metricTCPReceived   = expvar.NewInt("tcp_received")
+	metricTCPResponses  = expvar.NewInt("tcp_responses")
+	metricFormErr       = expvar.NewInt("formerr_responses")
+	metricPackFailures  = expvar.NewInt("pack_failures")
+	metricWriteFailures = expvar.NewInt("write_failures")
+
+	metricCacheHits      = expvar.NewInt("cache_hits")
+	metricCacheMisses    = expvar.NewInt("cache_misses")
+	metricCacheEvictions = expvar.NewInt("cache_evictions")
+
+	metricCacheNegativeHits = expvar.NewInt("cache_negative_hits")
+
+	metricForwardQueries  = expvar.NewInt("forward_queries")
+	metricForwardFailures = expvar.NewInt("forward_failures")
+
+	metricBogus = expvar.NewInt("dnssec_bogus")
+
+	metricTransfers        = expvar.NewInt("zone_transfers")
+	metricTransfersRefused = expvar.NewInt("zone_transfers_refused")
+
+	metricNotifiesSent     = expvar.NewInt("notifies_sent")
+	metricNotifiesFailed   = expvar.NewInt("notifies_failed")
+	metricNotifiesReceived = expvar.NewInt("notifies_received")
+
+	metricUpdates = expvar.NewInt("updates")
+
+	metricTSIGFailures = expvar.NewInt("tsig_failures")
+
+	metricRRLLimited = expvar.NewInt("rrl_limited") // over the rate, log only included
+	metricRRLDropped = expvar.NewInt("rrl_dropped")
+	metricRRLSlipped = expvar.NewInt("rrl_slipped")
+)
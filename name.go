@@ -0,0 +1,270 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// dnsName is a domain name held in uncompressed wire format, e.g.
+// "\x07example\x03com\x00". Octets keep the case they arrived with, so
+// 0x20-randomized questions are echoed back verbatim; every comparison
+// folds ASCII case (RFC 4343).
+type dnsName string
+
+const rootName dnsName = "\x00"
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+// parseName parses an absolute name in presentation format. A missing
+// trailing dot is implied. \. and \DDD escapes are understood.
+func parseName(s string) (dnsName, error) {
+	return parseNameOrigin(s, rootName)
+}
+
+// parseNameOrigin parses a name in presentation format; names without a
+// trailing dot are relative to origin, and "@" is the origin itself.
+func parseNameOrigin(s string, origin dnsName) (dnsName, error) {
+	if s == "@" {
+		return origin, nil
+	}
+	if s == "" {
+		return "", newError("empty domain name")
+	}
+	if s == "." {
+		return rootName, nil
+	}
+
+	var wire []byte
+	label := make([]byte, 0, maxLabelLen)
+	absolute := false
+	flush := func() error {
+		if len(label) == 0 {
+			return newError("empty label in " + strconv.Quote(s))
+		}
+		if len(label) > maxLabelLen {
+			return newError("label longer than 63 octets in " + strconv.Quote(s))
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+		label = label[:0]
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '.':
+			if err := flush(); err != nil {
+				return "", err
+			}
+			if i == len(s)-1 {
+				absolute = true
+			}
+		case '\\':
+			if i+1 >= len(s) {
+				return "", newError("trailing backslash in " + strconv.Quote(s))
+			}
+			if isDigit(s[i+1]) {
+				if i+3 >= len(s) || !isDigit(s[i+2]) || !isDigit(s[i+3]) {
+					return "", newError("bad \\DDD escape in " + strconv.Quote(s))
+				}
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				if n > 255 {
+					return "", newError("bad \\DDD escape in " + strconv.Quote(s))
+				}
+				label = append(label, byte(n))
+				i += 3
+			} else {
+				label = append(label, s[i+1])
+				i++
+			}
+		default:
+			label = append(label, c)
+		}
+	}
+	if !absolute {
+		if err := flush(); err != nil {
+			return "", err
+		}
+	}
+
+	var n dnsName
+	if absolute {
+		n = dnsName(append(wire, 0))
+	} else {
+		n = dnsName(string(wire) + string(origin))
+	}
+	if len(n) > maxNameLen {
+		return "", newError("domain name exceeds 255 octets: " + strconv.Quote(s))
+	}
+	return n, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// mustParseName is parseName for names known to be valid.
+func mustParseName(s string) dnsName {
+	n, err := parseName(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// String returns the name in presentation format with a trailing dot.
+func (n dnsName) String() string {
+	if n.isRoot() {
+		return "."
+	}
+	var b strings.Builder
+	for _, label := range n.labels() {
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' ||
+				c == ';' || c == '@' || c == '$':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c <= ' ' || c >= 0x7f:
+				b.WriteString("\\" + leftPad3(int(c)))
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+func leftPad3(i int) string {
+	s := strconv.Itoa(i)
+	return strings.Repeat("0", 3-len(s)) + s
+}
+
+// isRoot reports whether n is the root. The zero value counts as root.
+func (n dnsName) isRoot() bool {
+	return len(n) <= 1
+}
+
+// wireLen returns the uncompressed length on the wire.
+func (n dnsName) wireLen() int {
+	if len(n) == 0 {
+		return 1
+	}
+	return len(n)
+}
+
+// labels returns the raw labels from leftmost to rightmost, without the
+// root label.
+func (n dnsName) labels() []string {
+	var labels []string
+	for off := 0; off < len(n) && n[off] != 0; off += 1 + int(n[off]) {
+		labels = append(labels, string(n[off+1:off+1+int(n[off])]))
+	}
+	return labels
+}
+
+// labelCount returns the number of labels, not counting the root.
+func (n dnsName) labelCount() int {
+	count := 0
+	for off := 0; off < len(n) && n[off] != 0; off += 1 + int(n[off]) {
+		count++
+	}
+	return count
+}
+
+// firstLabel returns the leftmost label, "" for the root.
+func (n dnsName) firstLabel() string {
+	if n.isRoot() {
+		return ""
+	}
+	return string(n[1 : 1+int(n[0])])
+}
+
+// parent strips the leftmost label. The parent of the root is the root.
+func (n dnsName) parent() dnsName {
+	if n.isRoot() {
+		return rootName
+	}
+	return n[1+int(n[0]):]
+}
+
+// suffix returns the rightmost count labels of n.
+func (n dnsName) suffix(count int) dnsName {
+	for skip := n.labelCount() - count; skip > 0; skip-- {
+		n = n.parent()
+	}
+	if len(n) == 0 {
+		return rootName
+	}
+	return n
+}
+
+// prepend returns label.n, failing when the result is too long.
+func (n dnsName) prepend(label string) (dnsName, bool) {
+	if len(label) == 0 || len(label) > maxLabelLen || len(n)+1+len(label) > maxNameLen {
+		return "", false
+	}
+	if len(n) == 0 {
+		n = rootName
+	}
+	return dnsName(string(byte(len(label)))+label) + n, true
+}
+
+// canonical returns n with ASCII letters lowercased (RFC 4034 6.2).
+func (n dnsName) canonical() dnsName {
+	if len(n) == 0 {
+		return rootName
+	}
+	b := []byte(n)
+	for off := 0; off < len(b) && b[off] != 0; off += 1 + int(b[off]) {
+		for i := off + 1; i <= off+int(b[off]); i++ {
+			if 'A' <= b[i] && b[i] <= 'Z' {
+				b[i] += 'a' - 'A'
+			}
+		}
+	}
+	return dnsName(b)
+}
+
+// key returns a string usable as a case-insensitive map key.
+func (n dnsName) key() string {
+	return string(n.canonical())
+}
+
+// equal compares two names ignoring ASCII case.
+func (n dnsName) equal(o dnsName) bool {
+	return n.canonical() == o.canonical()
+}
+
+// isSubdomainOf reports whether n is at or below o.
+func (n dnsName) isSubdomainOf(o dnsName) bool {
+	nc, oc := n.labelCount(), o.labelCount()
+	if nc < oc {
+		return false
+	}
+	return n.suffix(oc).equal(o)
+}
+
+// compareName orders names canonically (RFC 4034 6.1): label by label
+// from the right, each label compared as lowercased octets, with absent
+// labels sorting first. It returns -1, 0 or +1.
+func compareName(a, b dnsName) int {
+	al, bl := a.canonical().labels(), b.canonical().labels()
+	for i, j := len(al)-1, len(bl)-1; i >= 0 || j >= 0; i, j = i-1, j-1 {
+		switch {
+		case i < 0:
+			return -1
+		case j < 0:
+			return 1
+		}
+		if c := strings.Compare(al[i], bl[j]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		in, out string
+		labels  int
+	}{
+		{".", ".", 0},
+		{"example.com", "example.com.", 2},
+		{"Example.COM.", "Example.COM.", 2},
+		{`a\.b.example.`, `a\.b.example.`, 2},
+		{`\065\066.`, "AB.", 1},
+		{`sp\032ace.`, `sp\032ace.`, 1},
+	}
+	for _, tt := range tests {
+		n, err := parseName(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if n.String() != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.in, n.String(), tt.out)
+		}
+		if n.labelCount() != tt.labels {
+			t.Errorf("%q: %d labels, want %d", tt.in, n.labelCount(), tt.labels)
+		}
+	}
+
+	long := ""
+	for i := 0; i < 128; i++ {
+		long += "a."
+	}
+	for _, bad := range []string{"", "a..b", `\256.`, `a\1.`, long} {
+		if _, err := parseName(bad); err == nil {
+			t.Errorf("%q: parsed", bad)
+		}
+	}
+}
+
+func TestNameComparison(t *testing.T) {
+	a, b := mustParseName("Twitter.COM."), mustParseName("twitter.com.")
+	if !a.equal(b) || a.key() != b.key() {
+		t.Error("names differing in case are not equal")
+	}
+	if a == b {
+		t.Error("case was not preserved")
+	}
+	if !mustParseName("www.example.com.").isSubdomainOf(mustParseName("EXAMPLE.com")) {
+		t.Error("www.example.com. is not below example.com.")
+	}
+	if mustParseName("badexample.com.").isSubdomainOf(mustParseName("example.com.")) {
+		t.Error("badexample.com. is below example.com.")
+	}
+	if p := mustParseName("www.example.com.").parent(); !p.equal(mustParseName("example.com.")) {
+		t.Errorf("parent is %v", p)
+	}
+}
+
+// The example from RFC 4034 section 6.1.
+func TestCanonicalOrder(t *testing.T) {
+	want := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", `\001.z.example.`, "*.z.example.", `\200.z.example.`,
+	}
+	names := make([]dnsName, len(want))
+	for i := range want {
+		names[len(want)-1-i] = mustParseName(want[i])
+	}
+	sort.Slice(names, func(i, j int) bool { return compareName(names[i], names[j]) < 0 })
+	for i := range names {
+		if names[i].String() != want[i] {
+			t.Errorf("position %d: got %v, want %v", i, names[i], want[i])
+		}
+	}
+}
+
+func FuzzParseName(f *testing.F) {
+	f.Add("example.com.")
+	f.Add(`a\.b\\c\255.`)
+	f.Fuzz(func(t *testing.T, s string) {
+		n, err := parseName(s)
+		if err != nil {
+			return
+		}
+		n2, err := parseName(n.String())
+		if err != nil || n2 != n {
+			t.Fatalf("%q: presentation %q does not parse back: %v", s, n.String(), err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// NOTIFY (RFC 1996). A primary tells its secondaries when the serial
+// changes, retrying with a doubling timeout until each one answers. A
+// secondary takes a NOTIFY from its primaries as a hint to check the
+// serial now rather than when the refresh timer runs out.
+
+const (
+	notifyTimeout = 2 * time.Second
+	notifyTries   = 5
+)
+
+func (z *zone) setNotify(addrs []string) {
+	for _, addr := range addrs {
+		z.notify = append(z.notify, withPort(addr))
+	}
+}
+
+// notifyChange sends NOTIFY to the secondaries of z when the serial
+// differs between old and t.
+func (z *zone) notifyChange(old, t *zoneTree) {
+	if len(z.notify) == 0 {
+		return
+	}
+	soa := t.get(z.origin).rrset(dnsTypeSOA)
+	if len(soa) == 0 {
+		return
+	}
+	serial, _ := soaSerial(soa[0])
+	if prev := old.get(z.origin).rrset(dnsTypeSOA); len(prev) > 0 {
+		if s, _ := soaSerial(prev[0]); s == serial {
+			return
+		}
+	}
+	for _, addr := range z.notify {
+		go sendNotify(addr, z.origin, soa[0], z.key)
+	}
+}
+
+// sendNotify tells the secondary at addr of the new SOA, signed with key
+// unless it is nil.
+func sendNotify(addr string, origin dnsName, soa dnsRR, key *tsigKey) {
+	q := newQuery(origin, dnsTypeSOA, false)
+	if key != nil {
+		q.tsig = newTSIGState(key)
+	}
+	q.Opcode = opcodeNotify
+	q.AA = true
+	q.Answer = []dnsRR{soa}
+	timeout := notifyTimeout
+	for try := 0; try < notifyTries; try++ {
+		metricNotifiesSent.Add(1)
+		res, err := exchangeUDP(context.Background(), addr, q, timeout)
+		if tsigRejected(err) {
+			// Trying again with the same key will not help.
+			log.Printf("NOTIFY of %s to %s: %v", origin, addr, err)
+			metricNotifiesFailed.Add(1)
+			return
+		}
+		if err == nil {
+			if res.Rcode != rcodeSuccess {
+				log.Printf("NOTIFY of %s to %s: rcode %d", origin, addr, res.Rcode)
+				metricNotifiesFailed.Add(1)
+			}
+			return
+		}
+		timeout *= 2
+	}
+	log.Printf("NOTIFY of %s to %s: no answer", origin, addr)
+	metricNotifiesFailed.Add(1)
+}
+
+// notified takes a NOTIFY for a secondary zone from one of its primaries,
+// or signed with its key, and has the zone checked at once.
+func (srv *authServer) notified(req *dnsMessage, res *dnsMessage, client net.IP) error {
+	if len(req.Question) != 1 {
+		return newFormatError("exactly one question is supported", headerLen)
+	}
+	q := req.Question[0]
+	z := srv.zones.get(q.Qname)
+	if z == nil || z.secondary == nil {
+		return newRefusedError("NOTIFY for " + q.Qname.String() + ", which is not a secondary zone here")
+	}
+	if !z.secondary.notifiers.allowsKey(client, req.keyName()) {
+		return newRefusedError("NOTIFY for " + z.origin.String() + " from " + client.String() + ", which is not a primary")
+	}
+	metricNotifiesReceived.Add(1)
+	res.AA = true
+	select {
+	case z.secondary.check <- struct{}{}:
+	default: // a check is already due
+	}
+	return nil
+}
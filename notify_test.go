@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	origin := mustParseName("example.")
+	rrs, err := parseZone(strings.NewReader(testAuthZone), "test", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := newZone(origin, rrs)
+	primary.transfer, _ = parseACL([]string{"127.0.0.0/8"})
+	primarySrv := &authServer{zones: newZoneSet()}
+	primarySrv.zones.add(primary)
+	primaryAddr := startTestTCP(t, primarySrv)
+
+	z, err := newSecondaryZone(origin, "", []string{primaryAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &authServer{zones: newZoneSet()}
+	srv.zones.add(z)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go serveUDP(conn, srv)
+	go z.keepFresh()
+	waitSerial := func(serial uint32) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, soa, ok := z.soa(); ok && soa.Serial == serial {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("secondary not at serial %d", serial)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The first refresh runs at once; the SOA says the next is in two
+	// hours, so only the NOTIFY brings the change over in time.
+	waitSerial(1)
+	primary.setNotify([]string{conn.LocalAddr().String()})
+	bumpSerial(t, primary, nil, testA("new.example.", 3600, 1))
+	waitSerial(2)
+	if res := srv.serve(testQuery("new.example.", dnsTypeA), testClient); len(res.Answer) != 1 {
+		t.Errorf("%d answers after NOTIFY", len(res.Answer))
+	}
+
+	notify := testQuery("example.", dnsTypeSOA)
+	notify.Opcode = opcodeNotify
+	if res := srv.serve(notify, testClient); res.Rcode != rcodeRefused {
+		t.Errorf("NOTIFY from a stranger: rcode %d", res.Rcode)
+	}
+	if res := srv.serve(notify, net.ParseIP("127.0.0.1")); res.Rcode != rcodeSuccess || !res.AA || res.Opcode != opcodeNotify {
+		t.Errorf("NOTIFY from the primary: rcode %d", res.Rcode)
+	}
+	if res := primarySrv.serve(notify, net.ParseIP("127.0.0.1")); res.Rcode != rcodeRefused {
+		t.Errorf("NOTIFY to a primary zone: rcode %d", res.Rcode)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// dnsRRHeader.Type
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypePTR   = 12
+	dnsTypeMX    = 15
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsTypeDNAME = 39
+	dnsTypeOPT   = 41
+	dnsTypeDS    = 43
+
+	// DNSSEC (RFC 4034, RFC 5155, RFC 7344, RFC 9824)
+	dnsTypeRRSIG      = 46
+	dnsTypeNSEC       = 47
+	dnsTypeDNSKEY     = 48
+	dnsTypeNSEC3      = 50
+	dnsTypeNSEC3PARAM = 51
+	dnsTypeCDS        = 59
+	dnsTypeCDNSKEY    = 60
+	dnsTypeNXNAME     = 128 // NSEC type bitmaps only
+
+	dnsTypeTSIG = 250 // RFC 8945, last in the additional section
+
+	// dnsQuestion.Qtype only
+	dnsTypeIXFR = 251
+	dnsTypeAXFR = 252
+	dnsTypeANY  = 255
+
+	// dnsRRHeader.Class
+	dnsClassINET  = 1
+	dnsClassCHAOS = 3
+	dnsClassNONE  = 254
+	dnsClassANY   = 255
+)
+
+var dnsTypeNames = map[uint16]string{
+	dnsTypeA:     "A",
+	dnsTypeNS:    "NS",
+	dnsTypeCNAME: "CNAME",
+	dnsTypeSOA:   "SOA",
+	dnsTypePTR:   "PTR",
+	dnsTypeMX:    "MX",
+	dnsTypeTXT:   "TXT",
+	dnsTypeAAAA:  "AAAA",
+	dnsTypeSRV:   "SRV",
+	dnsTypeDNAME: "DNAME",
+	dnsTypeOPT:   "OPT",
+	dnsTypeDS:    "DS",
+
+	dnsTypeRRSIG:      "RRSIG",
+	dnsTypeNSEC:       "NSEC",
+	dnsTypeDNSKEY:     "DNSKEY",
+	dnsTypeNSEC3:      "NSEC3",
+	dnsTypeNSEC3PARAM: "NSEC3PARAM",
+	dnsTypeCDS:        "CDS",
+	dnsTypeCDNSKEY:    "CDNSKEY",
+	dnsTypeNXNAME:     "NXNAME",
+	dnsTypeTSIG:       "TSIG",
+	dnsTypeIXFR:       "IXFR",
+	dnsTypeAXFR:       "AXFR",
+	dnsTypeANY:        "ANY",
+}
+
+var dnsClassNames = map[uint16]string{
+	dnsClassINET:  "IN",
+	dnsClassCHAOS: "CH",
+	dnsClassNONE:  "NONE",
+	dnsClassANY:   "ANY",
+}
+
+// typeString returns the mnemonic of a type, TYPEnnn when unknown (RFC 3597).
+func typeString(t uint16) string {
+	if s, ok := dnsTypeNames[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func classString(c uint16) string {
+	if s, ok := dnsClassNames[c]; ok {
+		return s
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range dnsTypeNames {
+		if name == s {
+			return t, true
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if i, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+func parseClass(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for c, name := range dnsClassNames {
+		if name == s {
+			return c, true
+		}
+	}
+	if strings.HasPrefix(s, "CLASS") {
+		if i, err := strconv.ParseUint(s[5:], 10, 16); err == nil {
+			return uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+// Typed views of Rdata. Each one walks its fields in wire order so that
+// packWalker, unpackWalker and the text walkers below all work on it.
+
+type dnsRdataA struct {
+	A []byte
+}
+
+func (rd *dnsRdataA) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.A, "A", "ipv4")
+}
+
+type dnsRdataAAAA struct {
+	AAAA []byte
+}
+
+func (rd *dnsRdataAAAA) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.AAAA, "AAAA", "ipv6")
+}
+
+// dnsRdataName serves every type whose rdata is a single name:
+// NS, CNAME, PTR and DNAME.
+type dnsRdataName struct {
+	Target dnsName
+}
+
+func (rd *dnsRdataName) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Target, "Target", "domain")
+}
+
+type dnsRdataSOA struct {
+	Ns      dnsName
+	Mbox    dnsName
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minttl  uint32
+}
+
+func (rd *dnsRdataSOA) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Ns, "Ns", "domain") &&
+		f(&rd.Mbox, "Mbox", "domain") &&
+		f(&rd.Serial, "Serial", "") &&
+		f(&rd.Refresh, "Refresh", "ttl") &&
+		f(&rd.Retry, "Retry", "ttl") &&
+		f(&rd.Expire, "Expire", "ttl") &&
+		f(&rd.Minttl, "Minttl", "ttl")
+}
+
+type dnsRdataMX struct {
+	Pref uint16
+	Mx   dnsName
+}
+
+func (rd *dnsRdataMX) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Pref, "Pref", "") && f(&rd.Mx, "Mx", "domain")
+}
+
+type dnsRdataTXT struct {
+	Txt []string
+}
+
+func (rd *dnsRdataTXT) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Txt, "Txt", "txt")
+}
+
+type dnsRdataSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   dnsName
+}
+
+func (rd *dnsRdataSRV) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(&rd.Priority, "Priority", "") &&
+		f(&rd.Weight, "Weight", "") &&
+		f(&rd.Port, "Port", "") &&
+		f(&rd.Target, "Target", "domain")
+}
+
+// newRdata returns an empty typed view for t, nil when t is unknown.
+func newRdata(t uint16) Walker {
+	switch t {
+	case dnsTypeA:
+		return new(dnsRdataA)
+	case dnsTypeAAAA:
+		return new(dnsRdataAAAA)
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR, dnsTypeDNAME:
+		return new(dnsRdataName)
+	case dnsTypeSOA:
+		return new(dnsRdataSOA)
+	case dnsTypeMX:
+		return new(dnsRdataMX)
+	case dnsTypeTXT:
+		return new(dnsRdataTXT)
+	case dnsTypeSRV:
+		return new(dnsRdataSRV)
+	case dnsTypeDS, dnsTypeCDS:
+		return new(dnsRdataDS)
+	case dnsTypeDNSKEY, dnsTypeCDNSKEY:
+		return new(dnsRdataDNSKEY)
+	case dnsTypeRRSIG:
+		return new(dnsRdataRRSIG)
+	case dnsTypeNSEC:
+		return new(dnsRdataNSEC)
+	case dnsTypeNSEC3:
+		return new(dnsRdataNSEC3)
+	case dnsTypeNSEC3PARAM:
+		return new(dnsRdataNSEC3PARAM)
+	}
+	return nil
+}
+
+// rdata decodes the typed view of rr.Rdata.
+func (rr *dnsRR) rdata() (Walker, bool) {
+	rd := newRdata(rr.Type)
+	if rd == nil {
+		return nil, false
+	}
+	if off, ok := unpackWalker(rd, rr.Rdata, 0); !ok || off != len(rr.Rdata) {
+		return nil, false
+	}
+	return rd, true
+}
+
+// setRdata encodes rd into rr.Rdata and fixes Rdlength.
+func (rr *dnsRR) setRdata(rd Walker) bool {
+	b, ok := packRdata(rd)
+	if !ok {
+		return false
+	}
+	rr.Rdata = b
+	rr.Rdlength = uint16(len(b))
+	return true
+}
+
+// newRR builds a record from a typed view of its rdata.
+func newRR(name dnsName, t uint16, ttl uint32, rd Walker) dnsRR {
+	rr := dnsRR{dnsRRHeader: dnsRRHeader{Name: name, Type: t, Class: dnsClassINET, Ttl: ttl}}
+	if !rr.setRdata(rd) {
+		panic("rdata does not fit in 65535 octets")
+	}
+	return rr
+}
+
+// String formats the record as a master file line.
+func (rr *dnsRR) String() string {
+	return rr.format(false)
+}
+
+// format formats the record as a master file line; with useUnicode the
+// owner and the names inside rdata are shown as U-labels.
+func (rr *dnsRR) format(useUnicode bool) string {
+	name := rr.Name.String()
+	if useUnicode {
+		name = rr.Name.unicodeString()
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", name, rr.Ttl, classString(rr.Class),
+		typeString(rr.Type), rr.rdataString(useUnicode))
+}
+
+func (rr *dnsRR) rdataString(useUnicode bool) string {
+	rd, ok := rr.rdata()
+	if !ok {
+		// RFC 3597 generic encoding
+		return fmt.Sprintf("\\# %d %x", len(rr.Rdata), rr.Rdata)
+	}
+	return formatRdata(rd, useUnicode)
+}
+
+// formatRdata is the text counterpart of packWalker.
+func formatRdata(rd Walker, useUnicode bool) string {
+	var fields []string
+	rd.Walk(func(field interface{}, name, tag string) bool {
+		switch fv := field.(type) {
+		case *uint8:
+			fields = append(fields, strconv.Itoa(int(*fv)))
+		case *uint16:
+			if tag == "type" {
+				fields = append(fields, typeString(*fv))
+			} else {
+				fields = append(fields, strconv.Itoa(int(*fv)))
+			}
+		case *uint32:
+			if tag == "time" {
+				fields = append(fields, formatSigTime(*fv))
+			} else {
+				fields = append(fields, strconv.FormatUint(uint64(*fv), 10))
+			}
+		case *dnsName:
+			if useUnicode {
+				fields = append(fields, fv.unicodeString())
+			} else {
+				fields = append(fields, fv.String())
+			}
+		case *[]byte:
+			switch tag {
+			case "ipv4", "ipv6":
+				fields = append(fields, net.IP(*fv).String())
+			case "base64":
+				fields = append(fields, base64.StdEncoding.EncodeToString(*fv))
+			case "base32":
+				fields = append(fields, base32Hex.EncodeToString(*fv))
+			case "salt":
+				if len(*fv) == 0 {
+					fields = append(fields, "-")
+				} else {
+					fields = append(fields, strings.ToUpper(hex.EncodeToString(*fv)))
+				}
+			case "bitmap":
+				types, _ := bitmapTypes(*fv)
+				for _, t := range types {
+					fields = append(fields, typeString(t))
+				}
+			default:
+				fields = append(fields, hex.EncodeToString(*fv))
+			}
+		case *[]string:
+			for _, s := range *fv {
+				fields = append(fields, quoteCharString(s))
+			}
+		}
+		return true
+	})
+	return strings.Join(fields, " ")
+}
+
+func quoteCharString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			b.WriteString("\\" + leftPad3(int(c)))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// parseRdata is the text counterpart of unpackWalker. Names are relative
+// to origin and may be given in Unicode.
+func parseRdata(rd Walker, tokens []string, origin dnsName) error {
+	var err error
+	ok := rd.Walk(func(field interface{}, name, tag string) bool {
+		if len(tokens) == 0 && tag == "bitmap" {
+			return true // no types at all
+		}
+		if len(tokens) == 0 {
+			err = newError("missing rdata field " + name)
+			return false
+		}
+		tok := tokens[0]
+		tokens = tokens[1:]
+		switch fv := field.(type) {
+		default:
+			err = newError("unknown rdata field type for " + name)
+			return false
+		case *uint8:
+			var i uint64
+			if i, err = strconv.ParseUint(tok, 10, 8); err != nil {
+				return false
+			}
+			*fv = uint8(i)
+		case *uint16:
+			if tag == "type" {
+				t, ok := parseType(tok)
+				if !ok {
+					err = newError("unknown type " + tok)
+					return false
+				}
+				*fv = t
+				break
+			}
+			var i uint64
+			if i, err = strconv.ParseUint(tok, 10, 16); err != nil {
+				return false
+			}
+			*fv = uint16(i)
+		case *uint32:
+			if tag == "ttl" {
+				*fv, err = parseTTL(tok)
+			} else if tag == "time" {
+				*fv, err = parseSigTime(tok)
+			} else {
+				var i uint64
+				i, err = strconv.ParseUint(tok, 10, 32)
+				*fv = uint32(i)
+			}
+			if err != nil {
+				return false
+			}
+		case *dnsName:
+			if *fv, err = parseZoneName(tok, origin); err != nil {
+				return false
+			}
+		case *[]byte:
+			switch tag {
+			case "ipv4":
+				ip := net.ParseIP(tok).To4()
+				if ip == nil || strings.Contains(tok, ":") {
+					err = newError("bad IPv4 address " + tok)
+					return false
+				}
+				*fv = ip
+			case "ipv6":
+				ip := net.ParseIP(tok)
+				if ip == nil || !strings.Contains(tok, ":") {
+					err = newError("bad IPv6 address " + tok)
+					return false
+				}
+				*fv = ip.To16()
+			case "base64":
+				s := strings.Join(append([]string{tok}, tokens...), "")
+				tokens = nil
+				if *fv, err = base64.StdEncoding.DecodeString(s); err != nil {
+					return false
+				}
+			case "base32":
+				if *fv, err = base32Hex.DecodeString(strings.ToUpper(tok)); err != nil {
+					return false
+				}
+			case "salt":
+				if tok == "-" {
+					*fv = nil
+				} else if *fv, err = hex.DecodeString(tok); err != nil {
+					return false
+				}
+			case "bitmap":
+				var types []uint16
+				for _, s := range append([]string{tok}, tokens...) {
+					t, ok := parseType(s)
+					if !ok {
+						err = newError("unknown type " + s)
+						return false
+					}
+					types = append(types, t)
+				}
+				tokens = nil
+				*fv = typeBitmap(types)
+			default:
+				// The rest of the tokens, as hexadecimal.
+				s := strings.Join(append([]string{tok}, tokens...), "")
+				tokens = nil
+				if *fv, err = hex.DecodeString(s); err != nil {
+					return false
+				}
+			}
+		case *[]string:
+			for _, t := range append([]string{tok}, tokens...) {
+				var s string
+				if s, err = unescapeCharString(t); err != nil {
+					return false
+				}
+				*fv = append(*fv, s)
+			}
+			tokens = nil
+		}
+		return true
+	})
+	if !ok {
+		return err
+	}
+	if len(tokens) > 0 {
+		return newError("trailing rdata " + strings.Join(tokens, " "))
+	}
+	return nil
+}
+
+// unescapeCharString resolves \X and \DDD escapes in a character-string.
+func unescapeCharString(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		if len(s) > 255 {
+			return "", newError("character-string longer than 255 octets")
+		}
+		return s, nil
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", newError("trailing backslash in " + s)
+		}
+		if isDigit(s[i+1]) {
+			if i+3 >= len(s) || !isDigit(s[i+2]) || !isDigit(s[i+3]) {
+				return "", newError("bad \\DDD escape in " + s)
+			}
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			if n > 255 {
+				return "", newError("bad \\DDD escape in " + s)
+			}
+			b = append(b, byte(n))
+			i += 3
+		} else {
+			b = append(b, s[i+1])
+			i++
+		}
+	}
+	if len(b) > 255 {
+		return "", newError("character-string longer than 255 octets")
+	}
+	return string(b), nil
+}
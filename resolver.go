@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Iterative resolver for --recursive.
+
+// Root hints: the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net. They are only used to prime the real list.
+var defaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	resolverTimeout     = 2 * time.Second  // per query to one server
+	resolverRetries     = 2                // rounds over the server list
+	resolveTimeout      = 10 * time.Second // per client query
+	maxReferrals        = 30
+	maxQueriesPerLookup = 100 // bounds the work one client query causes
+	maxNSDepth          = 6   // nesting of lookups for NS addresses
+	maxMinimiseCount    = 10  // minimised queries per name (RFC 9156 section 2.3)
+	primeInterval       = 24 * time.Hour
+)
+
+func recursiveMain(cfg *config, udpFd int, tcpFd int, udp int, tcp int) error {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+
+	if udpFd < 0 && udp < 0 {
+		return newError("Select UDP as udp or udpfd")
+	}
+
+	r, err := newResolver(cfg)
+	if err != nil {
+		return err
+	}
+	allowed, err := cfg.acl(cfg.RecursionACL, cfg.AllowQuery)
+	if err != nil {
+		return err
+	}
+	srv := &recursiveServer{resolver: r, allowed: allowed}
+	log.Printf("recursive started pid:%d udpFd:%d tcpFd:%d", os.Getpid(), udpFd, tcpFd)
+
+	return listenAndServe(udpFd, tcpFd, udp, tcp, srv)
+}
+
+// recursor answers a question completely, whether by iterating from the
+// root or by asking another resolver.
+type recursor interface {
+	resolve(ctx context.Context, qname dnsName, qtype uint16) (*dnsMessage, error)
+}
+
+type recursiveServer struct {
+	resolver recursor
+	allowed  acl // who may recurse; everyone when nil
+}
+
+// serve answers stub clients with RA set.
+func (srv *recursiveServer) serve(req *dnsMessage, client net.IP) *dnsMessage {
+	res := newResponse(req)
+	res.RA = true
+	if err := srv.answer(req, res, client); err != nil {
+		log.Print(err)
+		res.Answer, res.Authority, res.Additional = nil, nil, nil
+		res.Rcode = errorRcode(err)
+	}
+	return res
+}
+
+func (srv *recursiveServer) answer(req *dnsMessage, res *dnsMessage, client net.IP) error {
+	if !srv.allowed.openTo(client, req.keyName()) {
+		return newRefusedError("recursion refused to " + client.String())
+	}
+	if req.Opcode != opcodeQuery {
+		return newNotImplementedError("opcode not implemented")
+	}
+	if len(req.Question) != 1 {
+		return newFormatError("exactly one question is supported", headerLen)
+	}
+	if !req.RD {
+		return newRefusedError("recursion not desired and nothing cached")
+	}
+	q := req.Question[0]
+	if q.Qclass != dnsClassINET {
+		return newRefusedError("class " + classString(q.Qclass) + " not served")
+	}
+	switch q.Qtype {
+	case dnsTypeAXFR, dnsTypeIXFR:
+		return newRefusedError("zone transfers are not recursed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	result, err := srv.resolver.resolve(ctx, q.Qname, q.Qtype)
+	if err != nil {
+		return err
+	}
+	res.Rcode = result.Rcode
+	res.Answer = result.Answer
+	res.Authority = result.Authority
+	if !req.dnssecOK() {
+		res.Answer = withoutDNSSEC(res.Answer, q.Qtype)
+		res.Authority = withoutDNSSEC(res.Authority, q.Qtype)
+	}
+	// AD only for clients that show they understand it (RFC 6840 5.8).
+	res.AD = result.AD && (req.dnssecOK() || req.AD)
+	return nil
+}
+
+// withoutDNSSEC drops the records a client without DO did not ask for.
+func withoutDNSSEC(rrs []dnsRR, qtype uint16) []dnsRR {
+	var out []dnsRR
+	for _, rr := range rrs {
+		switch rr.Type {
+		case dnsTypeRRSIG, dnsTypeNSEC, dnsTypeNSEC3:
+			if rr.Type != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// QNAME minimisation modes.
+const (
+	qnameMinRelaxed = "relaxed" // fall back to the full name on errors and NXDOMAIN
+	qnameMinStrict  = "strict"
+	qnameMinOff     = "off"
+)
+
+type resolver struct {
+	hints     []string // root server addresses, host:port
+	port      string   // port of name servers found in referrals
+	timeout   time.Duration
+	cache     *rrCache
+	qnameMin  string
+	validator *validator // nil without validation
+
+	mu       sync.Mutex
+	roots    []string
+	primedAt time.Time
+}
+
+func newResolver(cfg *config) (*resolver, error) {
+	v, err := newValidator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &resolver{
+		validator: v,
+		port:      "53",
+		timeout:   resolverTimeout,
+		cache:     newRRCache(cfg.Cache),
+		qnameMin:  cfg.QnameMinimisation,
+	}
+	if r.qnameMin == "" {
+		r.qnameMin = qnameMinRelaxed
+	}
+	hints := cfg.RootHints
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+	for _, h := range hints {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, r.port)
+		}
+		r.hints = append(r.hints, h)
+	}
+	return r, nil
+}
+
+// lookupState is shared by everything one client query sets off.
+type lookupState struct {
+	budget  int
+	pending map[string]bool // zones whose chain of trust is being built
+}
+
+// nameservers are the addresses serving zone.
+type nameservers struct {
+	zone  dnsName
+	addrs []string
+}
+
+// resolve answers qname/qtype. The result carries the RCODE, the CNAME
+// chain and final answer, and for negative answers the SOA.
+func (r *resolver) resolve(ctx context.Context, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	st := &lookupState{budget: maxQueriesPerLookup}
+	return r.lookup(ctx, st, qname, qtype, 0)
+}
+
+func (r *resolver) lookup(ctx context.Context, st *lookupState, qname dnsName, qtype uint16, depth int) (*dnsMessage, error) {
+	result := new(dnsMessage)
+	result.AD = r.validator != nil
+	for chain := 0; chain < maxCNAMEChain; chain++ {
+		if next, done := r.cache.answer(qname, qtype, result); done {
+			return result, nil
+		} else if next != "" {
+			qname = next
+			continue
+		}
+		res, zone, err := r.iterate(ctx, st, qname, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		status, err := r.validate(ctx, st, res, zone, qname, qtype, depth)
+		if status == secBogus {
+			metricBogus.Add(1)
+			return nil, newRcodeError("bogus answer for "+qname.String()+": "+err.Error(), rcodeServerFailure)
+		}
+		r.cache.cacheResponse(res, zone, status)
+		result.AD = result.AD && status == secSecure
+		next, done := followAnswer(res, zone, qname, qtype, result)
+		if done {
+			return result, nil
+		}
+		qname = next
+	}
+	return nil, newError("CNAME chain too long")
+}
+
+// followAnswer moves the part of res that answers qname into result. It
+// returns the name to continue with when the answer ends in a CNAME
+// pointing outside what the server answered for.
+func followAnswer(res *dnsMessage, zone dnsName, qname dnsName, qtype uint16, result *dnsMessage) (dnsName, bool) {
+	for seen := 0; seen < maxCNAMEChain; seen++ {
+		var cname *dnsRR
+		found := false
+		for i := range res.Answer {
+			rr := &res.Answer[i]
+			if !rr.Name.equal(qname) {
+				continue
+			}
+			switch {
+			case rr.Type == qtype || qtype == dnsTypeANY:
+				result.Answer = append(result.Answer, *rr)
+				found = true
+			case rr.Type == dnsTypeCNAME:
+				cname = rr
+			}
+		}
+		if found {
+			result.Rcode = rcodeSuccess
+			if qtype != dnsTypeANY {
+				result.Answer = append(result.Answer, sigsFor(res.Answer, qname, qtype)...)
+			}
+			// Proof that a wildcard answer was rightly expanded.
+			result.Authority = append(result.Authority, denialRecords(res.Authority)...)
+			return "", true
+		}
+		if cname == nil {
+			// NXDOMAIN or NODATA: keep the SOA for negative caching
+			// and the proof of denial.
+			result.Rcode = res.Rcode
+			for _, rr := range res.Authority {
+				if rr.Type == dnsTypeSOA {
+					result.Authority = append(result.Authority, rr)
+				}
+			}
+			result.Authority = append(result.Authority, denialRecords(res.Authority)...)
+			return "", true
+		}
+		result.Answer = append(result.Answer, *cname)
+		result.Answer = append(result.Answer, sigsFor(res.Answer, qname, dnsTypeCNAME)...)
+		rd, ok := cname.rdata()
+		if !ok {
+			result.Rcode = rcodeServerFailure
+			return "", true
+		}
+		qname = rd.(*dnsRdataName).Target
+		// Only believe the rest of the chain from a server authoritative
+		// for it; anything else is looked up afresh.
+		if !qname.isSubdomainOf(zone) {
+			return qname, false
+		}
+	}
+	return qname, false
+}
+
+// iterate follows referrals from the root down to a server that answers
+// for qname, returning that answer and the zone it came from.
+//
+// With QNAME minimisation (RFC 9156) each server is first asked about
+// one label more than the zone it serves, with QTYPE A, until the zone
+// holding qname is found. In relaxed mode a server that fails or answers
+// NXDOMAIN to such a query is asked again with the full name.
+func (r *resolver) iterate(ctx context.Context, st *lookupState, qname dnsName, qtype uint16, depth int) (*dnsMessage, dnsName, error) {
+	ns := r.closestServers(ctx, st, qname, qtype)
+	known := ns.zone.labelCount() // labels of qname known to exist in ns.zone
+	minimise := r.qnameMin != qnameMinOff
+	minimised := 0
+	for step := 0; step < maxReferrals+maxMinimiseCount; step++ {
+		qn, qt := qname, qtype
+		if minimise && known+1 < qname.labelCount() && minimised < maxMinimiseCount {
+			qn, qt = qname.suffix(known+1), dnsTypeA
+			minimised++
+		}
+		res, err := r.query(ctx, st, ns.addrs, qn, qt)
+		if err != nil {
+			if qn != qname && r.qnameMin == qnameMinRelaxed && ctx.Err() == nil {
+				minimise = false
+				continue
+			}
+			return nil, "", err
+		}
+		next, ok := referralFrom(res, ns.zone, qn)
+		if ok || qn != qname {
+			// Final answers are cached once validated.
+			r.cache.cacheResponse(res, ns.zone, secUnchecked)
+		}
+		if !ok && qn != qname {
+			switch {
+			case res.Rcode == rcodeSuccess:
+				// qn exists in this zone; try one label more.
+				known++
+				continue
+			case r.qnameMin == qnameMinRelaxed:
+				minimise = false
+				continue
+			}
+			// Strict: nothing exists below a name that does not exist
+			// (RFC 8020).
+		}
+		if !ok {
+			if res.Rcode != rcodeSuccess && res.Rcode != rcodeNameError {
+				return nil, "", newError("lame answer for " + qname.String())
+			}
+			return res, ns.zone, nil
+		}
+		next.addrs = r.referralAddrs(ctx, st, res, ns.zone, next.zone, depth)
+		if len(next.addrs) == 0 {
+			return nil, "", newError("no usable name server addresses for " + next.zone.String())
+		}
+		ns = next
+		known = ns.zone.labelCount()
+	}
+	return nil, "", newError("too many referrals for " + qname.String())
+}
+
+// closestServers finds the deepest zone above qname whose servers and
+// their addresses are cached, falling back to the roots. DS lives in the
+// parent, so a DS query starts above qname.
+func (r *resolver) closestServers(ctx context.Context, st *lookupState, qname dnsName, qtype uint16) nameservers {
+	n := qname
+	if qtype == dnsTypeDS && !n.isRoot() {
+		n = n.parent()
+	}
+	for ; !n.isRoot(); n = n.parent() {
+		nsrrs, _, ok := r.cache.get(n, dnsTypeNS, trustAdditional)
+		if !ok {
+			continue
+		}
+		var addrs []string
+		for _, rr := range nsrrs {
+			rd, ok := rr.rdata()
+			if !ok {
+				continue
+			}
+			a, _, ok := r.cache.get(rd.(*dnsRdataName).Target, dnsTypeA, trustAdditional)
+			if !ok {
+				continue
+			}
+			for _, rr := range a {
+				if len(rr.Rdata) == 4 {
+					addrs = append(addrs, net.JoinHostPort(net.IP(rr.Rdata).String(), r.port))
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return nameservers{n, addrs}
+		}
+	}
+	return nameservers{rootName, r.rootServers(ctx, st)}
+}
+
+// referralFrom recognises a referral in res: no answer, and NS records in
+// the authority section for a zone below the current one that contains
+// qname.
+func referralFrom(res *dnsMessage, zone dnsName, qname dnsName) (nameservers, bool) {
+	if res.Rcode != rcodeSuccess || len(res.Answer) > 0 {
+		return nameservers{}, false
+	}
+	for _, rr := range res.Authority {
+		if rr.Type == dnsTypeNS && qname.isSubdomainOf(rr.Name) &&
+			rr.Name.isSubdomainOf(zone) && !rr.Name.equal(zone) {
+			return nameservers{zone: rr.Name}, true
+		}
+	}
+	return nameservers{}, false
+}
+
+// referralAddrs collects the addresses of the servers for child. Glue is
+// only believed when it is within the zone of the server that sent it;
+// names without usable glue are resolved.
+func (r *resolver) referralAddrs(ctx context.Context, st *lookupState, res *dnsMessage, zone, child dnsName, depth int) []string {
+	var names []dnsName
+	for _, rr := range res.Authority {
+		if rr.Type != dnsTypeNS || !rr.Name.equal(child) {
+			continue
+		}
+		if rd, ok := rr.rdata(); ok {
+			names = append(names, rd.(*dnsRdataName).Target)
+		}
+	}
+
+	var addrs, v6 []string
+	var unglued []dnsName
+	for _, name := range names {
+		glued := false
+		if name.isSubdomainOf(zone) {
+			for _, rr := range res.Additional {
+				if !rr.Name.equal(name) {
+					continue
+				}
+				switch rr.Type {
+				case dnsTypeA:
+					addrs = append(addrs, net.JoinHostPort(net.IP(rr.Rdata).String(), r.port))
+					glued = true
+				case dnsTypeAAAA:
+					v6 = append(v6, net.JoinHostPort(net.IP(rr.Rdata).String(), r.port))
+					glued = true
+				}
+			}
+		}
+		if !glued {
+			unglued = append(unglued, name)
+		}
+	}
+	addrs = append(addrs, v6...)
+	if len(addrs) > 0 || depth >= maxNSDepth {
+		return addrs
+	}
+
+	// No glue at all: resolve the server names, stopping at the first
+	// that gives addresses.
+	for _, name := range unglued {
+		if name.isSubdomainOf(child) {
+			continue // would need the very servers we are looking for
+		}
+		result, err := r.lookup(ctx, st, name, dnsTypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range result.Answer {
+			if rr.Type == dnsTypeA && len(rr.Rdata) == 4 {
+				addrs = append(addrs, net.JoinHostPort(net.IP(rr.Rdata).String(), r.port))
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+// query asks the servers in turn, with retries, until one gives a
+// usable response. SERVFAIL, REFUSED and the like move on to the next.
+func (r *resolver) query(ctx context.Context, st *lookupState, addrs []string, qname dnsName, qtype uint16) (*dnsMessage, error) {
+	var lastErr error = newError("no servers to ask for " + qname.String())
+	for try := 0; try < resolverRetries; try++ {
+		for _, addr := range addrs {
+			if err := ctx.Err(); err != nil {
+				return nil, wrapError(err)
+			}
+			if st.budget--; st.budget < 0 {
+				return nil, newError("query budget exhausted for " + qname.String())
+			}
+			q := newQuery(qname, qtype, false)
+			if r.validator != nil {
+				q.setEDNS(maxUDPResponse, true)
+			}
+			res, err := exchange(ctx, addr, q, r.timeout)
+			if err == nil && res.Rcode == rcodeFormatError && q.opt() != nil {
+				// An old server that does not know EDNS.
+				q.clearEDNS()
+				res, err = exchange(ctx, addr, q, r.timeout)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if res.Rcode != rcodeSuccess && res.Rcode != rcodeNameError {
+				lastErr = newError(addr + " answered with RCODE " + strconv.Itoa(res.Rcode))
+				continue
+			}
+			return res, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// rootServers returns the primed root server list, priming it from the
+// hints when it is missing or old (RFC 8109).
+func (r *resolver) rootServers(ctx context.Context, st *lookupState) []string {
+	r.mu.Lock()
+	roots, primedAt := r.roots, r.primedAt
+	r.mu.Unlock()
+	if len(roots) > 0 && time.Since(primedAt) < primeInterval {
+		return roots
+	}
+
+	res, err := r.query(ctx, st, r.hints, rootName, dnsTypeNS)
+	if err != nil {
+		log.Printf("priming failed, using hints: %v", err)
+		return r.hints
+	}
+	var addrs []string
+	for _, rr := range res.Additional {
+		if rr.Type == dnsTypeA && len(rr.Rdata) == 4 {
+			addrs = append(addrs, net.JoinHostPort(net.IP(rr.Rdata).String(), r.port))
+		}
+	}
+	if len(addrs) == 0 {
+		return r.hints
+	}
+	r.mu.Lock()
+	r.roots, r.primedAt = addrs, time.Now()
+	r.mu.Unlock()
+	return addrs
+}
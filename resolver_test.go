@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A miniature Internet: each zone is served by its own authoritative
+// server on a loopback address, all of them on the same port.
+var testHierarchy = map[string]string{
+	"127.0.0.1": `$ORIGIN .
+$TTL 3600
+.	SOA	a.root. hostmaster.root. 1 7200 3600 1209600 300
+.	NS	a.root.
+a.root.	A	127.0.0.1
+example.	NS	ns.example.
+ns.example.	A	127.0.0.2
+other.	NS	ns.other.
+ns.other.	A	127.0.0.3
+unglued.	NS	ns.other.
+`,
+	"127.0.0.2": `$ORIGIN example.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 3600 1209600 300
+@	NS	ns
+ns	A	127.0.0.2
+www	A	192.0.2.1
+alias	CNAME	www.other.
+inner	CNAME	www
+x.y.deep	A	192.0.2.4
+`,
+	"127.0.0.3": `$ORIGIN other.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 3600 1209600 300
+@	NS	ns
+ns	A	127.0.0.3
+www	A	192.0.2.2
+$ORIGIN unglued.
+@	SOA	ns.other. hostmaster 1 7200 3600 1209600 300
+@	NS	ns.other.
+host	A	192.0.2.3
+`,
+}
+
+// startTestHierarchy serves zones and returns the common port. wrap, if
+// not nil, may replace the handler of each server.
+func startTestHierarchy(t *testing.T, zones map[string]string, wrap func(ip string, h dnsHandler) dnsHandler) string {
+	var port string
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		text, ok := zones[ip]
+		if !ok {
+			continue
+		}
+		zs := newZoneSet()
+		rrs, err := parseZone(strings.NewReader(text), ip, rootName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Split the records of one server into its zones by SOA.
+		byZone := make(map[string][]dnsRR)
+		var origins []dnsName
+		for _, rr := range rrs {
+			if rr.Type == dnsTypeSOA {
+				origins = append(origins, rr.Name)
+			}
+		}
+		for _, rr := range rrs {
+			best := dnsName("")
+			for _, o := range origins {
+				if rr.Name.isSubdomainOf(o) && (best == "" || o.labelCount() > best.labelCount()) {
+					best = o
+				}
+			}
+			byZone[best.key()] = append(byZone[best.key()], rr)
+		}
+		for _, o := range origins {
+			zs.add(newZone(o, byZone[o.key()]))
+		}
+
+		addr := ip + ":0"
+		if port != "" {
+			addr = net.JoinHostPort(ip, port)
+		}
+		laddr, _ := net.ResolveUDPAddr("udp", addr)
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Skipf("cannot listen on %s: %v", addr, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+		var h dnsHandler = &authServer{zones: zs}
+		if wrap != nil {
+			h = wrap(ip, h)
+		}
+		go serveUDP(conn, h)
+	}
+	return port
+}
+
+func testResolver(t *testing.T) *resolver {
+	return testResolverWrap(t, nil)
+}
+
+func testResolverWrap(t *testing.T, wrap func(ip string, h dnsHandler) dnsHandler) *resolver {
+	port := startTestHierarchy(t, testHierarchy, wrap)
+	r, err := newResolver(&config{
+		RootHints: []string{net.JoinHostPort("127.0.0.1", port)},
+		DNSSEC:    dnssecConfig{Validation: "off"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.port = port
+	r.timeout = 500 * time.Millisecond
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	r := testResolver(t)
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{"www.example.", dnsTypeA, rcodeSuccess, []string{"www.example.\t3600\tIN\tA\t192.0.2.1"}},
+		{"inner.example.", dnsTypeA, rcodeSuccess, []string{
+			"inner.example.\t3600\tIN\tCNAME\twww.example.",
+			"www.example.\t3600\tIN\tA\t192.0.2.1"}},
+		{"alias.example.", dnsTypeA, rcodeSuccess, []string{
+			"alias.example.\t3600\tIN\tCNAME\twww.other.",
+			"www.other.\t3600\tIN\tA\t192.0.2.2"}},
+		{"host.unglued.", dnsTypeA, rcodeSuccess, []string{"host.unglued.\t3600\tIN\tA\t192.0.2.3"}},
+		{"nx.example.", dnsTypeA, rcodeNameError, nil},
+		{"www.example.", dnsTypeAAAA, rcodeSuccess, nil},
+		{"nx.", dnsTypeA, rcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := r.resolve(ctx, mustParseName(tt.name), tt.qtype)
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for i := range res.Answer {
+			got = append(got, res.Answer[i].String())
+		}
+		if res.Rcode != tt.rcode || strings.Join(got, "\n") != strings.Join(tt.answer, "\n") {
+			t.Errorf("%s: rcode %d, answer:\n%s", tt.name, res.Rcode, strings.Join(got, "\n"))
+		}
+		if tt.answer == nil && len(res.Authority) != 1 {
+			t.Errorf("%s: negative answer without SOA", tt.name)
+		}
+	}
+}
+
+func TestRecursiveServe(t *testing.T) {
+	srv := &recursiveServer{resolver: testResolver(t)}
+	req := testQuery("www.example.", dnsTypeA)
+	req.RD = true
+	res := srv.serve(req, testClient)
+	if !res.RA || res.AA || res.Rcode != rcodeSuccess || len(res.Answer) != 1 {
+		t.Errorf("RA %v AA %v rcode %d answers %d", res.RA, res.AA, res.Rcode, len(res.Answer))
+	}
+	req.RD = false
+	if res := srv.serve(req, testClient); res.Rcode != rcodeRefused {
+		t.Errorf("RD=0: rcode %d", res.Rcode)
+	}
+}
+
+func TestResolveFromCache(t *testing.T) {
+	r := testResolver(t)
+	ctx := context.Background()
+	if _, err := r.resolve(ctx, mustParseName("alias.example."), dnsTypeA); err != nil {
+		t.Fatal(err)
+	}
+	// With no queries allowed, only the cache can answer.
+	res, err := r.lookup(ctx, &lookupState{}, mustParseName("alias.example."), dnsTypeA, 0)
+	if err != nil || len(res.Answer) != 2 {
+		t.Fatalf("%v %v", err, res)
+	}
+	if res.Answer[1].String() != "www.other.\t3600\tIN\tA\t192.0.2.2" {
+		t.Errorf("cached answer %s", res.Answer[1].String())
+	}
+	// The servers for other. are known now; no root query is needed.
+	if _, err := r.lookup(ctx, &lookupState{budget: 1}, mustParseName("ns.other."), dnsTypeA, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveNegativeFromCache(t *testing.T) {
+	r := testResolver(t)
+	ctx := context.Background()
+	if _, err := r.resolve(ctx, mustParseName("nx.example."), dnsTypeA); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nx.example.", "deep.below.nx.example."} {
+		res, err := r.lookup(ctx, &lookupState{}, mustParseName(name), dnsTypeAAAA, 0)
+		if err != nil || res.Rcode != rcodeNameError || len(res.Authority) != 1 || res.Authority[0].Type != dnsTypeSOA {
+			t.Errorf("%s: %v %v", name, err, res)
+		}
+	}
+}
+
+// queryLogger records the questions a server is asked and can answer
+// some of them with NXDOMAIN, like servers that do not know about empty
+// non-terminals.
+type queryLogger struct {
+	h       dnsHandler
+	ip      string
+	nxNames map[string]bool
+
+	mu  *sync.Mutex // guards log and nxNames
+	log *[]string
+}
+
+func (l *queryLogger) serve(req *dnsMessage, client net.IP) *dnsMessage {
+	q := req.Question[0]
+	l.mu.Lock()
+	*l.log = append(*l.log, l.ip+" "+q.Qname.String()+" "+typeString(q.Qtype))
+	nx := l.nxNames[q.Qname.key()]
+	l.mu.Unlock()
+	if nx {
+		res := newResponse(req)
+		res.Rcode = rcodeNameError
+		return res
+	}
+	return l.h.serve(req, client)
+}
+
+func TestQnameMinimisation(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	nx := map[string]bool{}
+	r := testResolverWrap(t, func(ip string, h dnsHandler) dnsHandler {
+		return &queryLogger{h, ip, nx, &mu, &queries}
+	})
+	name := mustParseName("x.y.deep.example.")
+	resolve := func(mode string) (*dnsMessage, []string) {
+		r.qnameMin = mode
+		r.cache = newRRCache(cacheConfig{})
+		r.roots = nil
+		mu.Lock()
+		queries = nil
+		mu.Unlock()
+		res, err := r.resolve(context.Background(), name, dnsTypeTXT)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return res, append([]string(nil), queries...)
+	}
+
+	res, queries := resolve(qnameMinRelaxed)
+	want := []string{
+		"127.0.0.1 . NS", // priming
+		"127.0.0.1 example. A",
+		"127.0.0.2 deep.example. A",
+		"127.0.0.2 y.deep.example. A",
+		"127.0.0.2 x.y.deep.example. TXT",
+	}
+	if res.Rcode != rcodeSuccess || strings.Join(queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("relaxed: rcode %d, queries:\n%s", res.Rcode, strings.Join(queries, "\n"))
+	}
+
+	_, queries = resolve(qnameMinOff)
+	if len(queries) != 3 || queries[1] != "127.0.0.1 x.y.deep.example. TXT" {
+		t.Errorf("off: queries:\n%s", strings.Join(queries, "\n"))
+	}
+
+	// A server answering NXDOMAIN for an empty non-terminal.
+	mu.Lock()
+	nx[mustParseName("y.deep.example.").key()] = true
+	mu.Unlock()
+	if res, queries = resolve(qnameMinRelaxed); res.Rcode != rcodeSuccess || queries[len(queries)-1] != "127.0.0.2 x.y.deep.example. TXT" {
+		t.Errorf("relaxed fallback: rcode %d, queries:\n%s", res.Rcode, strings.Join(queries, "\n"))
+	}
+	if res, _ = resolve(qnameMinStrict); res.Rcode != rcodeNameError {
+		t.Errorf("strict: rcode %d", res.Rcode)
+	}
+}
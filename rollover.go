@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// Key rollovers of signed zones. Both kinds of key roll by pre-publishing
+// their successor: a new ZSK is in the DNSKEY set before it signs the
+// zone (RFC 6781 section 4.1.1.1); a new KSK signs the DNSKEY set next to
+// the old one and replaces it in the CDS and CDNSKEY sets when it takes
+// over (double signature, RFC 6781 section 4.1.2). A retired key stays
+// in the DNSKEY set until nothing cached can depend on it.
+
+const (
+	defaultPropagation = time.Hour          // for changes to reach every secondary
+	defaultParentDelay = 2 * 24 * time.Hour // for the parent to pick up CDS, plus its DS TTL
+)
+
+// Key states. A ZSK signs the zone only while active; a KSK signs the
+// DNSKEY set in all of them but is in the CDS set only while active.
+const (
+	keyPublished = "published"
+	keyActive    = "active"
+	keyRetired   = "retired"
+)
+
+// roll moves the keys on as their lifetimes and the TTLs in t require,
+// reporting whether anything changed.
+func (s *zoneSigner) roll(t *zoneTree) (bool, error) {
+	soa := t.get(s.origin).rrset(dnsTypeSOA)
+	if len(soa) == 0 {
+		return false, newError(s.origin.String() + " has no SOA")
+	}
+	now := s.now()
+	// The DNSKEY set has the SOA's TTL.
+	prepublish := time.Duration(soa[0].Ttl)*time.Second + s.propagation
+	roles := []struct {
+		flags    uint16
+		lifetime time.Duration
+		retire   time.Duration
+	}{
+		{dnskeyZone | dnskeySEP, s.kskLifetime, s.parentDelay + s.propagation},
+		{dnskeyZone, s.zskLifetime, time.Duration(maxTTL(t))*time.Second + s.propagation},
+	}
+	changed := false
+	for _, r := range roles {
+		c, err := s.rollKeys(r.flags, r.lifetime, prepublish, r.retire, now)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// rollKeys takes the keys with flags one step on: a successor is
+// published prepublish before the active key's lifetime ends, takes over
+// when it has ended, and the retired key is removed after retire.
+func (s *zoneSigner) rollKeys(flags uint16, lifetime, prepublish, retire time.Duration, now time.Time) (bool, error) {
+	changed := false
+	var cur, next *signingKey
+	var kept []*signingKey
+	for _, k := range s.keys {
+		if k.dnskey.Flags != flags {
+			kept = append(kept, k)
+			continue
+		}
+		switch k.state {
+		case keyRetired:
+			if !now.Before(k.since.Add(retire)) {
+				if err := os.Remove(k.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return changed, wrapError(err)
+				}
+				log.Printf("removed key %d of %s", k.tag, s.origin)
+				changed = true
+				continue
+			}
+		case keyActive:
+			if cur == nil || k.since.After(cur.since) {
+				cur = k
+			}
+		case keyPublished:
+			next = k
+		}
+		kept = append(kept, k)
+	}
+	s.keys = kept
+
+	switch {
+	case next != nil && !now.Before(next.since.Add(prepublish)) &&
+		(cur == nil || lifetime == 0 || !now.Before(cur.since.Add(lifetime))):
+		if err := next.setState(keyActive, now); err != nil {
+			return changed, err
+		}
+		if cur != nil {
+			if err := cur.setState(keyRetired, now); err != nil {
+				return changed, err
+			}
+		}
+		log.Printf("key %d of %s is active", next.tag, s.origin)
+		changed = true
+	case next == nil && cur != nil && lifetime > 0 && !now.Before(cur.since.Add(lifetime-prepublish)):
+		k, err := s.generateKey(flags, keyPublished)
+		if err != nil {
+			return changed, err
+		}
+		s.keys = append(s.keys, k)
+		changed = true
+	}
+	return changed, nil
+}
+
+// maxTTL is the longest TTL in t, how long a signature may be cached.
+func maxTTL(t *zoneTree) uint32 {
+	var ttl uint32
+	t.walk(func(n *zoneNode) bool {
+		for _, rrs := range n.rrsets {
+			for _, rr := range rrs {
+				ttl = max(ttl, rr.Ttl)
+			}
+		}
+		return true
+	})
+	return ttl
+}
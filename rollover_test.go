@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func tagsOf(keys []*signingKey) []uint16 {
+	var tags []uint16
+	for _, k := range keys {
+		tags = append(tags, k.tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// signedBy returns the key tags of the RRSIGs over the typ RRset at name.
+func signedBy(t *zoneTree, name dnsName, typ uint16) []uint16 {
+	var tags []uint16
+	for _, rr := range sigsFor(t.get(name).rrset(dnsTypeRRSIG), name, typ) {
+		rd, _ := rr.rdata()
+		tags = append(tags, rd.(*dnsRdataRRSIG).KeyTag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+func sameTags(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRollover(t *testing.T) {
+	day := 24 * time.Hour
+	dir := t.TempDir()
+	cfg := &signingConfig{ZSKLifetime: 10 * 86400, KSKLifetime: 30 * 86400, Propagation: 3600, ParentDelay: 2 * 86400}
+	s, err := newZoneSigner(mustParseName("example."), cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := s.keys[0].since
+	for _, k := range s.keys {
+		if k.since.After(start) {
+			start = k.since
+		}
+	}
+	clock := &testClock{start}
+	s.now = clock.now
+	z := testSignedZone(t, s, testSignZone)
+	www := mustParseName("www.example.")
+
+	// The SOA TTL of an hour and the propagation time make keys wait
+	// two hours before they are used, and ZSKs two hours after.
+	ksk, zsk := uint16(dnskeyZone|dnskeySEP), uint16(dnskeyZone)
+	steps := []struct {
+		at                   time.Duration
+		zskPublished, zskRet int
+		kskPublished, kskRet int
+	}{
+		{time.Hour, 0, 0, 0, 0},
+		{10*day - 2*time.Hour, 1, 0, 0, 0},
+		{10 * day, 0, 1, 0, 0},
+		{10*day + 2*time.Hour, 0, 0, 0, 0},
+		{30*day - 2*time.Hour, 1, 0, 1, 0},
+		{30 * day, 0, 1, 0, 1},
+		{32 * day, 0, 0, 0, 1},
+		{32*day + time.Hour, 0, 0, 0, 0},
+	}
+	for _, step := range steps {
+		clock.t = start.Add(step.at)
+		if err := z.maintain(false); err != nil {
+			t.Fatal(err)
+		}
+		when := step.at.String()
+		if n := len(s.keysIn(zsk, keyPublished)); n != step.zskPublished {
+			t.Errorf("%s: %d published ZSKs", when, n)
+		}
+		if n := len(s.keysIn(zsk, keyRetired)); n != step.zskRet {
+			t.Errorf("%s: %d retired ZSKs", when, n)
+		}
+		if n := len(s.keysIn(ksk, keyPublished)); n != step.kskPublished {
+			t.Errorf("%s: %d published KSKs", when, n)
+		}
+		if n := len(s.keysIn(ksk, keyRetired)); n != step.kskRet {
+			t.Errorf("%s: %d retired KSKs", when, n)
+		}
+		if len(s.keysIn(zsk, keyActive)) != 1 || len(s.keysIn(ksk, keyActive)) != 1 {
+			t.Fatalf("%s: not one active key of each kind", when)
+		}
+
+		tree := z.snapshot()
+		if n := len(tree.get(s.origin).rrset(dnsTypeDNSKEY)); n != len(s.keys) {
+			t.Errorf("%s: %d DNSKEYs for %d keys", when, n, len(s.keys))
+		}
+		if got := signedBy(tree, www, dnsTypeA); !sameTags(got, tagsOf(s.keysIn(zsk, keyActive))) {
+			t.Errorf("%s: data signed by %v", when, got)
+		}
+		allKSKs := tagsOf(s.keysWith(ksk))
+		if got := signedBy(tree, s.origin, dnsTypeDNSKEY); !sameTags(got, allKSKs) {
+			t.Errorf("%s: DNSKEY set signed by %v, want %v", when, got, allKSKs)
+		}
+		cds := tree.get(s.origin).rrset(dnsTypeCDS)
+		if len(cds) != 1 {
+			t.Fatalf("%s: %d CDS records", when, len(cds))
+		}
+		rd, _ := cds[0].rdata()
+		if tag := rd.(*dnsRdataDS).KeyTag; tag != s.keysIn(ksk, keyActive)[0].tag {
+			t.Errorf("%s: CDS for key %d", when, tag)
+		}
+		if len(tree.get(s.origin).rrset(dnsTypeCDNSKEY)) != 1 {
+			t.Errorf("%s: no CDNSKEY", when)
+		}
+	}
+
+	// The states survive a restart, and removed keys are gone.
+	again, err := newZoneSigner(mustParseName("example."), cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.keys) != len(s.keys) {
+		t.Fatalf("%d keys after restart, want %d", len(again.keys), len(s.keys))
+	}
+	for _, k := range s.keys {
+		found := false
+		for _, l := range again.keys {
+			if l.tag == k.tag && l.state == k.state && l.since.Equal(k.since) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("key %d %s since %v not found after restart", k.tag, k.state, k.since)
+		}
+	}
+}
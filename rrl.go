@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Response rate limiting for UDP, after BIND and Knot. Responses are
+// counted in token buckets keyed by the client's netblock and what the
+// response is about: the name and type of an answer, the zone of an
+// NXDOMAIN or NODATA, the delegation of a referral, or nothing for
+// errors. A bucket over its rate drops responses, except that every
+// slip-th one goes out truncated, so that real clients behind a spoofed
+// address can retry over TCP. Reflected floods then carry no more than
+// the rate from any one netblock.
+
+const (
+	rrlDefaultWindow = 15 // seconds
+	rrlDefaultSlip   = 2
+	rrlDefaultIPv4   = 24 // prefix lengths of a netblock
+	rrlDefaultIPv6   = 56
+	rrlSweepInterval = time.Second
+)
+
+// What a response is about, for separate rates.
+const (
+	rrlAnswer = iota
+	rrlNXDomain
+	rrlError
+)
+
+// Actions for a response.
+const (
+	rrlSend = iota
+	rrlDrop
+	rrlSlip // send it truncated
+)
+
+type rateLimiter struct {
+	rates   [3]float64 // responses per second by kind
+	window  float64    // seconds a bucket remembers, and at most owes
+	slip    int
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	exempt  acl
+	logOnly bool
+	now     func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+}
+
+type rrlBucket struct {
+	balance  float64 // responses that may still go out; negative in debt
+	last     time.Time
+	dropped  int  // since the bucket went over, for slip
+	limiting bool // logged as over its rate
+}
+
+// newRateLimiter sets up RRL as configured.
+func newRateLimiter(cfg *rateLimitConfig, exempt acl) *rateLimiter {
+	rl := &rateLimiter{
+		window:  rrlDefaultWindow,
+		slip:    rrlDefaultSlip,
+		ipv4:    net.CIDRMask(rrlDefaultIPv4, 8*net.IPv4len),
+		ipv6:    net.CIDRMask(rrlDefaultIPv6, 8*net.IPv6len),
+		exempt:  exempt,
+		logOnly: cfg.LogOnly,
+		now:     time.Now,
+		buckets: make(map[string]*rrlBucket),
+	}
+	rl.rates[rrlAnswer] = float64(cfg.ResponsesPerSecond)
+	rl.rates[rrlNXDomain] = float64(cfg.NXDomainsPerSecond)
+	rl.rates[rrlError] = float64(cfg.ErrorsPerSecond)
+	for kind := range rl.rates {
+		if rl.rates[kind] == 0 {
+			rl.rates[kind] = float64(cfg.ResponsesPerSecond)
+		}
+	}
+	if cfg.Window > 0 {
+		rl.window = float64(cfg.Window)
+	}
+	if cfg.Slip != nil {
+		rl.slip = *cfg.Slip
+	}
+	if cfg.IPv4PrefixLength > 0 {
+		rl.ipv4 = net.CIDRMask(cfg.IPv4PrefixLength, 8*net.IPv4len)
+	}
+	if cfg.IPv6PrefixLength > 0 {
+		rl.ipv6 = net.CIDRMask(cfg.IPv6PrefixLength, 8*net.IPv6len)
+	}
+	return rl
+}
+
+// check counts res, a response to client, and says what to do with it.
+func (rl *rateLimiter) check(client net.IP, res *dnsMessage) int {
+	if client == nil || rl.exempt.allows(client) {
+		return rrlSend
+	}
+	kind, key := rl.key(client, res)
+	rate := rl.rates[kind]
+	if rate <= 0 {
+		return rrlSend
+	}
+	now := rl.now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	b := rl.buckets[key]
+	if b == nil {
+		b = &rrlBucket{balance: rate, last: now}
+		rl.buckets[key] = b
+	}
+	b.balance = min(b.balance+now.Sub(b.last).Seconds()*rate, rate) - 1
+	b.balance = max(b.balance, -rl.window*rate)
+	b.last = now
+	if b.balance >= 0 {
+		if b.limiting {
+			log.Printf("rate limit: %s back under %g responses per second", rl.describe(client, res), rate)
+			b.limiting, b.dropped = false, 0
+		}
+		return rrlSend
+	}
+	metricRRLLimited.Add(1)
+	if !b.limiting {
+		mode := ""
+		if rl.logOnly {
+			mode = " (log only)"
+		}
+		log.Printf("rate limit: %s over %g responses per second%s", rl.describe(client, res), rate, mode)
+		b.limiting = true
+	}
+	if rl.logOnly {
+		return rrlSend
+	}
+	b.dropped++
+	if rl.slip > 0 && b.dropped%rl.slip == 0 {
+		metricRRLSlipped.Add(1)
+		return rrlSlip
+	}
+	metricRRLDropped.Add(1)
+	return rrlDrop
+}
+
+// key returns the kind of res and its bucket for client.
+func (rl *rateLimiter) key(client net.IP, res *dnsMessage) (int, string) {
+	var block net.IP
+	if ip4 := client.To4(); ip4 != nil {
+		block = ip4.Mask(rl.ipv4)
+	} else {
+		block = client.Mask(rl.ipv6)
+	}
+	kind, name, qtype := rrlError, "", uint16(0)
+	switch res.Rcode {
+	case rcodeSuccess, rcodeNameError:
+		kind = rrlAnswer
+		if res.Rcode == rcodeNameError {
+			kind = rrlNXDomain
+		}
+		switch {
+		case res.Rcode == rcodeSuccess && len(res.Answer) > 0 && len(res.Question) > 0:
+			name, qtype = res.Question[0].Qname.key(), res.Question[0].Qtype
+		case len(res.Authority) > 0:
+			// The zone of a denial, the delegation of a referral.
+			name, qtype = res.Authority[0].Name.key(), res.Authority[0].Type
+		case len(res.Question) > 0:
+			name = res.Question[0].Qname.key()
+		}
+	}
+	b := append([]byte{byte(kind)}, block...)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return kind, string(b) + name
+}
+
+func (rl *rateLimiter) describe(client net.IP, res *dnsMessage) string {
+	s := "responses to " + client.String()
+	if len(res.Question) > 0 {
+		s += " for " + res.Question[0].Qname.String() + " " + typeString(res.Question[0].Qtype)
+	}
+	return s
+}
+
+// sweep forgets buckets that have been idle long enough to be full
+// again, even from the deepest debt. The caller holds rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rrlSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	idle := time.Duration((rl.window + 1) * float64(time.Second))
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > idle {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// dnsRateLimited is implemented by handlers whose UDP responses may be
+// rate limited.
+type dnsRateLimited interface {
+	rateLimiter() *rateLimiter
+}
+
+// limitResponse applies the rate limiter of h, if any, to res, a UDP
+// response to client. It reports whether res is to be sent, truncating
+// it first for a slip.
+func limitResponse(h dnsHandler, client net.IP, res *dnsMessage) bool {
+	rh, ok := h.(dnsRateLimited)
+	if !ok || rh.rateLimiter() == nil {
+		return true
+	}
+	switch rh.rateLimiter().check(client, res) {
+	case rrlDrop:
+		return false
+	case rrlSlip:
+		opt := res.opt()
+		res.TC = true
+		res.Answer, res.Authority, res.Additional = nil, nil, nil
+		if opt != nil {
+			res.Additional = []dnsRR{*opt}
+		}
+	}
+	return true
+}
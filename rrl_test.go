@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	slip := 2
+	exempt, _ := parseACL([]string{"198.51.100.0/24"})
+	rl := newRateLimiter(&rateLimitConfig{ResponsesPerSecond: 3, NXDomainsPerSecond: 1, Window: 2, Slip: &slip}, exempt)
+	clock := &testClock{time.Now()}
+	rl.now = clock.now
+	srv := testAuthServer(t)
+	answer := srv.serve(testQuery("www.example.", dnsTypeA), testClient)
+	nxdomain := srv.serve(testQuery("absent.example.", dnsTypeA), testClient)
+	check := func(client string, res *dnsMessage, want ...int) {
+		t.Helper()
+		for i, w := range want {
+			if got := rl.check(net.ParseIP(client), res); got != w {
+				t.Errorf("%s, response %d: action %d, want %d", client, i, got, w)
+			}
+		}
+	}
+
+	// The burst is the rate; after it every second response slips.
+	check("192.0.2.1", answer, rrlSend, rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop)
+	// The netblock shares the bucket, other names and kinds do not.
+	check("192.0.2.200", answer, rrlSlip)
+	check("192.0.2.1", nxdomain, rrlSend, rrlDrop)
+	check("203.0.113.1", answer, rrlSend)
+	check("198.51.100.1", answer, rrlSend, rrlSend, rrlSend, rrlSend, rrlSend)
+
+	// The debt is worked off at the rate; once clear, the count towards
+	// the next slip starts afresh.
+	clock.t = clock.t.Add(time.Second)
+	check("192.0.2.1", answer, rrlDrop)
+	clock.t = clock.t.Add(4 * time.Second)
+	check("192.0.2.1", answer, rrlSend, rrlSend, rrlSend, rrlDrop)
+
+	rl.logOnly = true
+	before := metricRRLLimited.Value()
+	check("192.0.2.1", answer, rrlSend, rrlSend)
+	if metricRRLLimited.Value() != before+2 {
+		t.Error("log-only responses not counted")
+	}
+}
+
+func TestRateLimitUDP(t *testing.T) {
+	srv := testAuthServer(t)
+	slip := 2
+	srv.rrl = newRateLimiter(&rateLimitConfig{ResponsesPerSecond: 1, Slip: &slip}, nil)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go serveUDP(conn, srv)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		req := testQuery("www.example.", dnsTypeA)
+		req.Id = uint16(i)
+		reqBytes, _ := req.Pack()
+		if _, err := client.Write(reqBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One answer goes out, one is dropped and one slips out truncated.
+	var full, truncated int
+	client.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			break
+		}
+		res := new(dnsMessage)
+		if err := res.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if res.TC && len(res.Answer) == 0 {
+			truncated++
+		} else {
+			full++
+		}
+	}
+	if full != 1 || truncated != 1 {
+		t.Errorf("%d answers and %d truncated responses", full, truncated)
+	}
+}
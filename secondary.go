@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Secondary zones are copied from their primaries by IXFR, or AXFR for
+// the first copy, and kept fresh by the SOA timers (RFC 1034 section
+// 4.3.5). Once the expire time passes without reaching a primary the zone
+// is answered with SERVFAIL. The copy is kept in the zone's file, whose
+// modification time tells a restarted server how fresh it still is.
+
+const (
+	secondaryTimeout = 30 * time.Second // per primary, for a check or a transfer
+	initialRetry     = time.Minute      // until the first copy arrives
+	minSOARefresh    = 5 * time.Second  // whatever the SOA says
+)
+
+type secondary struct {
+	primaries []string // "address:port"
+	notifiers acl      // the primaries' addresses, or the zone's key
+	now       func() time.Time
+	expires   atomic.Int64  // UnixNano; zero while there is no copy
+	check     chan struct{} // a NOTIFY asks for a check now
+}
+
+// newSecondaryZone starts a secondary zone from the copy saved in file,
+// if there is one.
+func newSecondaryZone(origin dnsName, file string, primaries []string) (*zone, error) {
+	s := &secondary{now: time.Now, check: make(chan struct{}, 1)}
+	var hosts []string
+	for _, addr := range primaries {
+		addr = withPort(addr)
+		host, _, _ := net.SplitHostPort(addr)
+		s.primaries = append(s.primaries, addr)
+		hosts = append(hosts, host)
+	}
+	var err error
+	if s.notifiers, err = parseACL(hosts); err != nil {
+		return nil, newError("primaries of " + origin.String() + ": " + err.Error())
+	}
+	z := newZone(origin, nil)
+	z.file, z.secondary = file, s
+	if file == "" {
+		return z, nil
+	}
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return z, nil
+	}
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	rrs, err := loadZoneFile(file, origin)
+	if err == nil {
+		err = checkZone(origin, rrs)
+	}
+	if err != nil {
+		log.Printf("ignoring the saved copy of %s: %v", origin, err)
+		return z, nil
+	}
+	if err := z.replace(rrs); err != nil {
+		return nil, err
+	}
+	if _, soa, ok := z.soa(); ok {
+		s.expires.Store(info.ModTime().Add(seconds(soa.Expire)).UnixNano())
+	}
+	return z, nil
+}
+
+// setKey has z signed with key towards its primaries and secondaries. A
+// secondary then takes NOTIFY signed with the key from anywhere, and
+// unsigned ones not at all.
+func (z *zone) setKey(key *tsigKey) {
+	z.key = key
+	if z.secondary != nil {
+		z.secondary.notifiers = acl{{key: key.name.key()}}
+	}
+}
+
+// signed returns q to be signed with the key of z, if it has one.
+func (z *zone) signed(q *dnsMessage) *dnsMessage {
+	if z.key != nil {
+		q.tsig = newTSIGState(z.key)
+	}
+	return q
+}
+
+func seconds(s uint32) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// fresh reports whether the copy may still be served.
+func (s *secondary) fresh() bool {
+	e := s.expires.Load()
+	return e != 0 && s.now().UnixNano() < e
+}
+
+// serving reports whether z has data to answer with: always for a
+// primary zone, until it expires for a secondary.
+func (z *zone) serving() bool {
+	return z.secondary == nil || z.secondary.fresh()
+}
+
+// keepSecondariesFresh starts refreshing every secondary zone in zs.
+func (zs *zoneSet) keepSecondariesFresh() {
+	for _, z := range zs.zones {
+		if z.secondary != nil {
+			go z.keepFresh()
+		}
+	}
+}
+
+// keepFresh refreshes z as its SOA timers say, or at once on a NOTIFY.
+// It does not return.
+func (z *zone) keepFresh() {
+	for {
+		select {
+		case <-time.After(z.refresh()):
+		case <-z.secondary.check:
+		}
+	}
+}
+
+// refresh brings z up to date from the first primary that answers and
+// returns when to check again: after the refresh time on success, the
+// retry time otherwise.
+func (z *zone) refresh() time.Duration {
+	s := z.secondary
+	wait := initialRetry
+	if _, soa, ok := z.soa(); ok {
+		wait = seconds(soa.Retry)
+	}
+	for _, primary := range s.primaries {
+		err := z.refreshFrom(primary)
+		if err != nil {
+			log.Printf("refreshing %s from %s: %v", z.origin, primary, err)
+			continue
+		}
+		_, soa, _ := z.soa()
+		now := s.now()
+		s.expires.Store(now.Add(seconds(soa.Expire)).UnixNano())
+		if z.file != "" {
+			if err := os.Chtimes(z.file, now, now); err != nil {
+				log.Printf("saving %s: %v", z.origin, err)
+			}
+		}
+		wait = seconds(soa.Refresh)
+		break
+	}
+	if s.expires.Load() != 0 && !s.fresh() {
+		log.Printf("%s has expired", z.origin)
+	}
+	return max(wait, minSOARefresh)
+}
+
+// refreshFrom compares the serials and transfers the zone from primary
+// when it has a newer one. The check goes over TCP like the transfer.
+func (z *zone) refreshFrom(primary string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secondaryTimeout)
+	defer cancel()
+	if _, cur, ok := z.soa(); ok {
+		res, err := exchangeTCP(ctx, primary, z.signed(newQuery(z.origin, dnsTypeSOA, false)), secondaryTimeout)
+		if err != nil {
+			return err
+		}
+		if res.Rcode != rcodeSuccess || !res.AA || len(res.Answer) == 0 || res.Answer[0].Type != dnsTypeSOA {
+			return newError("no authoritative SOA for " + z.origin.String())
+		}
+		serial, ok := soaSerial(res.Answer[0])
+		if !ok {
+			return newError("bad SOA for " + z.origin.String())
+		}
+		if !serialBefore(cur.Serial, serial) {
+			return nil
+		}
+	}
+	return z.transferIn(ctx, primary)
+}
+
+// transferIn pulls z from primary and publishes and saves the result:
+// IXFR from the current serial, AXFR when there is no copy yet.
+func (z *zone) transferIn(ctx context.Context, primary string) error {
+	q := z.signed(newQuery(z.origin, dnsTypeAXFR, false))
+	cur, soa, ok := z.soa()
+	if ok {
+		q.Question[0].Qtype = dnsTypeIXFR
+		q.Authority = []dnsRR{cur}
+	}
+	in, err := receiveTransfer(ctx, primary, q, soa)
+	if err != nil {
+		return err
+	}
+	switch {
+	case in.full != nil:
+		if err := checkZone(z.origin, in.full); err != nil {
+			return err
+		}
+		if err := z.replace(in.full); err != nil {
+			return err
+		}
+	case len(in.diffs) > 0:
+		if from, _ := soaSerial(in.diffs[0].from); from != soa.Serial {
+			return newError(fmt.Sprintf("IXFR does not start at serial %d", soa.Serial))
+		}
+		err := z.update(func(x *zoneTxn) error { return applyDiffs(z.origin, x, in.diffs) })
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	_, now, _ := z.soa()
+	log.Printf("%s of %s from %s: serial %d", typeString(q.Question[0].Qtype), z.origin, primary, now.Serial)
+	if z.file != "" {
+		if err := writeZoneFile(z.file, z.origin, z.snapshot(), nil); err != nil {
+			log.Printf("saving %s: %v", z.origin, err)
+		}
+	}
+	return nil
+}
+
+// inboundTransfer is a received transfer: the whole zone, the changes
+// from our serial on, or neither when we are up to date.
+type inboundTransfer struct {
+	full  []dnsRR
+	diffs []*zoneDiff
+}
+
+// receiveTransfer sends q, an AXFR or IXFR, to primary and reads the
+// responses until the transfer is complete. cur is our SOA, nil for an
+// AXFR. A signed q needs the transfer signed to its last message.
+func receiveTransfer(ctx context.Context, primary string, q *dnsMessage, cur *dnsRdataSOA) (*inboundTransfer, error) {
+	reqBytes, err := packQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", primary)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn, secondaryTimeout)
+	if err := writeTCPMessage(conn, reqBytes); err != nil {
+		return nil, err
+	}
+	var rrs []dnsRR
+	for {
+		resBytes, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		res := new(dnsMessage)
+		if err := res.Unpack(resBytes); err != nil {
+			return nil, err
+		}
+		// Only the first response has to repeat the question.
+		if len(rrs) == 0 {
+			if _, err := parseResponse(q, resBytes); err != nil {
+				return nil, err
+			}
+		} else if res.Id != q.Id || !res.QR {
+			return nil, newError("response does not match the query ID")
+		} else if q.tsig != nil {
+			if err := q.tsig.verifyResponse(resBytes, res); err != nil {
+				return nil, err
+			}
+		}
+		if res.Rcode != rcodeSuccess {
+			return nil, newError(fmt.Sprintf("transfer of %s failed with rcode %d", q.Question[0].Qname, res.Rcode))
+		}
+		rrs = append(rrs, res.Answer...)
+		in, done, err := parseTransfer(rrs, cur)
+		if err == nil && done && q.tsig != nil && q.tsig.pending != nil {
+			err = newError("transfer of " + q.Question[0].Qname.String() + " ends unsigned")
+		}
+		if err != nil || done {
+			return in, err
+		}
+	}
+}
+
+// parseTransfer makes sense of the records received so far (RFC 1995
+// section 4, RFC 5936 section 2.2) and reports whether they are complete.
+func parseTransfer(rrs []dnsRR, cur *dnsRdataSOA) (*inboundTransfer, bool, error) {
+	if len(rrs) == 0 {
+		return nil, false, newError("empty transfer")
+	}
+	if rrs[0].Type != dnsTypeSOA {
+		return nil, false, newError("transfer does not start with an SOA")
+	}
+	serial, ok := soaSerial(rrs[0])
+	if !ok {
+		return nil, false, newError("bad SOA in transfer")
+	}
+	isFinal := func(rr dnsRR) bool {
+		if rr.Type != dnsTypeSOA {
+			return false
+		}
+		s, _ := soaSerial(rr)
+		return s == serial
+	}
+	if len(rrs) == 1 {
+		// A lone SOA not newer than ours answers an IXFR.
+		return &inboundTransfer{}, cur != nil && !serialBefore(cur.Serial, serial), nil
+	}
+	if cur == nil || rrs[1].Type != dnsTypeSOA {
+		if !isFinal(rrs[len(rrs)-1]) {
+			return nil, false, nil
+		}
+		return &inboundTransfer{full: rrs[:len(rrs)-1]}, true, nil
+	}
+
+	in := new(inboundTransfer)
+	for i := 1; i < len(rrs); {
+		if isFinal(rrs[i]) {
+			if i != len(rrs)-1 {
+				return nil, false, newError("records after the end of the IXFR")
+			}
+			return in, true, nil
+		}
+		d := &zoneDiff{from: rrs[i]}
+		for i++; i < len(rrs) && rrs[i].Type != dnsTypeSOA; i++ {
+			d.deleted = append(d.deleted, rrs[i])
+		}
+		if i == len(rrs) {
+			break
+		}
+		d.to = rrs[i]
+		for i++; i < len(rrs) && rrs[i].Type != dnsTypeSOA; i++ {
+			d.added = append(d.added, rrs[i])
+		}
+		in.diffs = append(in.diffs, d)
+	}
+	return nil, false, nil
+}
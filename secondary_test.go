@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecondary(t *testing.T) {
+	origin := mustParseName("example.")
+	rrs, err := parseZone(strings.NewReader(testAuthZone), "test", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := newZone(origin, rrs)
+	primary.transfer, _ = parseACL([]string{"127.0.0.0/8"})
+	primarySrv := &authServer{zones: newZoneSet()}
+	primarySrv.zones.add(primary)
+	addr := startTestTCP(t, primarySrv)
+
+	file := filepath.Join(t.TempDir(), "example.zone")
+	z, err := newSecondaryZone(origin, file, []string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{time.Now()}
+	z.secondary.now = clock.now
+	srv := &authServer{zones: newZoneSet()}
+	srv.zones.add(z)
+	lookup := func(name string) *dnsMessage {
+		return srv.serve(testQuery(name, dnsTypeA), testClient)
+	}
+	if res := lookup("www.example."); res.Rcode != rcodeServerFailure {
+		t.Errorf("before the first transfer: rcode %d", res.Rcode)
+	}
+
+	if wait := z.refresh(); wait != 7200*time.Second {
+		t.Errorf("next refresh in %v", wait)
+	}
+	if res := lookup("www.example."); res.Rcode != rcodeSuccess || len(res.Answer) != 1 || !res.AA {
+		t.Fatalf("after AXFR: rcode %d, %d answers", res.Rcode, len(res.Answer))
+	}
+
+	// A change the primary's journal holds comes by IXFR, one it lost
+	// by the whole zone.
+	bumpSerial(t, primary, nil, testA("new.example.", 3600, 1))
+	z.refresh()
+	if res := lookup("new.example."); len(res.Answer) != 1 {
+		t.Errorf("after IXFR: %d answers", len(res.Answer))
+	}
+	if err := primary.update(func(x *zoneTxn) error {
+		x.deleteRR(testA("new.example.", 3600, 1))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bumpSerial(t, primary, nil, testA("newer.example.", 3600, 2))
+	z.refresh()
+	if res := lookup("new.example."); res.Rcode != rcodeNameError {
+		t.Errorf("after AXFR fallback: rcode %d for a deleted name", res.Rcode)
+	}
+	if res := lookup("newer.example."); len(res.Answer) != 1 {
+		t.Errorf("after AXFR fallback: %d answers", len(res.Answer))
+	}
+	if _, soa, _ := z.soa(); soa.Serial != 3 {
+		t.Errorf("serial %d after refresh, want 3", soa.Serial)
+	}
+
+	// The saved copy is served at once after a restart.
+	again, err := newSecondaryZone(origin, file, []string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.serving() {
+		t.Fatal("saved copy not served after restart")
+	}
+	if _, soa, _ := again.soa(); soa.Serial != 3 {
+		t.Errorf("serial %d after restart", soa.Serial)
+	}
+
+	// Without a primary the copy lives until the expire time.
+	z.secondary.primaries = []string{"127.0.0.1:1"}
+	if wait := z.refresh(); wait != 3600*time.Second {
+		t.Errorf("retry in %v", wait)
+	}
+	clock.t = clock.t.Add(1209599 * time.Second)
+	if !z.serving() {
+		t.Error("expired early")
+	}
+	clock.t = clock.t.Add(time.Second)
+	if res := lookup("www.example."); res.Rcode != rcodeServerFailure {
+		t.Errorf("after expiry: rcode %d", res.Rcode)
+	}
+}
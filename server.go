@@ -1,62 +1,141 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"time"
 )
 
-func authoritativeMain(udpFd int, tcpFd int, udp int, tcp int) error {
+const (
+	maxTCPSize     = 65535
+	tcpIdleTimeout = 10 * time.Second // RFC 7766 section 6.2.3
+)
+
+func authoritativeMain(cfg *config, udpFd int, tcpFd int, udp int, tcp int) error {
 	log.SetFlags(log.Flags() | log.Lshortfile)
 
 	if udpFd < 0 && udp < 0 {
 		return newError("Select UDP as udp or udpfd")
 	}
-	if tcpFd < 0 && tcp < 0 {
-		// TODO
-		//return newError("Select TCP as tcp or tcpfd")
+
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		return err
+	}
+	zones, err := cfg.loadZones(keys)
+	if err != nil {
+		return err
+	}
+	rrl, err := cfg.rateLimiter()
+	if err != nil {
+		return err
 	}
+	srv := &authServer{zones: zones, keys: keys, rrl: rrl}
+	go zones.keepSigned()
+	go zones.keepJournalsCompact()
+	zones.keepSecondariesFresh()
 
-	log.Printf("authoritative started pid:%d udpFd:%d tcpFd:%d", os.Getpid(), udpFd, tcpFd)
+	log.Printf("authoritative started pid:%d udpFd:%d tcpFd:%d zones:%d", os.Getpid(), udpFd, tcpFd, len(zones.zones))
 
-	var udpConn *net.UDPConn
+	return listenAndServe(udpFd, tcpFd, udp, tcp, srv)
+}
+
+// listenAndServe serves h over UDP and, when a TCP socket is given, over
+// TCP as well. It returns when the UDP socket is closed.
+func listenAndServe(udpFd, tcpFd, udp, tcp int, h dnsHandler) error {
+	udpConn, err := listenUDP(udpFd, udp)
+	if err != nil {
+		return err
+	}
+	if tcpFd >= 0 || tcp >= 0 {
+		ln, err := listenTCP(tcpFd, tcp)
+		if err != nil {
+			return err
+		}
+		go serveTCP(ln, h)
+	}
+	serveUDP(udpConn, h)
+	return newError("UDP socket closed")
+}
+
+// listenUDP takes over the socket passed by circus as udpFd, or opens
+// one on port udp.
+func listenUDP(udpFd int, udp int) (*net.UDPConn, error) {
 	if udpFd >= 0 {
 		conn, err := net.FileConn(os.NewFile(uintptr(udpFd), ""))
 		if err != nil {
-			return wrapError(err)
+			return nil, wrapError(err)
 		}
-		udpConn = conn.(*net.UDPConn)
-	} else {
-		addr := fmt.Sprintf("0.0.0.0:%d", udp)
-		addr = "0.0.0.0:10053"
-		laddr, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			return wrapError(err)
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			return nil, newError("udpfd is not a UDP socket")
 		}
-		udpConn, err = net.ListenUDP("udp", laddr)
+		return udpConn, nil
+	}
+	addr := fmt.Sprintf("0.0.0.0:%d", udp)
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return udpConn, nil
+}
+
+// listenTCP is listenUDP for the TCP socket.
+func listenTCP(tcpFd int, tcp int) (*net.TCPListener, error) {
+	if tcpFd >= 0 {
+		ln, err := net.FileListener(os.NewFile(uintptr(tcpFd), ""))
 		if err != nil {
-			return wrapError(err)
+			return nil, wrapError(err)
+		}
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, newError("tcpfd is not a TCP socket")
 		}
+		return tcpLn, nil
+	}
+	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("0.0.0.0:%d", tcp))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, wrapError(err)
 	}
+	return ln, nil
+}
+
+// Requests can be as large as a UDP datagram: EDNS options, TSIG and
+// UPDATE all go past 512 bytes.
+const maxUDPRequest = 65535
 
+// serveUDP reads queries forever, handling each in its own goroutine.
+func serveUDP(udpConn *net.UDPConn, h dnsHandler) {
+	buf := make([]byte, maxUDPRequest)
 	for {
-		reqBytes := make([]byte, 512)
-		n, remoteAddr, err := udpConn.ReadFrom(reqBytes)
+		n, remoteAddr, err := udpConn.ReadFrom(buf)
 
 		// NOTE: ここはエラーが出ても継続する
 		// TODO: シグナル対応する
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Print(err)
 			continue
 		} else if n == 0 {
 			log.Print("Received an empty request.")
 			continue
 		}
-		go authoritativeHandleUDP(udpConn, &remoteAddr, reqBytes)
+		reqBytes := make([]byte, n)
+		copy(reqBytes, buf[:n])
+		go handleUDP(h, udpConn, &remoteAddr, reqBytes)
 	}
-
-	return newError("must not come here")
 }
 
 type Walker interface {
@@ -72,6 +151,12 @@ func packWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 		default:
 			log.Print("unknown packing type")
 			return false
+		case *uint8:
+			if off+1 > len(msg) {
+				return false
+			}
+			msg[off] = *fv
+			off++
 		case *uint16:
 			i := *fv
 			if off+2 > len(msg) {
@@ -92,15 +177,44 @@ func packWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 			off += 4
 		case *[]byte:
 			bytes := *fv
+			switch tag {
+			case "ipv4":
+				if len(bytes) != 4 {
+					return false
+				}
+			case "ipv6":
+				if len(bytes) != 16 {
+					return false
+				}
+			case "salt", "base32":
+				// Preceded by a length octet (RFC 5155)
+				if len(bytes) > 255 || off+1 > len(msg) {
+					return false
+				}
+				msg[off] = byte(len(bytes))
+				off++
+			}
+			if off+len(bytes) > len(msg) {
+				return false
+			}
 			off += copy(msg[off:], bytes)
-		case *string:
-			s := *fv
+		case *[]string:
+			// A sequence of character-strings, each with a length octet.
+			for _, s := range *fv {
+				if len(s) > 255 || off+1+len(s) > len(msg) {
+					return false
+				}
+				msg[off] = byte(len(s))
+				off++
+				off += copy(msg[off:], s)
+			}
+		case *dnsName:
 			switch tag {
 			default:
-				log.Print("unknown string tag", tag)
+				log.Print("unknown name tag", tag)
 				return false
 			case "domain":
-				off, ok = packDomainName(s, msg, off)
+				off, ok = packDomainName(*fv, msg, off)
 				if !ok {
 					return false
 				}
@@ -114,42 +228,17 @@ func packWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 	return off, true
 }
 
-// Pack a domain name s into msg[off:].
-// Domain names are a sequence of counted strings
-// split at the dots.  They end with a zero-length string.
-func packDomainName(s string, msg []byte, off int) (off1 int, ok bool) {
-	// Add trailing dot to canonicalize name.
-	if n := len(s); n == 0 || s[n-1] != '.' {
-		s += "."
+// Pack a domain name n into msg[off:].
+// Names are already held as a sequence of counted strings ending with
+// a zero-length one, so this is a plain copy.
+func packDomainName(n dnsName, msg []byte, off int) (off1 int, ok bool) {
+	if len(n) == 0 {
+		n = rootName
 	}
-
-	// Each dot ends a segment of the name.
-	// We trade each dot byte for a length byte.
-	// There is also a trailing zero.
-	// Check that we have all the space we need.
-	tot := len(s) + 1
-	if off+tot > len(msg) {
+	if off+len(n) > len(msg) {
 		return len(msg), false
 	}
-
-	// Emit sequence of counted strings, chopping at dots.
-	begin := 0
-	for i := 0; i < len(s); i++ {
-		if s[i] == '.' {
-			if i-begin >= 1<<6 { // top two bits of length must be clear
-				return len(msg), false
-			}
-			msg[off] = byte(i - begin)
-			off++
-			for j := begin; j < i; j++ {
-				msg[off] = s[j]
-				off++
-			}
-			begin = i + 1
-		}
-	}
-	msg[off] = 0
-	off++
+	off += copy(msg[off:], n)
 	return off, true
 }
 
@@ -161,6 +250,12 @@ func unpackWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 		default:
 			log.Print("unknown packing type")
 			return false
+		case *uint8:
+			if off+1 > len(msg) {
+				return false
+			}
+			*fv = msg[off]
+			off++
 		case *uint16:
 			if off+2 > len(msg) {
 				return false
@@ -176,20 +271,53 @@ func unpackWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 				uint32(msg[off+2])<<8 |
 				uint32(msg[off+3])
 			off += 4
-		case *string:
-			var s string
+		case *[]byte:
+			n := len(msg) - off // the rest of msg by default
+			switch tag {
+			case "ipv4":
+				n = 4
+			case "ipv6":
+				n = 16
+			case "salt", "base32":
+				if off+1 > len(msg) {
+					return false
+				}
+				n = int(msg[off])
+				off++
+			}
+			if off+n > len(msg) {
+				return false
+			}
+			*fv = append([]byte(nil), msg[off:off+n]...)
+			off += n
+		case *[]string:
+			var ss []string
+			for off < len(msg) {
+				n := int(msg[off])
+				if off+1+n > len(msg) {
+					return false
+				}
+				ss = append(ss, string(msg[off+1:off+1+n]))
+				off += 1 + n
+			}
+			if len(ss) == 0 {
+				return false
+			}
+			*fv = ss
+		case *dnsName:
+			var n dnsName
 			switch tag {
 			default:
-				log.Print("unknown string tag", tag)
+				log.Print("unknown name tag", tag)
 				return false
 			case "domain":
-				s, off, ok = unpackDomainName(msg, off)
+				n, off, ok = unpackDomainName(msg, off)
 				if !ok {
 					log.Print("failed unpack domain name", name)
 					return false
 				}
 			}
-			*fv = s
+			*fv = n
 		}
 		return true
 	})
@@ -199,8 +327,8 @@ func unpackWalker(walker Walker, msg []byte, off int) (off1 int, ok bool) {
 	return off, true
 }
 
-func unpackDomainName(msg []byte, off int) (s string, off1 int, ok bool) {
-	s = ""
+func unpackDomainName(msg []byte, off int) (n dnsName, off1 int, ok bool) {
+	var wire []byte
 	lenmsg := len(msg)
 	ptrCount := 0 // pointer follow counter
 
@@ -217,24 +345,29 @@ func unpackDomainName(msg []byte, off int) (s string, off1 int, ok bool) {
 		if off >= lenmsg {
 			return "", lenmsg, false
 		}
+		labelStart := off
 		labelSize := int(msg[off])
 		off++
 
 		if labelSize == 0 {
 			break
 		}
-		if labelSize&0xC0 == 0x00 {
+		switch labelSize & 0xC0 {
+		case 0x00:
 			// Read a label
 			if off+labelSize > len(msg) {
 				log.Print("invalid label")
 				return "", lenmsg, false
 			}
+			if len(wire)+1+labelSize+1 > maxNameLen {
+				log.Print("domain name exceeds 255 octets")
+				return "", lenmsg, false
+			}
 
-			s += string(msg[off:off+labelSize]) + "."
+			wire = append(wire, msg[off-1:off+labelSize]...)
 			off += labelSize
-		} else if labelSize&0xC0 == 0xC0 {
+		case 0xC0:
 			// 上位2bitが1のときは、ポインタが指定されている
-			log.Fatal("used label is pointer")
 
 			// pointer to somewhere else in msg.
 			// remember location after first ptr,
@@ -253,16 +386,24 @@ func unpackDomainName(msg []byte, off int) (s string, off1 int, ok bool) {
 				log.Print("follow too many pointers of domain name label")
 				return "", lenmsg, false
 			}
-			off = (labelSize^0xC0)<<8 | int(leastSignificantByte)
+			// Pointers may only refer to prior data.
+			ptr := (labelSize^0xC0)<<8 | int(leastSignificantByte)
+			if ptr >= labelStart {
+				log.Print("forward pointer of domain name label")
+				return "", lenmsg, false
+			}
+			off = ptr
+		default:
+			// 0x40 and 0x80 are reserved (RFC 6891 retired EDNS0 extended labels).
+			log.Print("unsupported label type")
+			return "", lenmsg, false
 		}
 	}
-	if s == "" {
-		s = "."
-	}
+	n = dnsName(append(wire, 0))
 	if ptrCount == 0 {
-		return s, off, true
+		return n, off, true
 	} else {
-		return s, off1, true
+		return n, off1, true
 	}
 }
 
@@ -272,6 +413,8 @@ type dnsMessage struct {
 	Answer     []dnsRR
 	Authority  []dnsRR
 	Additional []dnsRR
+
+	tsig *tsigState // signs a request, or the responses to one
 }
 
 func (dns *dnsMessage) Unpack(msg []byte) (err error) {
@@ -281,39 +424,46 @@ func (dns *dnsMessage) Unpack(msg []byte) (err error) {
 	// Header
 	headerData := new(dnsHeaderData)
 	if off, ok = unpackWalker(headerData, msg, off); !ok {
-		return newError("insufficient data")
+		return newFormatError("insufficient data for header", 0)
 	}
 	dns.dnsHeader.initWithData(headerData)
 
-	// Records
+	// Records. The counts are untrusted: allocate no more than the rest
+	// of the message can hold, a root name and type and class for a
+	// question, and another TTL and rdlength for a record.
+	const minQuestionLen, minRRLen = 5, 11
+	records := int(headerData.Ancount) + int(headerData.Nscount) + int(headerData.Arcount)
+	if int(headerData.Qdcount)*minQuestionLen+records*minRRLen > len(msg)-off {
+		return newFormatError("more records than the message holds", off)
+	}
 	dns.Question = make([]dnsQuestion, headerData.Qdcount)
 	dns.Answer = make([]dnsRR, headerData.Ancount)
 	dns.Authority = make([]dnsRR, headerData.Nscount)
 	dns.Additional = make([]dnsRR, headerData.Arcount)
 
 	for i := 0; i < len(dns.Question); i++ {
-		off, ok = unpackWalker(&dns.Question[i], msg, off)
-		if err != nil {
-			return
+		begin := off
+		if off, ok = unpackWalker(&dns.Question[i], msg, off); !ok {
+			return newFormatError("bad question", begin)
 		}
 	}
 
 	for i := 0; i < len(dns.Answer); i++ {
-		off, ok = dns.Answer[i].Unpack(msg, off)
-		if err != nil {
-			return
+		begin := off
+		if off, ok = dns.Answer[i].Unpack(msg, off); !ok {
+			return newFormatError("bad answer RR", begin)
 		}
 	}
 	for i := 0; i < len(dns.Authority); i++ {
-		off, ok = dns.Authority[i].Unpack(msg, off)
-		if err != nil {
-			return
+		begin := off
+		if off, ok = dns.Authority[i].Unpack(msg, off); !ok {
+			return newFormatError("bad authority RR", begin)
 		}
 	}
 	for i := 0; i < len(dns.Additional); i++ {
-		off, ok = dns.Additional[i].Unpack(msg, off)
-		if err != nil {
-			return
+		begin := off
+		if off, ok = dns.Additional[i].Unpack(msg, off); !ok {
+			return newFormatError("bad additional RR", begin)
 		}
 	}
 
@@ -323,7 +473,7 @@ func (dns *dnsMessage) Unpack(msg []byte) (err error) {
 // packLen returns the message length when in UNcompressed wire format.
 func (dns *dnsMessage) packlen() int {
 	// Message header is always 12 bytes
-	l := 12
+	l := headerLen
 	for i := 0; i < len(dns.Question); i++ {
 		l += dns.Question[i].len()
 	}
@@ -360,6 +510,12 @@ func (dns *dnsMessage) Pack() (msg []byte, ok bool) {
 	if dns.QR {
 		headerData.Bits |= _QR
 	}
+	if dns.AD {
+		headerData.Bits |= _AD
+	}
+	if dns.CD {
+		headerData.Bits |= _CD
+	}
 	headerData.Qdcount = uint16(len(dns.Question))
 	headerData.Ancount = uint16(len(dns.Answer))
 	headerData.Nscount = uint16(len(dns.Authority))
@@ -402,6 +558,8 @@ type dnsHeader struct {
 	RD     bool // Recursion Desired
 	RA     bool // Recursion Available
 	Z      bool // Reserved for future use. Must be zero.
+	AD     bool // Authentic Data (RFC 4035)
+	CD     bool // Checking Disabled
 	Rcode  int  // Response code
 }
 
@@ -412,6 +570,30 @@ const (
 	_TC = 1 << 9  // truncated
 	_RD = 1 << 8  // recursion desired
 	_RA = 1 << 7  // recursion available
+	_AD = 1 << 5  // authentic data
+	_CD = 1 << 4  // checking disabled
+)
+
+const (
+	// dnsHeader.Opcode
+	opcodeQuery  = 0
+	opcodeNotify = 4 // RFC 1996
+	opcodeUpdate = 5 // RFC 2136
+)
+
+const (
+	// dnsHeader.Rcode
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeServerFailure  = 2
+	rcodeNameError      = 3
+	rcodeNotImplemented = 4
+	rcodeRefused        = 5
+	rcodeYXDomain       = 6 // RFC 2136
+	rcodeYXRRSet        = 7
+	rcodeNXRRSet        = 8
+	rcodeNotAuth        = 9
+	rcodeNotZone        = 10
 )
 
 func (header *dnsHeader) initWithData(headerData *dnsHeaderData) {
@@ -424,9 +606,14 @@ func (header *dnsHeader) initWithData(headerData *dnsHeaderData) {
 	header.TC = (bits & _TC) != 0
 	header.RD = (bits & _RD) != 0
 	header.RA = (bits & _RA) != 0
+	header.AD = (bits & _AD) != 0
+	header.CD = (bits & _CD) != 0
 	header.Rcode = int(bits & 0xF)
 }
 
+// Length of the fixed message header on the wire.
+const headerLen = 12
+
 // Use like Plain Old Data (wire-like definition)
 type dnsHeaderData struct {
 	Id                                 uint16
@@ -465,7 +652,7 @@ func (h *dnsHeaderData) Walk(f func(field interface{}, name, tag string) bool) b
 // }
 
 type dnsQuestion struct {
-	Qname  string
+	Qname  dnsName
 	Qtype  uint16
 	Qclass uint16
 }
@@ -477,7 +664,7 @@ func (q *dnsQuestion) Walk(f func(field interface{}, name, tag string) bool) boo
 }
 
 func (q *dnsQuestion) len() int {
-	return len(q.Qname) + 1 + 2 + 2
+	return q.Qname.wireLen() + 2 + 2
 }
 
 type dnsRR struct {
@@ -494,7 +681,7 @@ func (rr *dnsRR) Walk(f func(field interface{}, name, tag string) bool) bool {
 }
 
 type dnsRRHeader struct {
-	Name     string
+	Name     dnsName
 	Type     uint16
 	Class    uint16
 	Ttl      uint32
@@ -510,7 +697,7 @@ func (rr *dnsRRHeader) Walk(f func(field interface{}, name, tag string) bool) bo
 }
 
 func (h *dnsRRHeader) len() int {
-	return len(h.Name) + 1 + 2 + 2 + 4 + 2
+	return h.Name.wireLen() + 2 + 2 + 4 + 2
 }
 
 func (rr *dnsRR) Unpack(msg []byte, off int) (off1 int, ok bool) {
@@ -524,63 +711,234 @@ func (rr *dnsRR) Unpack(msg []byte, off int) (off1 int, ok bool) {
 		return off, false
 	}
 	rr.Rdata = msg[off : off+length]
+
+	// Names inside rdata may be compressed against the whole message;
+	// store them expanded so the record stands on its own.
+	if hasCompressibleRdata(rr.Type) {
+		rd := newRdata(rr.Type)
+		if end, ok := unpackWalker(rd, msg[:off+length], off); !ok || end != off+length {
+			log.Print("malformed rdata")
+			return off, false
+		}
+		if !rr.setRdata(rd) {
+			return off, false
+		}
+	}
 	off += length
 
 	return off, true
 }
 
-func authoritativeHandleUDP(conn *net.UDPConn, remoteAddr *net.Addr, reqBytes []byte) {
+// hasCompressibleRdata reports whether names in the rdata of type t may
+// be compressed (RFC 3597 section 4).
+func hasCompressibleRdata(t uint16) bool {
+	switch t {
+	case dnsTypeNS, dnsTypeCNAME, dnsTypeSOA, dnsTypePTR, dnsTypeMX:
+		return true
+	}
+	return false
+}
+
+// dnsHandler answers parsed queries; each server mode implements it.
+// client is the address the query came from.
+type dnsHandler interface {
+	serve(req *dnsMessage, client net.IP) *dnsMessage
+}
+
+// dnsTransferer is implemented by handlers that serve zone transfers.
+// These take any number of responses, handed to send in turn, and are
+// only offered over TCP. An error ends the connection.
+type dnsTransferer interface {
+	transfer(req *dnsMessage, client net.IP, send func(*dnsMessage) error) error
+}
+
+func isTransfer(req *dnsMessage) bool {
+	return req.Opcode == opcodeQuery && len(req.Question) == 1 &&
+		(req.Question[0].Qtype == dnsTypeAXFR || req.Question[0].Qtype == dnsTypeIXFR)
+}
+
+// addrIP returns the IP address of a UDP or TCP peer.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func handleUDP(h dnsHandler, conn *net.UDPConn, remoteAddr *net.Addr, reqBytes []byte) {
 	// log.Printf("Received: %d bytes\n", len(reqBytes))
+	metricUDPReceived.Add(1)
 
-	reqMsg := new(dnsMessage)
-	if err := reqMsg.Unpack(reqBytes); err != nil {
-		log.Print(err)
-		conn.Close()
+	// Without a complete header there is no ID to answer to.
+	if len(reqBytes) < headerLen {
+		metricUDPShort.Add(1)
+		return
+	}
+	// Never answer a response; that is how reflection loops start.
+	if reqBytes[2]&(_QR>>8) != 0 {
+		metricUDPNotQuery.Add(1)
 		return
 	}
 
-	// log.Printf("Request Msg: %#v", reqMsg)
-
-	resMsg := serve(reqMsg)
+	var resMsg *dnsMessage
+	limit := maxUDPSize
+	reqMsg := new(dnsMessage)
+	if err := reqMsg.Unpack(reqBytes); err != nil {
+		log.Printf("%v from %v", err, *remoteAddr)
+		metricFormErr.Add(1)
+		resMsg = errorResponse(reqBytes, errorRcode(err))
+	} else if err := checkTSIG(h, reqBytes, reqMsg); err != nil {
+		log.Printf("%v from %v", err, *remoteAddr)
+		resMsg = newResponse(reqMsg)
+		resMsg.Rcode = errorRcode(err)
+	} else {
+		// log.Printf("Request Msg: %#v", reqMsg)
+		resMsg = h.serve(reqMsg, addrIP(*remoteAddr))
+		if reqMsg.opt() != nil {
+			if resMsg.opt() == nil {
+				resMsg.setEDNS(ednsUDPSize, reqMsg.dnssecOK())
+			}
+			limit = min(reqMsg.udpSize(), ednsUDPSize)
+		}
+	}
 
 	// log.Printf("Response Msg: %#v", resMsg)
 
-	resBytes, ok := resMsg.Pack()
+	if !limitResponse(h, addrIP(*remoteAddr), resMsg) {
+		return
+	}
+	if resMsg.tsig != nil {
+		limit -= resMsg.tsig.size()
+	}
+	resBytes, ok := packResponse(resMsg, limit)
 	if !ok {
 		log.Print("failed pack response")
+		metricPackFailures.Add(1)
 		return
 	}
+	if resMsg.tsig != nil {
+		resBytes = resMsg.tsig.sign(resBytes)
+	}
 	_, err := conn.WriteTo(resBytes, *remoteAddr)
 	if err != nil {
 		log.Print(err)
+		metricWriteFailures.Add(1)
 		return
 	}
+	metricUDPResponses.Add(1)
 	// log.Printf("Sent: %d bytes\n", n)
 }
 
-func serve(req *dnsMessage) *dnsMessage {
-	res := *req
+// serveTCP accepts connections forever, serving each in its own
+// goroutine.
+func serveTCP(ln *net.TCPListener, h dnsHandler) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Print(err)
+			continue
+		}
+		go handleTCP(h, conn)
+	}
+}
 
-	// とにかく twitter.com. A 8.8.8.8 というAnswerを返してみる
+// handleTCP answers the queries on conn in turn until the client closes
+// it or stays quiet for tcpIdleTimeout. Zone transfers go to handlers
+// that stream them.
+func handleTCP(h dnsHandler, conn net.Conn) {
+	defer conn.Close()
+	client := addrIP(conn.RemoteAddr())
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		reqBytes, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		metricTCPReceived.Add(1)
+		if len(reqBytes) < headerLen || reqBytes[2]&(_QR>>8) != 0 {
+			return
+		}
 
+		reqMsg := new(dnsMessage)
+		if err := reqMsg.Unpack(reqBytes); err != nil {
+			log.Printf("%v from %v", err, conn.RemoteAddr())
+			metricFormErr.Add(1)
+			if writeTCPResponse(conn, errorResponse(reqBytes, errorRcode(err))) != nil {
+				return
+			}
+			continue
+		}
+		if err := checkTSIG(h, reqBytes, reqMsg); err != nil {
+			log.Printf("%v from %v", err, conn.RemoteAddr())
+			resMsg := newResponse(reqMsg)
+			resMsg.Rcode = errorRcode(err)
+			if writeTCPResponse(conn, resMsg) != nil {
+				return
+			}
+			continue
+		}
+		if t, ok := h.(dnsTransferer); ok && isTransfer(reqMsg) {
+			send := func(res *dnsMessage) error { return writeTCPResponse(conn, res) }
+			if err := t.transfer(reqMsg, client, send); err != nil {
+				log.Print(err)
+				return
+			}
+			continue
+		}
+		resMsg := h.serve(reqMsg, client)
+		if reqMsg.opt() != nil && resMsg.opt() == nil {
+			resMsg.setEDNS(ednsUDPSize, reqMsg.dnssecOK())
+		}
+		if writeTCPResponse(conn, resMsg) != nil {
+			return
+		}
+	}
+}
+
+func writeTCPResponse(conn net.Conn, resMsg *dnsMessage) error {
+	if resMsg == nil {
+		return newError("no response")
+	}
+	limit := maxTCPSize
+	if resMsg.tsig != nil {
+		limit -= resMsg.tsig.size()
+	}
+	resBytes, ok := packResponse(resMsg, limit)
+	if !ok {
+		metricPackFailures.Add(1)
+		return newError("failed pack response")
+	}
+	if resMsg.tsig != nil {
+		resBytes = resMsg.tsig.sign(resBytes)
+	}
+	conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	if err := writeTCPMessage(conn, resBytes); err != nil {
+		metricWriteFailures.Add(1)
+		return err
+	}
+	metricTCPResponses.Add(1)
+	return nil
+}
+
+// errorResponse builds a bare response to a request that could not be
+// parsed. Only the header is trusted: the ID, opcode and RD are echoed
+// back and every section is left empty.
+func errorResponse(reqBytes []byte, rcode int) *dnsMessage {
+	headerData := new(dnsHeaderData)
+	if _, ok := unpackWalker(headerData, reqBytes, 0); !ok {
+		return nil
+	}
+	res := new(dnsMessage)
+	res.dnsHeader.initWithData(headerData)
 	res.QR = true
-	res.Opcode = 0
-	res.AA = true
+	res.AA = false
 	res.TC = false
-	// res.RD =
 	res.RA = false
-	res.Rcode = 0
-
-	answer := new(dnsRR)
-	answer.dnsRRHeader.Name = "twitter.com."
-	answer.dnsRRHeader.Type = 1  // Type: Aレコード
-	answer.dnsRRHeader.Class = 1 // Class: IN
-	answer.dnsRRHeader.Ttl = 60  // 60秒
-
-	answer.Rdata = []byte{0x08, 0x08, 0x08, 0x08}
-	answer.dnsRRHeader.Rdlength = 4
-
-	res.Answer = append(res.Answer, *answer)
-
-	return &res
+	res.Rcode = rcode
+	return res
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedPackets reads the packets in testdata/packets, captured on the
+// wire: the queries of Go's stub resolver and a recursive resolver's
+// answers to them.
+func capturedPackets(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "packets", "*.bin"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("no captured packets: %v", err)
+	}
+	packets := make(map[string][]byte)
+	for _, file := range files {
+		p, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		packets[filepath.Base(file)] = p
+	}
+	return packets
+}
+
+// Packets in the shapes dig and public resolvers send, assembled by hand
+// to seed the fuzzers beside the captured ones. The first four are well
+// formed.
+var seedPackets = [][]byte{
+	// dig example.com A (RD, AD, EDNS0 with a client cookie)
+	{
+		0x8f, 0x3a, 0x01, 0x20, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+		0x00, 0x0a, 0x00, 0x08, 0x5a, 0x1d, 0x6e, 0x0b, 0x93, 0xc4, 0x27, 0x01,
+	},
+	// Response to the above: one A record, owner compressed to the question
+	{
+		0x8f, 0x3a, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x04,
+		0x5d, 0xb8, 0xd8, 0x22,
+	},
+	// Referral from a root server for www.example.com: NS in authority, glue
+	{
+		0x12, 0x34, 0x80, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01,
+		0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		// com. NS a.gtld-servers.net.
+		0xc0, 0x18, 0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0xa3, 0x00, 0x00, 0x14,
+		0x01, 'a', 0x0c, 'g', 't', 'l', 'd', '-', 's', 'e', 'r', 'v', 'e', 'r', 's',
+		0x03, 'n', 'e', 't', 0x00,
+		// a.gtld-servers.net. A 192.5.6.30
+		0xc0, 0x2d, 0x00, 0x01, 0x00, 0x01, 0x00, 0x02, 0xa3, 0x00, 0x00, 0x04,
+		0xc0, 0x05, 0x06, 0x1e,
+	},
+	// NXDOMAIN with the SOA of the zone in the authority section
+	{
+		0xbe, 0xef, 0x85, 0x83, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00,
+		0x02, 'n', 'x', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		// example.com. SOA ns.example.com. hostmaster.example.com. ...
+		0xc0, 0x0f, 0x00, 0x06, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x26,
+		0x02, 'n', 's', 0xc0, 0x0f,
+		0x0a, 'h', 'o', 's', 't', 'm', 'a', 's', 't', 'e', 'r', 0xc0, 0x0f,
+		0x78, 0x49, 0x3b, 0x01, 0x00, 0x00, 0x1c, 0x20, 0x00, 0x00, 0x0e, 0x10,
+		0x00, 0x12, 0x75, 0x00, 0x00, 0x00, 0x0e, 0x10,
+	},
+	// Pointer loop
+	{
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	},
+	// Truncated header
+	{0x00, 0x01, 0x01},
+}
+
+func FuzzUnpack(f *testing.F) {
+	for _, p := range seedPackets {
+		f.Add(p)
+	}
+	for _, p := range capturedPackets(f) {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := new(dnsMessage)
+		if err := m.Unpack(data); err != nil {
+			return
+		}
+		packed, ok := m.Pack()
+		if !ok {
+			t.Fatalf("unpacked message does not pack: %#v", m)
+		}
+		m2 := new(dnsMessage)
+		if err := m2.Unpack(packed); err != nil {
+			t.Fatalf("repacked message does not unpack: %v", err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("round trip mismatch:\n%#v\n%#v", m, m2)
+		}
+	})
+}
+
+func FuzzUnpackDomainName(f *testing.F) {
+	for _, p := range seedPackets {
+		f.Add(p, headerLen)
+	}
+	for _, p := range capturedPackets(f) {
+		f.Add(p, headerLen)
+	}
+	f.Add([]byte{0x00}, 0)
+	f.Add([]byte{0x01, 'a', 0xc0, 0x00}, 2)
+	f.Fuzz(func(t *testing.T, msg []byte, off int) {
+		if off < 0 || off > len(msg) {
+			return
+		}
+		s, off1, ok := unpackDomainName(msg, off)
+		if !ok {
+			return
+		}
+		if off1 <= off || off1 > len(msg) {
+			t.Fatalf("offset %d out of range after %d", off1, off)
+		}
+		if len(s) > 255 {
+			t.Fatalf("name of %d octets", len(s))
+		}
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	rr := func(name string, typ uint16, rdata ...byte) dnsRR {
+		return dnsRR{dnsRRHeader{mustParseName(name), typ, 1, 3600, uint16(len(rdata))}, rdata}
+	}
+	wireName := []byte{0x02, 'n', 's', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00}
+	soa := append(append(append([]byte{}, wireName...), wireName...),
+		0x78, 0x49, 0x3b, 0x01, 0x00, 0x00, 0x1c, 0x20, 0x00, 0x00, 0x0e, 0x10,
+		0x00, 0x12, 0x75, 0x00, 0x00, 0x00, 0x0e, 0x10)
+
+	records := []dnsRR{
+		rr("example.com.", 1, 192, 0, 2, 1),                                                      // A
+		rr("example.com.", 2, wireName...),                                                       // NS
+		rr("www.example.com.", 5, wireName...),                                                   // CNAME
+		rr("example.com.", 6, soa...),                                                            // SOA
+		rr("1.2.0.192.in-addr.arpa.", 12, wireName...),                                           // PTR
+		rr("example.com.", 15, append([]byte{0x00, 0x0a}, wireName...)...),                       // MX
+		rr("example.com.", 16, 0x05, 'h', 'e', 'l', 'l', 'o'),                                    // TXT
+		rr("example.com.", 28, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1),       // AAAA
+		rr("_sip._udp.example.com.", 33, append([]byte{0, 1, 0, 2, 0x13, 0xc4}, wireName...)...), // SRV
+		rr("example.com.", 99, 0x00),                                                             // unknown type
+		rr(".", 2, wireName...),                                                                  // root owner
+	}
+	// DNSSEC types, whose rdata must also come back in its typed view.
+	apex, bitmap := mustParseName("example.com."), typeBitmap([]uint16{dnsTypeA, dnsTypeRRSIG, dnsTypeNSEC})
+	records = append(records,
+		newRR(apex, dnsTypeDNSKEY, 3600, &dnsRdataDNSKEY{257, 3, algECDSAP256SHA256, []byte{1, 2, 3, 4}}),
+		newRR(apex, dnsTypeRRSIG, 3600, &dnsRdataRRSIG{dnsTypeA, algECDSAP256SHA256, 2, 3600, 1700086400, 1700000000, 12345, apex, []byte{5, 6, 7, 8}}),
+		newRR(apex, dnsTypeDS, 3600, &dnsRdataDS{12345, algECDSAP256SHA256, digestSHA256, make([]byte, 32)}),
+		newRR(apex, dnsTypeNSEC, 3600, &dnsRdataNSEC{mustParseName("www.example.com."), bitmap}),
+		newRR(mustParseName("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.com."), dnsTypeNSEC3, 3600,
+			&dnsRdataNSEC3{nsec3HashSHA1, nsec3OptOut, 1, []byte{0xaa, 0xbb}, make([]byte, 20), bitmap}),
+		newRR(apex, dnsTypeNSEC3PARAM, 0, &dnsRdataNSEC3PARAM{nsec3HashSHA1, 0, 1, []byte{0xaa, 0xbb}}),
+	)
+
+	roundTrip := func(what string, m *dnsMessage) *dnsMessage {
+		t.Helper()
+		packed, ok := m.Pack()
+		if !ok {
+			t.Errorf("%s: pack failed", what)
+			return nil
+		}
+		m2 := new(dnsMessage)
+		if err := m2.Unpack(packed); err != nil {
+			t.Errorf("%s: unpack failed: %v", what, err)
+			return nil
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Errorf("%s: round trip mismatch:\n%#v\n%#v", what, m, m2)
+			return nil
+		}
+		return m2
+	}
+	for _, r := range records {
+		m := &dnsMessage{
+			dnsHeader: dnsHeader{Id: 0xabcd, QR: true, AA: true, RD: true, Rcode: rcodeSuccess},
+			Question:  []dnsQuestion{{r.Name, r.Type, 1}},
+			Answer:    []dnsRR{r},
+			Authority: []dnsRR{r},
+		}
+		m.Additional = []dnsRR{}
+		what := typeString(r.Type)
+		if m2 := roundTrip(what, m); m2 != nil && newRdata(r.Type) != nil {
+			if _, ok := m2.Answer[0].rdata(); !ok {
+				t.Errorf("%s: rdata does not parse", what)
+			}
+		}
+	}
+
+	// OPT and TSIG only go at the end of the additional section.
+	opt := dnsRR{dnsRRHeader{mustParseName("."), dnsTypeOPT, ednsUDPSize, ednsDO, 12},
+		[]byte{0x00, 0x0a, 0x00, 0x08, 0x5a, 0x1d, 0x6e, 0x0b, 0x93, 0xc4, 0x27, 0x01}}
+	tsig := (&tsigRdata{alg: mustParseName("hmac-sha256."), time: 1700000000, fudge: 300, mac: make([]byte, 32), origID: 0xabcd}).pack()
+	m := &dnsMessage{
+		dnsHeader: dnsHeader{Id: 0xabcd, QR: true, Rcode: rcodeSuccess},
+		Question:  []dnsQuestion{{apex, dnsTypeSOA, 1}},
+		Answer:    []dnsRR{},
+		Authority: []dnsRR{},
+		Additional: []dnsRR{opt,
+			{dnsRRHeader{mustParseName("xfr.example.com."), dnsTypeTSIG, dnsClassANY, 0, uint16(len(tsig))}, tsig}},
+	}
+	if m2 := roundTrip("OPT and TSIG", m); m2 != nil {
+		if m2.opt() == nil {
+			t.Error("OPT not found")
+		}
+		if rd, ok := unpackTSIGRdata(m2.Additional[1].Rdata); !ok || rd.time != 1700000000 || rd.origID != 0xabcd {
+			t.Errorf("TSIG rdata %+v", rd)
+		}
+	}
+}
+
+func TestUnpackRejectsMalformed(t *testing.T) {
+	for i, p := range seedPackets[4:] {
+		m := new(dnsMessage)
+		err := m.Unpack(p)
+		if err == nil {
+			t.Errorf("packet %d: unpacked without error", i)
+			continue
+		}
+		if rcode := errorRcode(err); rcode != rcodeFormatError {
+			t.Errorf("packet %d: rcode %d, want FORMERR", i, rcode)
+		}
+	}
+}
+
+func TestUnpackBoundsCounts(t *testing.T) {
+	// A bare header claiming 65535 records in every section.
+	p := []byte{0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	m := new(dnsMessage)
+	err := m.Unpack(p)
+	runtime.ReadMemStats(&after)
+	if errorRcode(err) != rcodeFormatError {
+		t.Errorf("rcode %d, want FORMERR", errorRcode(err))
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("%d bytes allocated for a bare header", n)
+	}
+}
+
+func TestUnpackSeedPackets(t *testing.T) {
+	// The records of each well-formed seed, in order.
+	want := [][]string{
+		{".\t0\tCLASS4096\tOPT\t\\# 12 000a00085a1d6e0b93c42701"},
+		{"example.com.\t3600\tIN\tA\t93.184.216.34"},
+		{"com.\t172800\tIN\tNS\ta.gtld-servers.net.", "a.gtld-servers.net.\t172800\tIN\tA\t192.5.6.30"},
+		{"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2018065153 7200 3600 1209600 3600"},
+	}
+	for i, p := range seedPackets[:4] {
+		m := new(dnsMessage)
+		if err := m.Unpack(p); err != nil {
+			t.Errorf("packet %d: %v", i, err)
+			continue
+		}
+		var got []string
+		for _, rrs := range [][]dnsRR{m.Answer, m.Authority, m.Additional} {
+			for _, rr := range rrs {
+				got = append(got, rr.String())
+			}
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("packet %d:\n%q\nwant\n%q", i, got, want[i])
+		}
+	}
+}
+
+func TestUnpackCapturedPackets(t *testing.T) {
+	for name, p := range capturedPackets(t) {
+		m := new(dnsMessage)
+		if err := m.Unpack(p); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if m.QR == strings.HasPrefix(name, "query-") || len(m.Question) != 1 || m.opt() == nil {
+			t.Errorf("%s: QR %v, %d questions, OPT %v", name, m.QR, len(m.Question), m.opt())
+		}
+		packed, ok := m.Pack()
+		m2 := new(dnsMessage)
+		if !ok || m2.Unpack(packed) != nil || !reflect.DeepEqual(m, m2) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+}
+
+func TestServeLargeUDPRequest(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go serveUDP(conn, testAuthServer(t))
+
+	// 1000 bytes of EDNS padding (RFC 7830) take the query past 512.
+	req := testQuery("www.example.", dnsTypeA)
+	req.setEDNS(ednsUDPSize, false)
+	opt := req.opt()
+	opt.Rdata = append([]byte{0, 12, 0x03, 0xe8}, make([]byte, 1000)...)
+	opt.Rdlength = uint16(len(opt.Rdata))
+	res, err := exchangeUDP(context.Background(), conn.LocalAddr().String(), req, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != rcodeSuccess || len(res.Answer) != 1 {
+		t.Errorf("rcode %d, %d answers", res.Rcode, len(res.Answer))
+	}
+}
@@ -0,0 +1,822 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Online signing of authoritative zones. Keys are PKCS #8 PEM files in
+// the zone's key directory, one per key, with the DNSKEY flags and the
+// key's rollover state in PEM headers; missing keys are generated at
+// load. The DNSKEY set, the NSEC or NSEC3 chain and all signatures are
+// rebuilt whenever the zone's data is published, and again before the
+// signatures expire. With compact denial (RFC 9824) there is no chain:
+// each negative answer gets an NSEC of its own, signed when it is sent.
+
+const (
+	defaultSigValidity = 14 * 24 * time.Hour
+	sigInceptionSkew   = time.Hour // inception is backdated for clock skew
+	resignInterval     = time.Hour // how often expiry is checked
+)
+
+var algorithmNames = map[string]uint8{
+	"RSASHA256":       algRSASHA256,
+	"ECDSAP256SHA256": algECDSAP256SHA256,
+	"ECDSAP384SHA384": algECDSAP384SHA384,
+	"ED25519":         algED25519,
+}
+
+// Derived from the data and the keys, so replaced by every signing.
+var signerTypes = []uint16{dnsTypeRRSIG, dnsTypeNSEC, dnsTypeNSEC3, dnsTypeNSEC3PARAM, dnsTypeDNSKEY, dnsTypeCDS, dnsTypeCDNSKEY}
+
+type signingKey struct {
+	dnskey *dnsRdataDNSKEY
+	tag    uint16
+	priv   crypto.Signer
+	file   string
+	state  string    // see rollover.go
+	since  time.Time // of the last change of state
+}
+
+type zoneSigner struct {
+	origin   dnsName
+	dir      string
+	alg      uint8 // of new keys
+	keys     []*signingKey
+	nsec3    *dnsRdataNSEC3PARAM // nil for NSEC
+	optOut   bool                // unsigned delegations are not in the NSEC3 chain
+	compact  bool                // compact denial of existence
+	validity time.Duration
+	refresh  time.Duration // sign again when less validity than this is left
+	now      func() time.Time
+
+	zskLifetime, kskLifetime time.Duration // zero for no rollovers
+	propagation              time.Duration
+	parentDelay              time.Duration
+}
+
+// newZoneSigner loads the keys of origin from dir, generating a KSK and a
+// ZSK when there are none.
+func newZoneSigner(origin dnsName, cfg *signingConfig, dir string) (*zoneSigner, error) {
+	s := &zoneSigner{
+		origin:      origin,
+		dir:         dir,
+		validity:    defaultSigValidity,
+		now:         time.Now,
+		zskLifetime: time.Duration(cfg.ZSKLifetime) * time.Second,
+		kskLifetime: time.Duration(cfg.KSKLifetime) * time.Second,
+		propagation: defaultPropagation,
+		parentDelay: defaultParentDelay,
+	}
+	if cfg.Propagation != 0 {
+		s.propagation = time.Duration(cfg.Propagation) * time.Second
+	}
+	if cfg.ParentDelay != 0 {
+		s.parentDelay = time.Duration(cfg.ParentDelay) * time.Second
+	}
+	if cfg.Validity != 0 {
+		s.validity = time.Duration(cfg.Validity) * time.Second
+	}
+	s.refresh = s.validity / 4
+	if cfg.Refresh != 0 {
+		s.refresh = time.Duration(cfg.Refresh) * time.Second
+	}
+	if s.refresh >= s.validity {
+		return nil, newError(origin.String() + ": refresh must be shorter than the signature validity")
+	}
+	s.alg = algECDSAP256SHA256
+	if cfg.Algorithm != "" {
+		var ok bool
+		if s.alg, ok = algorithmNames[strings.ToUpper(cfg.Algorithm)]; !ok {
+			return nil, newError(origin.String() + ": unknown algorithm " + cfg.Algorithm)
+		}
+	}
+	if cfg.NSEC3 != nil && cfg.Compact {
+		return nil, newError(origin.String() + ": compact denial needs no NSEC3")
+	}
+	s.compact = cfg.Compact
+	if cfg.NSEC3 != nil {
+		salt, err := hex.DecodeString(cfg.NSEC3.Salt)
+		if err != nil || len(salt) > 255 {
+			return nil, newError(origin.String() + ": bad NSEC3 salt " + cfg.NSEC3.Salt)
+		}
+		if cfg.NSEC3.Iterations > maxNSEC3Iterations {
+			return nil, newError(origin.String() + ": too many NSEC3 iterations")
+		}
+		s.nsec3 = &dnsRdataNSEC3PARAM{HashAlg: nsec3HashSHA1, Iterations: cfg.NSEC3.Iterations, Salt: salt}
+		s.optOut = cfg.NSEC3.OptOut
+	}
+
+	keys, err := loadSigningKeys(dir, origin, s.now())
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	if ksks := s.keysIn(dnskeyZone|dnskeySEP, keyActive); cfg.Algorithm == "" && len(ksks) > 0 {
+		s.alg = ksks[0].dnskey.Algorithm
+	}
+	for _, flags := range []uint16{dnskeyZone | dnskeySEP, dnskeyZone} {
+		if len(s.keysWith(flags)) > 0 {
+			continue
+		}
+		k, err := s.generateKey(flags, keyActive)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, k)
+	}
+	return s, nil
+}
+
+// keysWith returns the keys with exactly the given flags.
+func (s *zoneSigner) keysWith(flags uint16) []*signingKey {
+	var keys []*signingKey
+	for _, k := range s.keys {
+		if k.dnskey.Flags == flags {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// keysIn returns the keys with the given flags in one of states.
+func (s *zoneSigner) keysIn(flags uint16, states ...string) []*signingKey {
+	var keys []*signingKey
+	for _, k := range s.keysWith(flags) {
+		for _, state := range states {
+			if k.state == state {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// signingKeys returns the keys that sign the zone's data, the active
+// ZSKs, and those that sign the DNSKEY set, every KSK published. A lone
+// key of either kind signs everything.
+func (s *zoneSigner) signingKeys() (zsks, ksks []*signingKey) {
+	zsks = s.keysIn(dnskeyZone, keyActive)
+	ksks = s.keysIn(dnskeyZone|dnskeySEP, keyPublished, keyActive, keyRetired)
+	if len(zsks) == 0 {
+		zsks = s.keysIn(dnskeyZone|dnskeySEP, keyActive)
+	}
+	if len(ksks) == 0 {
+		ksks = zsks
+	}
+	return zsks, ksks
+}
+
+// sign returns the RRSIGs of rrs by keys, valid from now.
+func (s *zoneSigner) sign(rrs []dnsRR, keys []*signingKey, now time.Time) ([]dnsRR, error) {
+	inception := uint32(now.Add(-sigInceptionSkew).Unix())
+	expiration := uint32(now.Add(s.validity).Unix())
+	var sigs []dnsRR
+	for _, k := range keys {
+		sig, err := signRRset(k, s.origin, rrs, inception, expiration)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+func keyFileName(origin dnsName, alg uint8, tag uint16) string {
+	return fmt.Sprintf("K%s+%03d+%05d.pem", origin, alg, tag)
+}
+
+// loadSigningKeys reads the keys of origin from dir. Keys without a state
+// are taken to have become active at now.
+func loadSigningKeys(dir string, origin dnsName, now time.Time) ([]*signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "K"+origin.String()+"+*.pem"))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	var keys []*signingKey
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, newError(file + ": no private key")
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, newError(file + ": " + err.Error())
+		}
+		flags, err := strconv.ParseUint(block.Headers["Flags"], 10, 16)
+		if err != nil {
+			return nil, newError(file + ": bad Flags header")
+		}
+		k, err := newSigningKey(priv, uint16(flags))
+		if err != nil {
+			return nil, newError(file + ": " + err.Error())
+		}
+		k.file, k.state, k.since = file, keyActive, now
+		if state := block.Headers["State"]; state != "" {
+			if k.since, err = time.Parse(time.RFC3339, block.Headers["Since"]); err != nil {
+				return nil, newError(file + ": bad Since header")
+			}
+			switch state {
+			case keyPublished, keyActive, keyRetired:
+				k.state = state
+			default:
+				return nil, newError(file + ": unknown state " + state)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// generateKey makes a new key of the zone's algorithm and saves it.
+func (s *zoneSigner) generateKey(flags uint16, state string) (*signingKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch s.alg {
+	case algRSASHA256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case algECDSAP256SHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algECDSAP384SHA384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case algED25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	k, err := newSigningKey(priv, flags)
+	if err != nil {
+		return nil, err
+	}
+	k.file = filepath.Join(s.dir, keyFileName(s.origin, s.alg, k.tag))
+	if err := k.setState(state, s.now()); err != nil {
+		return nil, err
+	}
+	log.Printf("generated key %d for %s", k.tag, s.origin)
+	return k, nil
+}
+
+// setState moves k to state and saves it, replacing the file only once
+// the new one is complete.
+func (k *signingKey) setState(state string, now time.Time) error {
+	k.state, k.since = state, now
+	der, err := x509.MarshalPKCS8PrivateKey(k.priv)
+	if err != nil {
+		return wrapError(err)
+	}
+	block := &pem.Block{
+		Type: "PRIVATE KEY",
+		Headers: map[string]string{
+			"Flags": strconv.Itoa(int(k.dnskey.Flags)),
+			"State": state,
+			"Since": now.UTC().Format(time.RFC3339Nano),
+		},
+		Bytes: der,
+	}
+	tmp := k.file + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0o600); err != nil {
+		return wrapError(err)
+	}
+	if err := os.Rename(tmp, k.file); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// newSigningKey derives the DNSKEY of priv (RFC 3110, RFC 6605, RFC 8080).
+func newSigningKey(priv any, flags uint16) (*signingKey, error) {
+	key := &dnsRdataDNSKEY{Flags: flags, Protocol: 3}
+	var signer crypto.Signer
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		e := big32(priv.E)
+		key.Algorithm = algRSASHA256
+		key.PublicKey = append(append([]byte{byte(len(e))}, e...), priv.N.Bytes()...)
+		signer = priv
+	case *ecdsa.PrivateKey:
+		size := 32
+		key.Algorithm = algECDSAP256SHA256
+		if priv.Curve == elliptic.P384() {
+			size = 48
+			key.Algorithm = algECDSAP384SHA384
+		} else if priv.Curve != elliptic.P256() {
+			return nil, newError("unsupported curve")
+		}
+		key.PublicKey = append(priv.X.FillBytes(make([]byte, size)), priv.Y.FillBytes(make([]byte, size))...)
+		signer = priv
+	case ed25519.PrivateKey:
+		key.Algorithm = algED25519
+		key.PublicKey = []byte(priv.Public().(ed25519.PublicKey))
+		signer = priv
+	default:
+		return nil, newError("unsupported key type")
+	}
+	return &signingKey{dnskey: key, tag: keyTag(key), priv: signer}, nil
+}
+
+// big32 is the big-endian form of e without leading zeros.
+func big32(e int) []byte {
+	var b []byte
+	for ; e > 0; e >>= 8 {
+		b = append([]byte{byte(e)}, b...)
+	}
+	return b
+}
+
+// signRRset returns the RRSIG of rrs by key.
+func signRRset(key *signingKey, signer dnsName, rrs []dnsRR, inception, expiration uint32) (dnsRR, error) {
+	owner := rrs[0].Name
+	labels := owner.labelCount()
+	if owner.firstLabel() == "*" {
+		labels--
+	}
+	sig := &dnsRdataRRSIG{
+		TypeCovered: rrs[0].Type,
+		Algorithm:   key.dnskey.Algorithm,
+		Labels:      uint8(labels),
+		OrigTTL:     rrs[0].Ttl,
+		Expiration:  expiration,
+		Inception:   inception,
+		KeyTag:      key.tag,
+		SignerName:  signer,
+	}
+	data, ok := signedData(sig, rrs)
+	if !ok {
+		return dnsRR{}, newError("cannot sign " + owner.String())
+	}
+	var err error
+	switch priv := key.priv.(type) {
+	case *rsa.PrivateKey:
+		h := sha256.Sum256(data)
+		sig.Signature, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, h[:])
+	case *ecdsa.PrivateKey:
+		size := len(key.dnskey.PublicKey) / 2
+		var digest []byte
+		if key.dnskey.Algorithm == algECDSAP384SHA384 {
+			h := sha512.Sum384(data)
+			digest = h[:]
+		} else {
+			h := sha256.Sum256(data)
+			digest = h[:]
+		}
+		r, s, e := ecdsa.Sign(rand.Reader, priv, digest)
+		if err = e; err == nil {
+			sig.Signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(priv, data)
+	}
+	if err != nil {
+		return dnsRR{}, wrapError(err)
+	}
+	return newRR(owner, dnsTypeRRSIG, rrs[0].Ttl, sig), nil
+}
+
+// signTree returns t with a fresh DNSKEY set, denial chain and
+// signatures. With bump the SOA serial is increased first, so that
+// secondaries see the new signatures.
+func (s *zoneSigner) signTree(t *zoneTree, bump bool) (*zoneTree, error) {
+	now := s.now()
+	soas := t.get(s.origin).rrset(dnsTypeSOA)
+	if len(soas) == 0 {
+		return nil, newError(s.origin.String() + " has no SOA")
+	}
+	soa := soas[0]
+	rd, ok := soa.rdata()
+	if !ok {
+		return nil, newError(s.origin.String() + " has a bad SOA")
+	}
+	soaData := *rd.(*dnsRdataSOA)
+	negTTL := min(soa.Ttl, soaData.Minttl) // RFC 9077
+
+	x := t.begin()
+	t.walk(func(n *zoneNode) bool {
+		for _, typ := range signerTypes {
+			x.deleteRRset(n.name, typ)
+		}
+		return true
+	})
+	if bump {
+		soaData.Serial++
+		x.deleteRRset(s.origin, dnsTypeSOA)
+		x.addRR(newRR(s.origin, dnsTypeSOA, soa.Ttl, &soaData))
+	}
+	for _, k := range s.keys {
+		x.addRR(newRR(s.origin, dnsTypeDNSKEY, soa.Ttl, k.dnskey))
+	}
+	// What the parent's DS set should be (RFC 7344).
+	for _, k := range s.keysIn(dnskeyZone|dnskeySEP, keyActive) {
+		x.addRR(newRR(s.origin, dnsTypeCDNSKEY, soa.Ttl, k.dnskey))
+		if ds, ok := newDS(s.origin, k.dnskey, digestSHA256); ok {
+			x.addRR(newRR(s.origin, dnsTypeCDS, soa.Ttl, ds))
+		}
+	}
+	if s.nsec3 != nil {
+		x.addRR(newRR(s.origin, dnsTypeNSEC3PARAM, 0, s.nsec3))
+	}
+	body := x.tree()
+
+	// The names in the chain: everything but glue and other data below
+	// delegations.
+	var names []*zoneNode
+	body.walk(func(n *zoneNode) bool {
+		if findCut(body, s.origin, n.name, dnsTypeDS) == nil {
+			names = append(names, n)
+		}
+		return true
+	})
+	delegation := func(n *zoneNode) bool {
+		return !n.name.equal(s.origin) && n.rrset(dnsTypeNS) != nil
+	}
+	// types lists what is authoritative at n, i.e. only NS and DS at a
+	// delegation.
+	types := func(n *zoneNode) []uint16 {
+		var ts []uint16
+		for typ := range n.rrsets {
+			if !delegation(n) || typ == dnsTypeNS || typ == dnsTypeDS || typ == dnsTypeNSEC {
+				ts = append(ts, typ)
+			}
+		}
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		return ts
+	}
+
+	var chain []dnsRR
+	switch {
+	case s.compact:
+	case s.nsec3 == nil:
+		for i, n := range names {
+			next := names[(i+1)%len(names)].name
+			bitmap := typeBitmap(append(types(n), dnsTypeRRSIG, dnsTypeNSEC))
+			rr := newRR(n.name, dnsTypeNSEC, negTTL, &dnsRdataNSEC{next, bitmap})
+			x.addRR(rr)
+			chain = append(chain, rr)
+		}
+	default:
+		chain = s.nsec3Chain(body, names, delegation, types, negTTL)
+	}
+
+	// Sign the authoritative RRsets with the ZSKs, the DNSKEY set and
+	// what the parent takes from it with the KSKs.
+	zsks, ksks := s.signingKeys()
+	signed := x.tree()
+	for _, n := range names {
+		n = signed.get(n.name)
+		for _, typ := range types(n) {
+			if delegation(n) && typ != dnsTypeDS && typ != dnsTypeNSEC {
+				continue
+			}
+			keys := zsks
+			switch typ {
+			case dnsTypeDNSKEY, dnsTypeCDS, dnsTypeCDNSKEY:
+				keys = ksks
+			}
+			sigs, err := s.sign(n.rrset(typ), keys, now)
+			if err != nil {
+				return nil, err
+			}
+			for _, sig := range sigs {
+				x.addRR(sig)
+			}
+		}
+	}
+	result := x.commit()
+
+	if s.nsec3 != nil {
+		rrs := chain
+		for _, rr := range chain {
+			sigs, err := s.sign([]dnsRR{rr}, zsks, now)
+			if err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, sigs...)
+		}
+		result.nsec3 = newZoneTree(rrs)
+	}
+	return result, nil
+}
+
+// nsec3Chain builds the NSEC3 records of names, adding the empty
+// non-terminals between them and the apex (RFC 5155 section 7.1). With
+// opt-out, delegations without DS are left out, but not the empty
+// non-terminals above them.
+func (s *zoneSigner) nsec3Chain(t *zoneTree, names []*zoneNode, delegation func(*zoneNode) bool, types func(*zoneNode) []uint16, ttl uint32) []dnsRR {
+	type entry struct {
+		hash  []byte
+		types []uint16
+	}
+	var entries []entry
+	seen := make(map[string]bool)
+	add := func(name dnsName, ts []uint16) {
+		h := nsec3Hash(name, s.nsec3.Iterations, s.nsec3.Salt)
+		if !seen[string(h)] {
+			seen[string(h)] = true
+			entries = append(entries, entry{h, ts})
+		}
+	}
+	for _, n := range names {
+		ts := types(n)
+		switch {
+		case !delegation(n) || n.rrset(dnsTypeDS) != nil:
+			add(n.name, append(ts, dnsTypeRRSIG))
+		case !s.optOut:
+			add(n.name, ts)
+		}
+		for p := n.name; p.labelCount() > s.origin.labelCount()+1; {
+			p = p.parent()
+			if t.get(p) == nil {
+				add(p, nil)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return string(entries[i].hash) < string(entries[j].hash) })
+
+	var flags uint8
+	if s.optOut {
+		flags = nsec3OptOut
+	}
+	rrs := make([]dnsRR, 0, len(entries))
+	for i, e := range entries {
+		rrs = append(rrs, newRR(hashedOwner(s.origin, e.hash), dnsTypeNSEC3, ttl, &dnsRdataNSEC3{
+			HashAlg:    nsec3HashSHA1,
+			Flags:      flags,
+			Iterations: s.nsec3.Iterations,
+			Salt:       s.nsec3.Salt,
+			NextHashed: entries[(i+1)%len(entries)].hash,
+			TypeBitmap: typeBitmap(e.types),
+		}))
+	}
+	return rrs
+}
+
+func hashedOwner(origin dnsName, hash []byte) dnsName {
+	owner, _ := origin.prepend(strings.ToLower(base32Hex.EncodeToString(hash)))
+	return owner
+}
+
+// resign signs the current data again.
+func (z *zone) resign() error {
+	return z.maintain(true)
+}
+
+// maintain rolls the keys of z as due, then signs it again if forced, if
+// the keys changed or if the signatures are due for renewal.
+func (z *zone) maintain(force bool) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	rolled, err := z.signer.roll(z.snapshot())
+	if err != nil {
+		return err
+	}
+	if !force && !rolled && z.signer.now().Before(z.resignAt) {
+		return nil
+	}
+	t, err := z.signer.signTree(z.snapshot(), !z.resignAt.IsZero())
+	if err != nil {
+		return err
+	}
+	if err := z.publish(t); err != nil {
+		return err
+	}
+	z.resignAt = z.signer.now().Add(z.signer.validity - z.signer.refresh)
+	return nil
+}
+
+// keepSigned rolls the keys of the signed zones in zs and signs them
+// again before their signatures expire. It does not return.
+func (zs *zoneSet) keepSigned() {
+	for range time.Tick(resignInterval) {
+		for _, z := range zs.zones {
+			if z.signer == nil {
+				continue
+			}
+			if err := z.maintain(false); err != nil {
+				log.Printf("signing %s: %v", z.origin, err)
+			}
+		}
+	}
+}
+
+// prover adds the RRSIGs and denial records of a signed zone to a
+// response. Its methods do nothing on a nil prover, i.e. for clients
+// without DO and for unsigned zones.
+type prover struct {
+	t      *zoneTree
+	origin dnsName
+	signer *zoneSigner
+	res    *dnsMessage
+	co     bool // the client takes NXDOMAIN with compact denial
+}
+
+// sigs adds the RRSIGs over the typ RRset at node to the answer. With
+// compact denial, data expanded from a wildcard is signed as owner's own,
+// so there is nothing to prove about owner.
+func (p *prover) sigs(node *zoneNode, typ uint16, owner dnsName) {
+	switch {
+	case p == nil:
+	case p.signer.compact && !node.name.equal(owner):
+		p.res.Answer = append(p.res.Answer, p.live(withOwner(node.rrset(typ), owner))...)
+	default:
+		p.res.Answer = append(p.res.Answer, withOwner(sigsFor(node.rrset(dnsTypeRRSIG), node.name, typ), owner)...)
+	}
+}
+
+// live signs rrs for this response alone.
+func (p *prover) live(rrs []dnsRR) []dnsRR {
+	zsks, _ := p.signer.signingKeys()
+	sigs, err := p.signer.sign(rrs, zsks, p.signer.now())
+	if err != nil {
+		log.Print(err)
+	}
+	return sigs
+}
+
+// soa adds the RRSIGs over the SOA of a negative answer.
+func (p *prover) soa() {
+	if p == nil {
+		return
+	}
+	apex := p.t.get(p.origin)
+	p.res.Authority = append(p.res.Authority, sigsFor(apex.rrset(dnsTypeRRSIG), p.origin, dnsTypeSOA)...)
+}
+
+// authority adds the typ RRset at node and its RRSIGs to the authority
+// section, unless they are there already.
+func (p *prover) authority(node *zoneNode, typ uint16) {
+	if node == nil || node.rrset(typ) == nil {
+		return
+	}
+	for _, rr := range p.res.Authority {
+		if rr.Type == typ && rr.Name.equal(node.name) {
+			return
+		}
+	}
+	p.res.Authority = append(p.res.Authority, node.rrset(typ)...)
+	p.res.Authority = append(p.res.Authority, sigsFor(node.rrset(dnsTypeRRSIG), node.name, typ)...)
+}
+
+// covering returns the node whose NSEC covers name, which does not exist.
+func (p *prover) covering(name dnsName) *zoneNode {
+	for n := p.t.predecessor(name); n != nil; n = p.t.predecessor(n.name) {
+		if n.rrset(dnsTypeNSEC) != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p *prover) hashed(name dnsName) dnsName {
+	return hashedOwner(p.origin, nsec3Hash(name, p.signer.nsec3.Iterations, p.signer.nsec3.Salt))
+}
+
+// match3 returns the NSEC3 node matching name.
+func (p *prover) match3(name dnsName) *zoneNode {
+	return p.t.nsec3.get(p.hashed(name))
+}
+
+// cover3 returns the NSEC3 node covering name, which has none itself.
+func (p *prover) cover3(name dnsName) *zoneNode {
+	if n := p.t.nsec3.predecessor(p.hashed(name)); n != nil {
+		return n
+	}
+	return p.t.nsec3.last() // the last NSEC3 wraps around
+}
+
+// optedOut proves that name, a delegation without DS, lies in an opt-out
+// span: its parent, always in the chain, is the closest provable encloser
+// (RFC 5155 section 7.2.7).
+func (p *prover) optedOut(name dnsName) {
+	p.authority(p.match3(name.parent()), dnsTypeNSEC3)
+	p.authority(p.cover3(name), dnsTypeNSEC3)
+}
+
+// compact adds the NSEC of compact denial at name: it shows types and
+// covers no other name (RFC 9824 section 3).
+func (p *prover) compact(name dnsName, types []uint16) {
+	next, ok := name.prepend("\x00")
+	if !ok {
+		return // nothing follows a name of the maximum length
+	}
+	soa := p.t.get(p.origin).rrset(dnsTypeSOA)
+	if len(soa) == 0 {
+		return
+	}
+	ttl := soa[0].Ttl
+	if rd, ok := soa[0].rdata(); ok {
+		ttl = min(ttl, rd.(*dnsRdataSOA).Minttl)
+	}
+	rr := newRR(name, dnsTypeNSEC, ttl, &dnsRdataNSEC{next, typeBitmap(append(types, dnsTypeRRSIG, dnsTypeNSEC))})
+	p.res.Authority = append(p.res.Authority, rr)
+	p.res.Authority = append(p.res.Authority, p.live([]dnsRR{rr})...)
+}
+
+// compactTypes lists the types at node, only NS and DS at a delegation.
+func (p *prover) compactTypes(node *zoneNode) []uint16 {
+	cut := !node.name.equal(p.origin) && node.rrset(dnsTypeNS) != nil
+	var ts []uint16
+	for typ := range node.rrsets {
+		if typ != dnsTypeRRSIG && (!cut || typ == dnsTypeNS || typ == dnsTypeDS) {
+			ts = append(ts, typ)
+		}
+	}
+	return ts
+}
+
+// delegation proves the DS set at a referral, or that there is none.
+func (p *prover) delegation(cut *zoneNode) {
+	switch {
+	case p == nil:
+	case cut.rrset(dnsTypeDS) != nil:
+		p.authority(cut, dnsTypeDS)
+	case p.signer.compact:
+		p.compact(cut.name, p.compactTypes(cut))
+	case p.t.nsec3 == nil:
+		p.authority(cut, dnsTypeNSEC)
+	case p.match3(cut.name) == nil:
+		p.optedOut(cut.name)
+	default:
+		p.authority(p.match3(cut.name), dnsTypeNSEC3)
+	}
+}
+
+// nodata proves that name lacks the type asked for. node is what
+// answered for name: nil for an empty non-terminal, or a wildcard.
+func (p *prover) nodata(name dnsName, node *zoneNode) {
+	switch {
+	case p == nil:
+	case p.signer.compact && node == nil:
+		p.compact(name, nil)
+	case p.signer.compact:
+		p.compact(name, p.compactTypes(node))
+	case p.t.nsec3 == nil && node == nil:
+		p.authority(p.covering(name), dnsTypeNSEC)
+	case p.t.nsec3 == nil:
+		p.authority(node, dnsTypeNSEC)
+	case node != nil && node.name.equal(name) && p.match3(name) == nil:
+		p.optedOut(name) // DS at a delegation left out of the chain
+	case node == nil || node.name.equal(name):
+		p.authority(p.match3(name), dnsTypeNSEC3)
+	default:
+		// The closest encloser and the wildcard below it; expanded has
+		// covered the next closer name.
+		p.authority(p.match3(node.name.parent()), dnsTypeNSEC3)
+		p.authority(p.match3(node.name), dnsTypeNSEC3)
+	}
+}
+
+// nxdomain proves that name does not exist, nor the wildcard wild at its
+// closest encloser ce. Compact denial answers NODATA instead, with the
+// NXNAME type in the bitmap, unless the client takes NXDOMAIN.
+func (p *prover) nxdomain(name, ce, wild dnsName) {
+	switch {
+	case p == nil:
+	case p.signer.compact:
+		if !p.co {
+			p.res.Rcode = rcodeSuccess
+		}
+		p.compact(name, []uint16{dnsTypeNXNAME})
+	case p.t.nsec3 == nil:
+		p.authority(p.covering(name), dnsTypeNSEC)
+		p.authority(p.covering(wild), dnsTypeNSEC)
+	default:
+		p.authority(p.match3(ce), dnsTypeNSEC3)
+		p.authority(p.cover3(name.suffix(ce.labelCount()+1)), dnsTypeNSEC3)
+		p.authority(p.cover3(wild), dnsTypeNSEC3)
+	}
+}
+
+// expanded proves that name, answered from the wildcard at its closest
+// encloser ce, does not exist itself.
+func (p *prover) expanded(name, ce dnsName) {
+	switch {
+	case p == nil:
+	case p.signer.compact:
+		// sigs signs the answer as name's own.
+	case p.t.nsec3 == nil:
+		p.authority(p.covering(name), dnsTypeNSEC)
+	default:
+		p.authority(p.cover3(name.suffix(ce.labelCount()+1)), dnsTypeNSEC3)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigner(t *testing.T, origin string, cfg *signingConfig, dir string) *zoneSigner {
+	t.Helper()
+	s, err := newZoneSigner(mustParseName(origin), cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testSignedZone(t *testing.T, s *zoneSigner, text string) *zone {
+	t.Helper()
+	rrs, err := parseZone(strings.NewReader(text), "test", rootName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := newZone(s.origin, rrs)
+	z.signer = s
+	if err := z.resign(); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+const testSignZone = `$ORIGIN example.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 3600 1209600 300
+@	NS	ns
+ns	A	192.0.2.53
+www	A	192.0.2.1
+x.y.deep	A	192.0.2.4
+*.wild	TXT	"wild"
+sub	NS	ns.sub
+ns.sub	A	192.0.2.54
+`
+
+func TestSignZone(t *testing.T) {
+	dir := t.TempDir()
+	for _, nsec3 := range []*nsec3Config{nil, {Iterations: 1, Salt: "aabb"}} {
+		s := testSigner(t, "example.", &signingConfig{NSEC3: nsec3}, dir)
+		z := testSignedZone(t, s, testSignZone)
+		tree := z.snapshot()
+		keys := tree.get(s.origin).rrset(dnsTypeDNSKEY)
+		if len(keys) != 2 {
+			t.Fatalf("%d DNSKEYs", len(keys))
+		}
+
+		// Every authoritative RRset verifies, nothing else is signed.
+		check := func(n *zoneNode) bool {
+			sigs := n.rrset(dnsTypeRRSIG)
+			for typ, rrs := range n.rrsets {
+				if typ == dnsTypeRRSIG {
+					continue
+				}
+				covered := sigsFor(sigs, n.name, typ)
+				glue := n.name.equal(mustParseName("ns.sub.example.")) ||
+					(n.name.equal(mustParseName("sub.example.")) && typ == dnsTypeNS)
+				if glue != (len(covered) == 0) {
+					t.Errorf("%s %s: %d signatures", n.name, typeString(typ), len(covered))
+				}
+				for _, sigRR := range covered {
+					rd, _ := sigRR.rdata()
+					sig := rd.(*dnsRdataRRSIG)
+					ok := false
+					for _, keyRR := range keys {
+						kd, _ := keyRR.rdata()
+						if verifyRRSIG(sig, kd.(*dnsRdataDNSKEY), rrs) == nil {
+							ok = true
+						}
+					}
+					if !ok {
+						t.Errorf("%s %s: signature does not verify", n.name, typeString(typ))
+					}
+				}
+			}
+			return true
+		}
+		tree.walk(check)
+
+		// The chain is a ring over the authoritative names, with NSEC3
+		// also over the empty non-terminals.
+		want := []string{"example.", "x.y.deep.example.", "ns.example.",
+			"sub.example.", "*.wild.example.", "www.example."}
+		if nsec3 == nil {
+			n := tree.get(s.origin)
+			for i := range want {
+				if !n.name.equal(mustParseName(want[i])) {
+					t.Errorf("NSEC chain at %s, want %s", n.name, want[i])
+					break
+				}
+				rd, _ := n.rrset(dnsTypeNSEC)[0].rdata()
+				n = tree.get(rd.(*dnsRdataNSEC).NextDomain)
+			}
+			if !n.name.equal(s.origin) {
+				t.Errorf("NSEC chain does not wrap to the apex")
+			}
+		} else {
+			tree.nsec3.walk(check)
+			if tree.nsec3.count != len(want)+3 {
+				t.Errorf("%d NSEC3 records, want %d", tree.nsec3.count, len(want)+3)
+			}
+		}
+	}
+
+	// The keys were written and are found again.
+	s := testSigner(t, "example.", &signingConfig{}, dir)
+	if len(s.keys) != 2 {
+		t.Errorf("%d keys after reload", len(s.keys))
+	}
+}
+
+func TestResign(t *testing.T) {
+	s := testSigner(t, "example.", &signingConfig{Validity: 86400}, t.TempDir())
+	clock := &testClock{time.Now()}
+	s.now = clock.now
+	z := testSignedZone(t, s, testSignZone)
+	serial := func() uint32 {
+		_, soa, _ := z.soa()
+		return soa.Serial
+	}
+	clock.t = clock.t.Add(time.Hour)
+	if err := z.maintain(false); err != nil || serial() != 1 {
+		t.Fatalf("fresh signatures renewed: serial %d, %v", serial(), err)
+	}
+	clock.t = clock.t.Add(18 * time.Hour)
+	if err := z.maintain(false); err != nil || serial() != 2 {
+		t.Fatalf("signatures with 5 hours left not renewed: serial %d, %v", serial(), err)
+	}
+	sigs := sigsFor(z.snapshot().get(s.origin).rrset(dnsTypeRRSIG), s.origin, dnsTypeSOA)
+	rd, _ := sigs[0].rdata()
+	if !sigValidAt(rd.(*dnsRdataRRSIG), clock.t.Add(23*time.Hour)) {
+		t.Error("new signature expires too soon")
+	}
+}
+
+// testSignedHierarchy signs the zones of testHierarchy, all but
+// unglued., and returns a resolver trusting the root key.
+func testSignedHierarchy(t *testing.T, wrap func(ip string, h dnsHandler) dnsHandler, nta ...string) *resolver {
+	dir := t.TempDir()
+	signers := map[string]*zoneSigner{
+		".":        testSigner(t, ".", &signingConfig{}, dir),
+		"example.": testSigner(t, "example.", &signingConfig{Algorithm: "ED25519"}, dir),
+		"other.":   testSigner(t, "other.", &signingConfig{NSEC3: &nsec3Config{Salt: "abcd"}}, dir),
+	}
+	zones := make(map[string]string)
+	for ip, text := range testHierarchy {
+		zones[ip] = text
+	}
+	for _, child := range []string{"example.", "other."} {
+		ksk := signers[child].keysWith(dnskeyZone | dnskeySEP)[0]
+		ds, _ := newDS(mustParseName(child), ksk.dnskey, digestSHA256)
+		rr := newRR(mustParseName(child), dnsTypeDS, 3600, ds)
+		zones["127.0.0.1"] += rr.String() + "\n"
+	}
+	zones["127.0.0.2"] += "*.wild\tTXT\t\"wild\"\n"
+	zones["127.0.0.3"] = strings.Replace(zones["127.0.0.3"], "$ORIGIN unglued.", "*.wild\tTXT\t\"wild\"\n$ORIGIN unglued.", 1)
+
+	port := startTestHierarchy(t, zones, func(ip string, h dnsHandler) dnsHandler {
+		for _, z := range h.(*authServer).zones.zones {
+			if s := signers[z.origin.String()]; s != nil {
+				z.signer = s
+				if err := z.resign(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if wrap != nil {
+			h = wrap(ip, h)
+		}
+		return h
+	})
+
+	root := signers["."].keysWith(dnskeyZone | dnskeySEP)[0].dnskey
+	anchor := ". DNSKEY 257 3 " + strconv.Itoa(int(root.Algorithm)) + " " + base64.StdEncoding.EncodeToString(root.PublicKey)
+	r, err := newResolver(&config{
+		RootHints: []string{net.JoinHostPort("127.0.0.1", port)},
+		DNSSEC:    dnssecConfig{TrustAnchors: []string{anchor}, NegativeTrustAnchors: nta},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.port = port
+	r.timeout = 500 * time.Millisecond
+	return r
+}
+
+func TestResolveSigned(t *testing.T) {
+	r := testSignedHierarchy(t, nil)
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ad    bool
+	}{
+		{"www.example.", dnsTypeA, rcodeSuccess, true},
+		{"www.example.", dnsTypeMX, rcodeSuccess, true},
+		{"nx.example.", dnsTypeA, rcodeNameError, true},
+		{"y.deep.example.", dnsTypeA, rcodeSuccess, true},
+		{"a.wild.example.", dnsTypeTXT, rcodeSuccess, true},
+		{"a.wild.example.", dnsTypeA, rcodeSuccess, true},
+		{"alias.example.", dnsTypeA, rcodeSuccess, true},
+		{"www.other.", dnsTypeA, rcodeSuccess, true},
+		{"nx.other.", dnsTypeA, rcodeNameError, true},
+		{"a.b.wild.other.", dnsTypeTXT, rcodeSuccess, true},
+		{"a.wild.other.", dnsTypeA, rcodeSuccess, true},
+		{"host.unglued.", dnsTypeA, rcodeSuccess, false},
+		{"nx.", dnsTypeA, rcodeNameError, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := r.resolve(ctx, mustParseName(tt.name), tt.qtype)
+		cancel()
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.name, typeString(tt.qtype), err)
+			continue
+		}
+		if res.Rcode != tt.rcode || res.AD != tt.ad {
+			t.Errorf("%s %s: rcode %d AD %v", tt.name, typeString(tt.qtype), res.Rcode, res.AD)
+		}
+	}
+
+	// Clients see AD, and the signatures only when they ask for them.
+	srv := &recursiveServer{resolver: r}
+	req := testQuery("www.example.", dnsTypeA)
+	req.RD = true
+	if res := srv.serve(req, testClient); res.AD || len(res.Answer) != 1 {
+		t.Errorf("without DO: AD %v, %d answers", res.AD, len(res.Answer))
+	}
+	req.setEDNS(ednsUDPSize, true)
+	if res := srv.serve(req, testClient); !res.AD || len(res.Answer) != 2 {
+		t.Errorf("with DO: AD %v, %d answers", res.AD, len(res.Answer))
+	}
+}
+
+// corrupter breaks the signatures of the answers it passes on.
+type corrupter struct{ h dnsHandler }
+
+func (c corrupter) serve(req *dnsMessage, client net.IP) *dnsMessage {
+	res := c.h.serve(req, client)
+	for i := range res.Answer {
+		if res.Answer[i].Type == dnsTypeRRSIG {
+			rdata := append([]byte(nil), res.Answer[i].Rdata...)
+			rdata[len(rdata)-1] ^= 1
+			res.Answer[i].Rdata = rdata
+		}
+	}
+	return res
+}
+
+func TestResolveBogus(t *testing.T) {
+	wrap := func(ip string, h dnsHandler) dnsHandler {
+		if ip == "127.0.0.3" {
+			return corrupter{h}
+		}
+		return h
+	}
+	ctx := context.Background()
+	r := testSignedHierarchy(t, wrap)
+	_, err := r.resolve(ctx, mustParseName("www.other."), dnsTypeA)
+	if err == nil || errorRcode(err) != rcodeServerFailure {
+		t.Errorf("bogus answer: %v", err)
+	}
+	if _, err := r.resolve(ctx, mustParseName("www.example."), dnsTypeA); err != nil {
+		t.Errorf("other zones: %v", err)
+	}
+
+	r = testSignedHierarchy(t, wrap, "other.")
+	if res, err := r.resolve(ctx, mustParseName("www.other."), dnsTypeA); err != nil || res.AD {
+		t.Errorf("under a negative trust anchor: %v", err)
+	}
+}
+
+func TestSignedDenial(t *testing.T) {
+	zone := mustParseName("example.")
+	text := testSignZone + "secure\tNS\tns.sub\nsecure\tDS\t12345 13 2 0123456789abcdef\n"
+	modes := []struct {
+		what string
+		cfg  *signingConfig
+	}{
+		{"NSEC", &signingConfig{}},
+		{"NSEC3", &signingConfig{NSEC3: &nsec3Config{Iterations: 1, Salt: "aabb"}}},
+		{"NSEC3 opt-out", &signingConfig{NSEC3: &nsec3Config{OptOut: true}}},
+		{"compact", &signingConfig{Compact: true}},
+	}
+	// Opt-out spans leave NXDOMAIN and wildcard answers insecure, and
+	// the missing DS of sub.
+	tests := []struct {
+		name   string
+		qtype  uint16
+		want   secStatus
+		optOut secStatus
+	}{
+		{"www.example.", dnsTypeA, secSecure, secSecure},
+		{"www.example.", dnsTypeMX, secSecure, secSecure},
+		{"nx.example.", dnsTypeA, secSecure, secInsecure},
+		{"nx.www.example.", dnsTypeA, secSecure, secInsecure},
+		{"deep.example.", dnsTypeA, secSecure, secSecure},
+		{"a.wild.example.", dnsTypeTXT, secSecure, secInsecure},
+		{"a.wild.example.", dnsTypeA, secSecure, secSecure},
+		{"secure.example.", dnsTypeDS, secSecure, secSecure},
+		{"sub.example.", dnsTypeDS, secSecure, secInsecure},
+	}
+	for _, mode := range modes {
+		s := testSigner(t, "example.", mode.cfg, t.TempDir())
+		srv := &authServer{zones: newZoneSet()}
+		srv.zones.add(testSignedZone(t, s, text))
+		r := testZoneValidator(t, zone, s.keysWith(dnskeyZone)[0].dnskey)
+		validate := func(res *dnsMessage, name string, qtype uint16) secStatus {
+			status, err := r.validate(context.Background(), &lookupState{}, res, zone, mustParseName(name), qtype, 0)
+			if status == secBogus {
+				t.Logf("%s %s %s: %v", mode.what, name, typeString(qtype), err)
+			}
+			return status
+		}
+
+		for _, tt := range tests {
+			req := testQuery(tt.name, tt.qtype)
+			req.setEDNS(ednsUDPSize, true)
+			res := srv.serve(req, testClient)
+			want := tt.want
+			if mode.cfg.NSEC3 != nil && mode.cfg.NSEC3.OptOut {
+				want = tt.optOut
+			}
+			if got := validate(res, tt.name, tt.qtype); got != want {
+				t.Errorf("%s %s %s: status %d, want %d", mode.what, tt.name, typeString(tt.qtype), got, want)
+			}
+		}
+
+		// A referral proves what a DS query would.
+		req := testQuery("host.sub.example.", dnsTypeA)
+		req.setEDNS(ednsUDPSize, true)
+		res := srv.serve(req, testClient)
+		var proof []dnsRR
+		for _, rr := range res.Authority {
+			if rr.Type != dnsTypeNS {
+				proof = append(proof, rr)
+			}
+		}
+		want := secSecure
+		if mode.cfg.NSEC3 != nil && mode.cfg.NSEC3.OptOut {
+			want = secInsecure
+		}
+		if got := validate(&dnsMessage{Authority: proof}, "sub.example.", dnsTypeDS); got != want {
+			t.Errorf("%s: referral to sub.example. has status %d, want %d", mode.what, got, want)
+		}
+	}
+}
+
+func TestCompactNXDOMAIN(t *testing.T) {
+	s := testSigner(t, "example.", &signingConfig{Compact: true}, t.TempDir())
+	srv := &authServer{zones: newZoneSet()}
+	srv.zones.add(testSignedZone(t, s, testSignZone))
+
+	req := testQuery("nx.example.", dnsTypeA)
+	if res := srv.serve(req, testClient); res.Rcode != rcodeNameError {
+		t.Errorf("without DO: rcode %d", res.Rcode)
+	}
+	req.setEDNS(ednsUDPSize, true)
+	res := srv.serve(req, testClient)
+	if res.Rcode != rcodeSuccess {
+		t.Errorf("with DO: rcode %d", res.Rcode)
+	}
+	nsecs := nsecRecords(res.Authority)
+	if len(nsecs) != 1 || !bitmapHas(nsecs[0].TypeBitmap, dnsTypeNXNAME) {
+		t.Fatalf("NSEC records %v", nsecs)
+	}
+	req.opt().Ttl |= ednsCO
+	res = srv.serve(req, testClient)
+	if res.Rcode != rcodeNameError || !res.compactOK() {
+		t.Errorf("with CO: rcode %d, CO %v", res.Rcode, res.compactOK())
+	}
+	if s, err := provesDenial(res.Authority, mustParseName("nx.example."), dnsTypeA, true); s != secSecure {
+		t.Errorf("NXDOMAIN with CO: %v", err)
+	}
+}
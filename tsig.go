@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transaction signatures (RFC 8945). A TSIG record ends the additional
+// section and carries an HMAC over the message and a few variables; a
+// response's MAC covers the request's MAC too, and each later message of
+// a transfer covers the MAC before it. Keys are shared secrets known by
+// name.
+
+const (
+	tsigFudge = 300 // seconds of clock difference accepted
+
+	// TSIG error field
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+type tsigKey struct {
+	name   dnsName
+	alg    dnsName
+	hash   func() hash.Hash
+	secret []byte
+}
+
+// tsigKeyring holds the configured keys by name.
+type tsigKeyring map[string]*tsigKey
+
+func (kr tsigKeyring) get(name dnsName) *tsigKey {
+	return kr[name.key()]
+}
+
+// newTSIGKey reads a key from its configuration; the algorithm is
+// HMAC-SHA256 when unset.
+func newTSIGKey(name, alg, secret string) (*tsigKey, error) {
+	n, err := parseName(name)
+	if err != nil {
+		return nil, err
+	}
+	if alg == "" {
+		alg = "hmac-sha256"
+	}
+	h, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(alg), ".")]
+	if !ok {
+		return nil, newError("unknown TSIG algorithm " + alg)
+	}
+	k := &tsigKey{name: n, alg: mustParseName(alg), hash: h}
+	if k.secret, err = base64.StdEncoding.DecodeString(secret); err != nil || len(k.secret) == 0 {
+		return nil, newError("bad secret for TSIG key " + name)
+	}
+	return k, nil
+}
+
+// tsigRdata is the TSIG record's data. Time is 48 bits on the wire.
+type tsigRdata struct {
+	alg    dnsName
+	time   uint64
+	fudge  uint16
+	mac    []byte
+	origID uint16
+	err    uint16
+	other  []byte
+}
+
+func (rd *tsigRdata) pack() []byte {
+	b := []byte(rd.alg.canonical())
+	b = binary.BigEndian.AppendUint16(b, uint16(rd.time>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(rd.time))
+	b = binary.BigEndian.AppendUint16(b, rd.fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rd.mac)))
+	b = append(b, rd.mac...)
+	b = binary.BigEndian.AppendUint16(b, rd.origID)
+	b = binary.BigEndian.AppendUint16(b, rd.err)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rd.other)))
+	return append(b, rd.other...)
+}
+
+func unpackTSIGRdata(b []byte) (*tsigRdata, bool) {
+	alg, off, ok := unpackDomainName(b, 0)
+	if !ok || off+10 > len(b) {
+		return nil, false
+	}
+	rd := &tsigRdata{alg: alg}
+	rd.time = uint64(binary.BigEndian.Uint16(b[off:]))<<32 | uint64(binary.BigEndian.Uint32(b[off+2:]))
+	rd.fudge = binary.BigEndian.Uint16(b[off+6:])
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n+6 > len(b) {
+		return nil, false
+	}
+	rd.mac = b[off : off+n]
+	off += n
+	rd.origID = binary.BigEndian.Uint16(b[off:])
+	rd.err = binary.BigEndian.Uint16(b[off+2:])
+	n = int(binary.BigEndian.Uint16(b[off+4:]))
+	off += 6
+	if off+n != len(b) {
+		return nil, false
+	}
+	rd.other = b[off:]
+	return rd, true
+}
+
+// tsigState follows one signed exchange: a request and its responses,
+// of which a transfer has many.
+type tsigState struct {
+	key       *tsigKey
+	prev      []byte // the last MAC, which the next one covers
+	responses int    // responses signed or verified so far
+	pending   []byte // unsigned responses since the last MAC
+	err       uint16 // the TSIG error a failed request is answered with
+	now       func() time.Time
+}
+
+func newTSIGState(key *tsigKey) *tsigState {
+	return &tsigState{key: key, now: time.Now}
+}
+
+// mac computes the MAC of msg, the wire form without the TSIG record.
+// Requests and first responses cover all the TSIG variables, later
+// messages of a stream only the timers.
+func (st *tsigState) mac(msg []byte, rd *tsigRdata) []byte {
+	h := hmac.New(st.key.hash, st.key.secret)
+	if st.prev != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(st.prev))))
+		h.Write(st.prev)
+	}
+	h.Write(st.pending)
+	h.Write(msg)
+	var v []byte
+	if st.responses == 0 {
+		v = append(v, st.key.name.canonical()...)
+		v = binary.BigEndian.AppendUint16(v, dnsClassANY)
+		v = binary.BigEndian.AppendUint32(v, 0)
+		v = append(v, rd.alg.canonical()...)
+	}
+	v = binary.BigEndian.AppendUint16(v, uint16(rd.time>>32))
+	v = binary.BigEndian.AppendUint32(v, uint32(rd.time))
+	v = binary.BigEndian.AppendUint16(v, rd.fudge)
+	if st.responses == 0 {
+		v = binary.BigEndian.AppendUint16(v, rd.err)
+		v = binary.BigEndian.AppendUint16(v, uint16(len(rd.other)))
+		v = append(v, rd.other...)
+	}
+	h.Write(v)
+	return h.Sum(nil)
+}
+
+// sign appends a TSIG record to msg, a packed message, carrying the
+// state's error. A request starts the exchange afresh; errors other than
+// BADTIME go out without a MAC.
+func (st *tsigState) sign(msg []byte) []byte {
+	tsigErr := st.err
+	if msg[2]&(_QR>>8) == 0 {
+		st.prev, st.pending, st.responses = nil, nil, 0
+	}
+	now := uint64(st.now().Unix())
+	rd := &tsigRdata{alg: st.key.alg, time: now, fudge: tsigFudge,
+		origID: binary.BigEndian.Uint16(msg), err: tsigErr}
+	if tsigErr == tsigBadTime {
+		rd.other = binary.BigEndian.AppendUint16(nil, uint16(now>>32))
+		rd.other = binary.BigEndian.AppendUint32(rd.other, uint32(now))
+	}
+	if tsigErr == 0 || tsigErr == tsigBadTime {
+		rd.mac = st.mac(msg, rd)
+		st.prev, st.pending = rd.mac, nil
+	}
+	if st.prev != nil && msg[2]&(_QR>>8) != 0 {
+		st.responses++
+	}
+	rr := dnsRR{dnsRRHeader: dnsRRHeader{Name: st.key.name, Type: dnsTypeTSIG, Class: dnsClassANY}}
+	rr.Rdata = rd.pack()
+	rr.Rdlength = uint16(len(rr.Rdata))
+	out := make([]byte, len(msg), len(msg)+rr.len())
+	copy(out, msg)
+	out = append(out, st.key.name...)
+	out = binary.BigEndian.AppendUint16(out, rr.Type)
+	out = binary.BigEndian.AppendUint16(out, rr.Class)
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint16(out, rr.Rdlength)
+	out = append(out, rr.Rdata...)
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out
+}
+
+// size is the most sign adds to a message.
+func (st *tsigState) size() int {
+	return len(st.key.name) + 10 + len(st.key.alg) + 16 + sha512.Size + 6
+}
+
+// findTSIG returns the TSIG record of m and where it starts in raw, the
+// message m was parsed from. It fails on a TSIG anywhere but last.
+func findTSIG(raw []byte, m *dnsMessage) (*dnsRR, int, error) {
+	n := len(m.Additional)
+	for i, rr := range m.Additional {
+		if rr.Type == dnsTypeTSIG && i != n-1 {
+			return nil, 0, newFormatError("TSIG is not the last record", headerLen)
+		}
+	}
+	if n == 0 || m.Additional[n-1].Type != dnsTypeTSIG {
+		return nil, 0, nil
+	}
+	// Skip to the start of the last record.
+	off := headerLen
+	var ok bool
+	for range m.Question {
+		if _, off, ok = unpackDomainName(raw, off); !ok {
+			return nil, 0, newFormatError("bad question", off)
+		}
+		off += 4
+	}
+	records := len(m.Answer) + len(m.Authority) + n
+	for i := 0; i < records-1; i++ {
+		if _, off, ok = unpackDomainName(raw, off); !ok || off+10 > len(raw) {
+			return nil, 0, newFormatError("bad record", off)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(raw[off+8:]))
+	}
+	return &m.Additional[n-1], off, nil
+}
+
+// verify checks the TSIG record rr found at off in raw against the
+// state's key. It returns the TSIG error for the response, 0 when the
+// message is authentic.
+func (st *tsigState) verify(raw []byte, rr *dnsRR, off int) (uint16, error) {
+	rd, ok := unpackTSIGRdata(rr.Rdata)
+	if !ok {
+		return 0, newFormatError("bad TSIG record", off)
+	}
+	if !rr.Name.equal(st.key.name) || !rd.alg.equal(st.key.alg) {
+		return tsigBadKey, newRcodeError("unknown TSIG key "+rr.Name.String(), rcodeNotAuth)
+	}
+	// The MAC is over the message as it was before the TSIG was added.
+	msg := make([]byte, off)
+	copy(msg, raw[:off])
+	binary.BigEndian.PutUint16(msg, rd.origID)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	if !hmac.Equal(rd.mac, st.mac(msg, rd)) {
+		return tsigBadSig, newRcodeError("bad TSIG MAC from "+rr.Name.String(), rcodeNotAuth)
+	}
+	if st.prev != nil {
+		st.responses++
+	}
+	st.prev, st.pending = rd.mac, nil
+	if now := uint64(st.now().Unix()); now > rd.time+uint64(rd.fudge) || rd.time > now+uint64(rd.fudge) {
+		return tsigBadTime, newRcodeError("TSIG time out of range for "+rr.Name.String(), rcodeNotAuth)
+	}
+	return 0, nil
+}
+
+// verifyResponse checks one response of a signed exchange. Responses of
+// a stream may come unsigned in between; the next MAC covers them.
+func (st *tsigState) verifyResponse(raw []byte, m *dnsMessage) error {
+	rr, off, err := findTSIG(raw, m)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		if st.responses == 0 {
+			return newError("unsigned response to a signed request")
+		}
+		st.pending = append(st.pending, raw...)
+		return nil
+	}
+	if rd, ok := unpackTSIGRdata(rr.Rdata); ok && rd.err != 0 {
+		return newRcodeError("TSIG error "+tsigErrorName(rd.err)+" from the server", rcodeNotAuth)
+	}
+	if _, err := st.verify(raw, rr, off); err != nil {
+		return err
+	}
+	m.Additional = m.Additional[:len(m.Additional)-1]
+	return nil
+}
+
+// tsigRejected reports whether err is a TSIG error the server answered
+// with, as verifyResponse returns it.
+func tsigRejected(err error) bool {
+	return err != nil && errorRcode(err) == rcodeNotAuth
+}
+
+func tsigErrorName(e uint16) string {
+	switch e {
+	case tsigBadSig:
+		return "BADSIG"
+	case tsigBadKey:
+		return "BADKEY"
+	case tsigBadTime:
+		return "BADTIME"
+	}
+	return strconv.Itoa(int(e))
+}
+
+// dnsKeyHolder is implemented by handlers that accept TSIG keys.
+type dnsKeyHolder interface {
+	tsigKeys() tsigKeyring
+}
+
+// checkTSIG verifies the TSIG of req, raw on the wire, against the keys
+// of h and strips it. The state stays in req.tsig, even on failure, to
+// sign the response with.
+func checkTSIG(h dnsHandler, raw []byte, req *dnsMessage) error {
+	rr, off, err := findTSIG(raw, req)
+	if err != nil || rr == nil {
+		return err
+	}
+	req.Additional = req.Additional[:len(req.Additional)-1]
+	var keys tsigKeyring
+	if kh, ok := h.(dnsKeyHolder); ok {
+		keys = kh.tsigKeys()
+	}
+	key := keys.get(rr.Name)
+	if key == nil {
+		// Answered unsigned, under the name the client used.
+		key = &tsigKey{name: rr.Name}
+		if rd, ok := unpackTSIGRdata(rr.Rdata); ok {
+			key.alg = rd.alg
+		}
+		req.tsig = newTSIGState(key)
+		req.tsig.err = tsigBadKey
+		metricTSIGFailures.Add(1)
+		return newRcodeError("unknown TSIG key "+rr.Name.String(), rcodeNotAuth)
+	}
+	req.tsig = newTSIGState(key)
+	if req.tsig.err, err = req.tsig.verify(raw, rr, off); err != nil {
+		metricTSIGFailures.Add(1)
+		if errorRcode(err) != rcodeNotAuth {
+			req.tsig = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// keyName returns the key a request was signed with, "" for none.
+func (m *dnsMessage) keyName() string {
+	if m.tsig == nil || m.tsig.err != 0 {
+		return ""
+	}
+	return m.tsig.key.name.key()
+}
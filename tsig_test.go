@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTSIGKey(t *testing.T, name, secret string) *tsigKey {
+	t.Helper()
+	k, err := newTSIGKey(name, "", base64.StdEncoding.EncodeToString([]byte(secret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestTSIG(t *testing.T) {
+	var text strings.Builder
+	text.WriteString(testAuthZone)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&text, "t%d\tTXT\t\"%s\"\n", i, strings.Repeat("x", 50))
+	}
+	origin := mustParseName("example.")
+	rrs, err := parseZone(strings.NewReader(text.String()), "test", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testTSIGKey(t, "xfr.example.", "0123456789abcdef0123456789abcdef")
+	primary := newZone(origin, rrs)
+	primary.transfer, _ = parseACL([]string{"key xfr.example."})
+	primary.updaters, _ = parseACL([]string{"key xfr.example."})
+	srv := &authServer{zones: newZoneSet(), keys: tsigKeyring{key.name.key(): key}}
+	srv.zones.add(primary)
+	addr := startTestTCP(t, srv)
+	ctx := context.Background()
+
+	// The key opens what the address alone does not.
+	if msgs := testTransfer(t, addr, testQuery("example.", dnsTypeAXFR)); msgs[0].Rcode != rcodeRefused {
+		t.Errorf("unsigned AXFR: rcode %d", msgs[0].Rcode)
+	}
+	q := newQuery(origin, dnsTypeAXFR, false)
+	q.tsig = newTSIGState(key)
+	in, err := receiveTransfer(ctx, addr, q, nil)
+	if err != nil {
+		t.Fatalf("signed AXFR: %v", err)
+	}
+	if len(in.full) != len(rrs) || q.tsig.responses < 2 {
+		t.Errorf("signed AXFR: %d records in %d signed messages", len(in.full), q.tsig.responses)
+	}
+
+	update := func(k *tsigKey) (*dnsMessage, error) {
+		req := testUpdate(nil, testA("new.example.", 300, 1))
+		if k != nil {
+			req.tsig = newTSIGState(k)
+		}
+		return exchangeTCP(ctx, addr, req, 5*time.Second)
+	}
+	if res, err := update(nil); err != nil || res.Rcode != rcodeRefused {
+		t.Errorf("unsigned UPDATE: %v", err)
+	}
+	if res, err := update(key); err != nil || res.Rcode != rcodeSuccess {
+		t.Errorf("signed UPDATE: %v", err)
+	}
+
+	// Failures are answered with NOTAUTH and the TSIG error.
+	skewed := newTSIGState(key)
+	skewed.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	cases := []struct {
+		st   *tsigState
+		want string
+	}{
+		{newTSIGState(testTSIGKey(t, "xfr.example.", "wrong")), "BADSIG"},
+		{newTSIGState(testTSIGKey(t, "other.example.", "0123456789abcdef")), "BADKEY"},
+		{skewed, "BADTIME"},
+	}
+	for _, c := range cases {
+		before := metricTSIGFailures.Value()
+		req := testQuery("www.example.", dnsTypeA)
+		req.tsig = c.st
+		res, resBytes := rawTCPExchange(t, addr, req)
+		if res.Rcode != rcodeNotAuth || len(res.Answer) != 0 {
+			t.Errorf("%s: rcode %d", c.want, res.Rcode)
+		}
+		if err := c.st.verifyResponse(resBytes, res); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v", c.want, err)
+		}
+		if metricTSIGFailures.Value() != before+1 {
+			t.Errorf("%s not counted", c.want)
+		}
+	}
+
+	// A secondary with the key pulls the zone and takes NOTIFY only
+	// signed with it.
+	z, err := newSecondaryZone(origin, "", []string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.setKey(key)
+	z.refresh()
+	if _, soa, ok := z.soa(); !ok || soa.Serial != 2 {
+		t.Fatal("secondary did not transfer the signed zone")
+	}
+	secondarySrv := &authServer{zones: newZoneSet(), keys: srv.keys}
+	secondarySrv.zones.add(z)
+	secondaryAddr := startTestTCP(t, secondarySrv)
+	notifyCases := []struct {
+		k    *tsigKey
+		want int
+	}{
+		{nil, rcodeRefused},
+		{key, rcodeSuccess},
+		{testTSIGKey(t, "xfr.example.", "wrong"), rcodeNotAuth},
+	}
+	for i, c := range notifyCases {
+		notify := testQuery("example.", dnsTypeSOA)
+		notify.Opcode = opcodeNotify
+		if c.k != nil {
+			notify.tsig = newTSIGState(c.k)
+		}
+		if res, _ := rawTCPExchange(t, secondaryAddr, notify); res.Rcode != c.want {
+			t.Errorf("NOTIFY %d: rcode %d, want %d", i, res.Rcode, c.want)
+		}
+	}
+
+	// Over UDP the sender hears of a TSIG error at once, as it would
+	// of any other answer.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go serveUDP(conn, secondarySrv)
+	notify := testQuery("example.", dnsTypeSOA)
+	notify.Opcode = opcodeNotify
+	notify.tsig = newTSIGState(testTSIGKey(t, "xfr.example.", "wrong"))
+	_, err = exchangeUDP(ctx, conn.LocalAddr().String(), notify, 2*time.Second)
+	if !tsigRejected(err) || !strings.Contains(err.Error(), "BADSIG") {
+		t.Errorf("NOTIFY over UDP with the wrong secret: %v", err)
+	}
+}
+
+// rawTCPExchange sends req, signed if it has a TSIG state, and returns
+// the response without checking its signature.
+func rawTCPExchange(t *testing.T, addr string, req *dnsMessage) (*dnsMessage, []byte) {
+	t.Helper()
+	reqBytes, err := packQuery(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTCPMessage(conn, reqBytes); err != nil {
+		t.Fatal(err)
+	}
+	resBytes, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := new(dnsMessage)
+	if err := res.Unpack(resBytes); err != nil {
+		t.Fatal(err)
+	}
+	return res, resBytes
+}
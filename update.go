@@ -0,0 +1,263 @@
+package main
+
+import (
+	"log"
+	"net"
+	"slices"
+)
+
+// Dynamic updates (RFC 2136). The zone section is the question, the
+// prerequisites are the answer section and the changes the authority
+// section. Prerequisites are checked and changes applied in one zone
+// transaction, so an update applies entirely or not at all. The serial
+// goes up by one unless the update brings an SOA of its own, and the
+// change goes to the zone's journal.
+
+// update applies an UPDATE request from client to a primary zone.
+func (srv *authServer) update(req *dnsMessage, res *dnsMessage, client net.IP) error {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dnsTypeSOA {
+		return newFormatError("UPDATE needs one zone of type SOA", headerLen)
+	}
+	q := req.Question[0]
+	z := srv.zones.get(q.Qname)
+	if z == nil {
+		return newRcodeError(q.Qname.String()+" is not a served zone", rcodeNotAuth)
+	}
+	if z.secondary != nil {
+		return newRefusedError("updates of " + z.origin.String() + " go to its primary")
+	}
+	if !z.updaters.allowsKey(client, req.keyName()) {
+		return newRefusedError("update of " + z.origin.String() + " refused to " + client.String())
+	}
+	if err := checkUpdate(z, req.Authority); err != nil {
+		return err
+	}
+	changed := false
+	err := z.update(func(x *zoneTxn) error {
+		if err := checkPrerequisites(z.origin, x.tree(), req.Answer); err != nil {
+			return err
+		}
+		changed = applyUpdate(z.origin, x, req.Authority)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	metricUpdates.Add(1)
+	if changed {
+		_, soa, _ := z.soa()
+		log.Printf("update of %s from %s: serial %d", z.origin, client, soa.Serial)
+	}
+	return nil
+}
+
+// checkPrerequisites tests the prerequisite section against t (RFC 2136
+// section 3.2).
+func checkPrerequisites(origin dnsName, t *zoneTree, rrs []dnsRR) error {
+	// Records of the zone's class are compared as whole RRsets.
+	type rrsetKey struct {
+		name string
+		typ  uint16
+	}
+	wanted := make(map[rrsetKey][]dnsRR)
+	for _, rr := range rrs {
+		if !rr.Name.isSubdomainOf(origin) {
+			return newRcodeError(rr.Name.String()+" is outside zone "+origin.String(), rcodeNotZone)
+		}
+		if rr.Ttl != 0 {
+			return newFormatError("prerequisite with a TTL", headerLen)
+		}
+		node := t.get(rr.Name)
+		switch rr.Class {
+		case dnsClassANY:
+			if len(rr.Rdata) != 0 {
+				return newFormatError("prerequisite with rdata", headerLen)
+			}
+			if rr.Type == dnsTypeANY && node == nil {
+				return newRcodeError(rr.Name.String()+" is not in use", rcodeNameError)
+			}
+			if rr.Type != dnsTypeANY && node.rrset(rr.Type) == nil {
+				return newRcodeError(rr.Name.String()+" has no "+typeString(rr.Type), rcodeNXRRSet)
+			}
+		case dnsClassNONE:
+			if len(rr.Rdata) != 0 {
+				return newFormatError("prerequisite with rdata", headerLen)
+			}
+			if rr.Type == dnsTypeANY && node != nil {
+				return newRcodeError(rr.Name.String()+" is in use", rcodeYXDomain)
+			}
+			if rr.Type != dnsTypeANY && node.rrset(rr.Type) != nil {
+				return newRcodeError(rr.Name.String()+" has "+typeString(rr.Type), rcodeYXRRSet)
+			}
+		case dnsClassINET:
+			k := rrsetKey{rr.Name.key(), rr.Type}
+			wanted[k] = append(wanted[k], rr)
+		default:
+			return newFormatError("prerequisite of class "+classString(rr.Class), headerLen)
+		}
+	}
+	for _, want := range wanted {
+		have := t.get(want[0].Name).rrset(want[0].Type)
+		if !sameRdata(want, have) {
+			return newRcodeError(want[0].Name.String()+" "+typeString(want[0].Type)+" differs", rcodeNXRRSet)
+		}
+	}
+	return nil
+}
+
+// sameRdata reports whether a and b hold the same set of rdata.
+func sameRdata(a, b []dnsRR) bool {
+	set := make(map[string]bool)
+	for _, rr := range a {
+		set[string(rr.Rdata)] = true
+	}
+	other := make(map[string]bool)
+	for _, rr := range b {
+		if !set[string(rr.Rdata)] {
+			return false
+		}
+		other[string(rr.Rdata)] = true
+	}
+	return len(set) == len(other)
+}
+
+// checkUpdate screens the update section before anything is applied
+// (RFC 2136 section 3.4.1).
+func checkUpdate(z *zone, rrs []dnsRR) error {
+	for _, rr := range rrs {
+		if !rr.Name.isSubdomainOf(z.origin) {
+			return newRcodeError(rr.Name.String()+" is outside zone "+z.origin.String(), rcodeNotZone)
+		}
+		if z.signer != nil && isSignerType(rr.Type) {
+			return newRefusedError(typeString(rr.Type) + " records of " + z.origin.String() + " are kept by the signer")
+		}
+		meta := rr.Type == dnsTypeANY || rr.Type == dnsTypeAXFR || rr.Type == dnsTypeIXFR || rr.Type == dnsTypeOPT
+		switch rr.Class {
+		case dnsClassINET:
+			if meta {
+				return newFormatError("cannot add records of type "+typeString(rr.Type), headerLen)
+			}
+			if newRdata(rr.Type) != nil {
+				if _, ok := rr.rdata(); !ok {
+					return newFormatError("bad "+typeString(rr.Type)+" rdata for "+rr.Name.String(), headerLen)
+				}
+			}
+		case dnsClassANY:
+			if rr.Ttl != 0 || len(rr.Rdata) != 0 || (meta && rr.Type != dnsTypeANY) {
+				return newFormatError("bad RRset deletion for "+rr.Name.String(), headerLen)
+			}
+		case dnsClassNONE:
+			if rr.Ttl != 0 || meta {
+				return newFormatError("bad record deletion for "+rr.Name.String(), headerLen)
+			}
+		default:
+			return newFormatError("update of class "+classString(rr.Class), headerLen)
+		}
+	}
+	return nil
+}
+
+// hasRdata reports whether rrs hold a record with rr's rdata.
+func hasRdata(rrs []dnsRR, rr dnsRR) bool {
+	for _, o := range rrs {
+		if string(o.Rdata) == string(rr.Rdata) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOtherThanCNAME reports whether node holds data a CNAME cannot
+// stand beside.
+func hasOtherThanCNAME(node *zoneNode) bool {
+	if node == nil {
+		return false
+	}
+	for typ := range node.rrsets {
+		if typ != dnsTypeCNAME && !isSignerType(typ) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSignerType(t uint16) bool {
+	return slices.Contains(signerTypes, t)
+}
+
+// applyUpdate carries out the update section (RFC 2136 section 3.4.2)
+// and reports whether anything changed. The SOA and the apex NS set are
+// never deleted, and CNAMEs do not mix with other data.
+func applyUpdate(origin dnsName, x *zoneTxn, rrs []dnsRR) bool {
+	changed, newSOA := false, false
+	for _, rr := range rrs {
+		class := rr.Class
+		rr.Class = dnsClassINET
+		apex := rr.Name.equal(origin)
+		node := x.tree().get(rr.Name)
+		switch {
+		case class == dnsClassANY && rr.Type == dnsTypeANY:
+			// Delete the name, or at the apex all but SOA and NS.
+			if node == nil {
+				continue
+			}
+			var types []uint16
+			for typ := range node.rrsets {
+				if !apex || (typ != dnsTypeSOA && typ != dnsTypeNS) {
+					types = append(types, typ)
+				}
+			}
+			for _, typ := range types {
+				x.deleteRRset(rr.Name, typ)
+				changed = true
+			}
+		case class == dnsClassANY:
+			if node.rrset(rr.Type) != nil && !(apex && (rr.Type == dnsTypeSOA || rr.Type == dnsTypeNS)) {
+				x.deleteRRset(rr.Name, rr.Type)
+				changed = true
+			}
+		case class == dnsClassNONE:
+			if rr.Type == dnsTypeSOA || !hasRdata(node.rrset(rr.Type), rr) {
+				continue
+			}
+			if apex && rr.Type == dnsTypeNS && len(node.rrset(dnsTypeNS)) == 1 {
+				continue
+			}
+			x.deleteRR(rr)
+			changed = true
+		default:
+			switch {
+			case rr.Type == dnsTypeSOA:
+				if !apex {
+					continue
+				}
+				cur, _ := soaSerial(node.rrset(dnsTypeSOA)[0])
+				if serial, _ := soaSerial(rr); !serialBefore(cur, serial) {
+					continue
+				}
+				x.deleteRRset(origin, dnsTypeSOA)
+				newSOA = true
+			case rr.Type == dnsTypeCNAME && hasOtherThanCNAME(node):
+				continue
+			case rr.Type == dnsTypeCNAME:
+				x.deleteRRset(rr.Name, dnsTypeCNAME)
+			case node.rrset(dnsTypeCNAME) != nil:
+				continue
+			}
+			if old := x.tree().get(rr.Name).rrset(rr.Type); hasRdata(old, rr) && old[0].Ttl == rr.Ttl {
+				continue
+			}
+			x.addRR(rr)
+			changed = true
+		}
+	}
+	if changed && !newSOA {
+		soa := x.tree().get(origin).rrset(dnsTypeSOA)[0]
+		rd, _ := soa.rdata()
+		data := *rd.(*dnsRdataSOA)
+		data.Serial++
+		x.deleteRRset(origin, dnsTypeSOA)
+		x.addRR(newRR(origin, dnsTypeSOA, soa.Ttl, &data))
+	}
+	return changed
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testUpdate(prereq []dnsRR, update ...dnsRR) *dnsMessage {
+	req := testQuery("example.", dnsTypeSOA)
+	req.Opcode = opcodeUpdate
+	req.Answer, req.Authority = prereq, update
+	return req
+}
+
+// testEmpty is a record without TTL or rdata, as prerequisites and
+// deletions use them.
+func testEmpty(name string, typ uint16, class uint16) dnsRR {
+	return dnsRR{dnsRRHeader: dnsRRHeader{Name: mustParseName(name), Type: typ, Class: class}}
+}
+
+// testDelete turns rr into the deletion of that one record.
+func testDelete(rr dnsRR) dnsRR {
+	rr.Class, rr.Ttl = dnsClassNONE, 0
+	return rr
+}
+
+func TestUpdate(t *testing.T) {
+	srv := testAuthServer(t)
+	z := srv.zones.get(mustParseName("example."))
+	z.file = filepath.Join(t.TempDir(), "example.zone")
+	if err := z.openJournal(z.file + ".jnl"); err != nil {
+		t.Fatal(err)
+	}
+	z.updaters, _ = parseACL([]string{"192.0.2.0/24"})
+	serial := func() uint32 {
+		_, soa, _ := z.soa()
+		return soa.Serial
+	}
+	lookup := func(name string, qtype uint16) *dnsMessage {
+		return srv.serve(testQuery(name, qtype), testClient)
+	}
+	send := func(req *dnsMessage, rcode int) {
+		t.Helper()
+		if res := srv.serve(req, testClient); res.Rcode != rcode || res.Opcode != opcodeUpdate {
+			t.Errorf("rcode %d, want %d", res.Rcode, rcode)
+		}
+	}
+
+	if res := srv.serve(testUpdate(nil, testA("new.example.", 300, 9)), net.ParseIP("198.51.100.1")); res.Rcode != rcodeRefused {
+		t.Errorf("update from a stranger: rcode %d", res.Rcode)
+	}
+	send(testUpdate(nil, testA("new.example.", 300, 9)), rcodeSuccess)
+	if res := lookup("new.example.", dnsTypeA); len(res.Answer) != 1 || serial() != 2 {
+		t.Errorf("after adding: %d answers, serial %d", len(res.Answer), serial())
+	}
+	// Adding the same again changes nothing, not even the serial.
+	send(testUpdate(nil, testA("new.example.", 300, 9)), rcodeSuccess)
+	if serial() != 2 {
+		t.Errorf("serial %d after an empty change", serial())
+	}
+
+	// Failed prerequisites leave everything as it was.
+	cases := []struct {
+		prereq dnsRR
+		rcode  int
+	}{
+		{testEmpty("absent.example.", dnsTypeANY, dnsClassANY), rcodeNameError},
+		{testEmpty("www.example.", dnsTypeANY, dnsClassNONE), rcodeYXDomain},
+		{testEmpty("www.example.", dnsTypeMX, dnsClassANY), rcodeNXRRSet},
+		{testEmpty("www.example.", dnsTypeA, dnsClassNONE), rcodeYXRRSet},
+		{testA("www.example.", 0, 99), rcodeNXRRSet},
+		{testA("www.other.", 0, 1), rcodeNotZone},
+	}
+	for _, c := range cases {
+		send(testUpdate([]dnsRR{c.prereq}, testA("late.example.", 300, 1)), c.rcode)
+	}
+	if res := lookup("late.example.", dnsTypeA); res.Rcode != rcodeNameError || serial() != 2 {
+		t.Errorf("update applied despite failed prerequisites")
+	}
+	send(testUpdate([]dnsRR{
+		testEmpty("www.example.", dnsTypeANY, dnsClassANY),
+		testEmpty("late.example.", dnsTypeANY, dnsClassNONE),
+		testA("www.example.", 0, 1),
+	}, testA("late.example.", 300, 1)), rcodeSuccess)
+	if res := lookup("late.example.", dnsTypeA); len(res.Answer) != 1 {
+		t.Error("update not applied with its prerequisites met")
+	}
+
+	// Deletions, of a record, an RRset and a name.
+	send(testUpdate(nil,
+		testDelete(testA("new.example.", 300, 9)),
+		testEmpty("late.example.", dnsTypeA, dnsClassANY),
+		testEmpty("a.b.ent.example.", dnsTypeANY, dnsClassANY),
+	), rcodeSuccess)
+	for _, name := range []string{"new.example.", "late.example.", "a.b.ent.example."} {
+		if res := lookup(name, dnsTypeA); res.Rcode != rcodeNameError {
+			t.Errorf("%s still there: rcode %d", name, res.Rcode)
+		}
+	}
+
+	// The apex keeps its SOA and NS, and CNAMEs stay alone.
+	before := serial()
+	send(testUpdate(nil,
+		testEmpty("example.", dnsTypeANY, dnsClassANY),
+		testEmpty("example.", dnsTypeNS, dnsClassANY),
+		testA("alias.example.", 300, 1),
+	), rcodeSuccess)
+	if len(lookup("example.", dnsTypeNS).Answer) != 1 || serial() != before {
+		t.Error("apex SOA or NS deleted")
+	}
+	if res := lookup("alias.example.", dnsTypeA); len(res.Answer) != 2 || res.Answer[0].Type != dnsTypeCNAME {
+		t.Error("A record added beside a CNAME")
+	}
+
+	send(testUpdate(nil, testEmpty("www.example.", dnsTypeAXFR, dnsClassINET)), rcodeFormatError)
+	req := testUpdate(nil, testA("x.example.", 300, 1))
+	req.Question[0].Qname = mustParseName("other.")
+	send(req, rcodeNotAuth)
+
+	// The changes are in the zone file once the journal is compacted.
+	z.compact()
+	data, err := os.ReadFile(z.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := parseZone(strings.NewReader(string(data)), z.file, z.origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := newZoneTree(rrs)
+	if saved.get(mustParseName("late.example.")) != nil || saved.get(mustParseName("www.example.")) == nil {
+		t.Error("zone file does not hold the updated zone")
+	}
+	if s, _ := soaSerial(saved.get(z.origin).rrset(dnsTypeSOA)[0]); s != serial() {
+		t.Errorf("serial %d in the zone file, want %d", s, serial())
+	}
+
+	// An update that cannot be journaled fails and is not served.
+	z.journalFile = filepath.Join(t.TempDir(), "gone", "example.zone.jnl")
+	before = serial()
+	send(testUpdate(nil, testA("lost.example.", 300, 1)), rcodeServerFailure)
+	if len(lookup("lost.example.", dnsTypeA).Answer) != 0 || serial() != before {
+		t.Error("update served without being journaled")
+	}
+}
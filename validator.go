@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSEC validation in the resolver (RFC 4035 section 5, RFC 5155
+// section 8).
+
+type secStatus int
+
+const (
+	secUnchecked secStatus = iota // not validated (yet)
+	secInsecure                   // provably unsigned, or validation is off
+	secSecure
+	secBogus
+)
+
+// worse combines the status of two parts of an answer.
+func (s secStatus) worse(o secStatus) secStatus {
+	switch {
+	case s == secBogus || o == secBogus:
+		return secBogus
+	case s == secInsecure || o == secInsecure:
+		return secInsecure
+	}
+	return s
+}
+
+// The root zone KSKs published by IANA (root-anchors.xml).
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	keyCacheMaxTTL = time.Hour
+	keyCacheBadTTL = time.Minute // for insecure and bogus outcomes
+)
+
+type validator struct {
+	anchors map[string]*trustAnchor // by zone key
+	nta     []dnsName               // negative trust anchors (RFC 7646)
+	now     func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*zoneKeys
+
+	// RFC 5011 state of the anchors, with a state file
+	stateFile string
+	managed   map[string]*anchorState
+	anchorMu  sync.Mutex
+}
+
+// trustAnchor is what is configured for one zone: DS records, or keys
+// trusted directly.
+type trustAnchor struct {
+	zone dnsName
+	ds   []*dnsRdataDS
+	keys []*dnsRdataDNSKEY
+}
+
+// zoneKeys is the outcome of building the chain of trust to a zone.
+type zoneKeys struct {
+	zone    dnsName
+	status  secStatus
+	keys    []*dnsRdataDNSKEY
+	reason  string
+	expires time.Time
+}
+
+// newValidator returns nil when validation is switched off.
+func newValidator(c *config) (*validator, error) {
+	cfg := c.DNSSEC
+	if cfg.Validation == "off" {
+		return nil, nil
+	}
+	v := &validator{
+		anchors: make(map[string]*trustAnchor),
+		now:     time.Now,
+		keys:    make(map[string]*zoneKeys),
+	}
+	anchors := cfg.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+	rrs, err := parseZone(strings.NewReader("$TTL 0\n"+strings.Join(anchors, "\n")), "trust anchors", rootName)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if err := v.addAnchor(rr); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range cfg.NegativeTrustAnchors {
+		name, err := parseZoneName(s, rootName)
+		if err != nil {
+			return nil, err
+		}
+		v.nta = append(v.nta, name)
+	}
+	if cfg.TrustAnchorFile != "" {
+		if err := v.loadAnchors(c.path(cfg.TrustAnchorFile)); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (v *validator) addAnchor(rr dnsRR) error {
+	ta := v.anchors[rr.Name.key()]
+	if ta == nil {
+		ta = &trustAnchor{zone: rr.Name}
+		v.anchors[rr.Name.key()] = ta
+	}
+	rd, ok := rr.rdata()
+	switch {
+	case !ok:
+		return newError("bad trust anchor " + rr.String())
+	case rr.Type == dnsTypeDS:
+		ta.ds = append(ta.ds, rd.(*dnsRdataDS))
+	case rr.Type == dnsTypeDNSKEY:
+		ta.keys = append(ta.keys, rd.(*dnsRdataDNSKEY))
+	default:
+		return newError("trust anchors are DS or DNSKEY records: " + rr.String())
+	}
+	return nil
+}
+
+// hasAnchorAbove reports whether some trust anchor is at or above name;
+// below none of them nothing can be secure.
+func (v *validator) hasAnchorAbove(name dnsName) bool {
+	for n := name; ; n = n.parent() {
+		if v.anchors[n.key()] != nil {
+			return true
+		}
+		if n.isRoot() {
+			return false
+		}
+	}
+}
+
+func (v *validator) negativeAnchor(name dnsName) bool {
+	for _, n := range v.nta {
+		if name.isSubdomainOf(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) cachedKeys(zone dnsName) *zoneKeys {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	zk := v.keys[zone.key()]
+	if zk == nil || !v.now().Before(zk.expires) {
+		return nil
+	}
+	return zk
+}
+
+func (v *validator) storeKeys(zk *zoneKeys) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[zk.zone.key()] = zk
+}
+
+// zoneKeys returns the validated keys of zone, building the chain of
+// trust from the closest anchor as needed.
+func (r *resolver) zoneKeys(ctx context.Context, st *lookupState, zone dnsName, depth int) *zoneKeys {
+	v := r.validator
+	if v.negativeAnchor(zone) || !v.hasAnchorAbove(zone) {
+		return &zoneKeys{zone: zone, status: secInsecure}
+	}
+	if zk := v.cachedKeys(zone); zk != nil {
+		return zk
+	}
+	if st.pending == nil {
+		st.pending = make(map[string]bool)
+	}
+	if st.pending[zone.key()] {
+		return &zoneKeys{zone: zone, status: secBogus, reason: "chain of trust loops at " + zone.String()}
+	}
+	st.pending[zone.key()] = true
+	defer delete(st.pending, zone.key())
+
+	zk := r.buildZoneKeys(ctx, st, zone, depth)
+	if zk.status != secSecure {
+		zk.expires = v.now().Add(keyCacheBadTTL)
+	}
+	if ctx.Err() == nil {
+		v.storeKeys(zk)
+	}
+	return zk
+}
+
+func (r *resolver) buildZoneKeys(ctx context.Context, st *lookupState, zone dnsName, depth int) *zoneKeys {
+	v := r.validator
+	bogus := func(reason string) *zoneKeys {
+		return &zoneKeys{zone: zone, status: secBogus, reason: reason}
+	}
+
+	var dss []*dnsRdataDS
+	var trusted []*dnsRdataDNSKEY
+	if ta := v.anchors[zone.key()]; ta != nil {
+		if as := v.managed[zone.key()]; as != nil {
+			r.refreshAnchor(ctx, st, as)
+		}
+		if dss, trusted = v.anchorKeys(ta); len(dss) == 0 && len(trusted) == 0 {
+			return bogus("every trust anchor of " + zone.String() + " is revoked")
+		}
+	} else {
+		res, err := r.lookup(ctx, st, zone, dnsTypeDS, depth+1)
+		if err != nil {
+			return bogus("no DS for " + zone.String() + ": " + err.Error())
+		}
+		if !res.AD {
+			return &zoneKeys{zone: zone, status: secInsecure}
+		}
+		for _, rr := range res.Answer {
+			if rr.Type != dnsTypeDS || !rr.Name.equal(zone) {
+				continue
+			}
+			if rd, ok := rr.rdata(); ok {
+				dss = append(dss, rd.(*dnsRdataDS))
+			}
+		}
+		if len(dss) == 0 {
+			// Only a real delegation without DS makes the zone
+			// insecure; a signer name that is no zone cut is forged.
+			if provesInsecureDelegation(res.Authority, zone) {
+				return &zoneKeys{zone: zone, status: secInsecure, expires: v.now().Add(keyCacheMaxTTL)}
+			}
+			return bogus(zone.String() + " is not a delegation")
+		}
+	}
+
+	supported := len(trusted) > 0
+	for _, ds := range dss {
+		if algorithmSupported(ds.Algorithm) && (ds.DigestType == digestSHA1 ||
+			ds.DigestType == digestSHA256 || ds.DigestType == digestSHA384) {
+			supported = true
+		}
+	}
+	if !supported {
+		// RFC 4035 section 5.2: no algorithm we know, treat as unsigned.
+		return &zoneKeys{zone: zone, status: secInsecure}
+	}
+
+	res, _, err := r.iterate(ctx, st, zone, dnsTypeDNSKEY, depth+1)
+	if err != nil {
+		return bogus("no DNSKEY for " + zone.String() + ": " + err.Error())
+	}
+	var keyRRs []dnsRR
+	var keys, entry []*dnsRdataDNSKEY
+	for _, rr := range res.Answer {
+		if rr.Type != dnsTypeDNSKEY || !rr.Name.equal(zone) {
+			continue
+		}
+		rd, ok := rr.rdata()
+		if !ok {
+			continue
+		}
+		key := rd.(*dnsRdataDNSKEY)
+		keyRRs = append(keyRRs, rr)
+		if key.Flags&dnskeyZone == 0 || key.Flags&dnskeyRevoke != 0 {
+			continue
+		}
+		keys = append(keys, key)
+		for _, ds := range dss {
+			if dsMatches(ds, zone, key) {
+				entry = append(entry, key)
+				break
+			}
+		}
+		for _, t := range trusted {
+			if t.Algorithm == key.Algorithm && string(t.PublicKey) == string(key.PublicKey) {
+				entry = append(entry, key)
+				break
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return bogus("no DNSKEY of " + zone.String() + " matches its DS")
+	}
+
+	now := v.now()
+	reason := "DNSKEY set of " + zone.String() + " is not signed by a key the DS refers to"
+	for _, sigRR := range sigsFor(res.Answer, zone, dnsTypeDNSKEY) {
+		rd, ok := sigRR.rdata()
+		if !ok {
+			continue
+		}
+		sig := rd.(*dnsRdataRRSIG)
+		if !sig.SignerName.equal(zone) {
+			continue
+		}
+		if !sigValidAt(sig, now) {
+			reason = "DNSKEY signature of " + zone.String() + " expired or not yet valid"
+			continue
+		}
+		for _, key := range entry {
+			if verifyRRSIG(sig, key, keyRRs) != nil {
+				continue
+			}
+			ttl := time.Duration(min(keyRRs[0].Ttl, sig.OrigTTL)) * time.Second
+			expires := now.Add(min(ttl, keyCacheMaxTTL))
+			if exp := time.Unix(int64(sig.Expiration), 0); exp.Before(expires) {
+				expires = exp
+			}
+			return &zoneKeys{zone: zone, status: secSecure, keys: keys, expires: expires}
+		}
+	}
+	return bogus(reason)
+}
+
+// validate checks res, the final answer to qname/qtype from a server for
+// zone. A bogus answer comes with the reason as an error.
+func (r *resolver) validate(ctx context.Context, st *lookupState, res *dnsMessage, zone, qname dnsName, qtype uint16, depth int) (secStatus, error) {
+	if r.validator == nil || r.validator.negativeAnchor(qname) {
+		return secInsecure, nil
+	}
+	status := secSecure
+	for _, rrs := range splitRRsets(res.Answer) {
+		if rrs[0].Type == dnsTypeRRSIG {
+			continue
+		}
+		s, sig, err := r.validateRRset(ctx, st, rrs, sigsFor(res.Answer, rrs[0].Name, rrs[0].Type), zone, depth)
+		if s == secBogus {
+			return s, err
+		}
+		if s == secSecure && int(sig.Labels) < rrs[0].Name.labelCount() {
+			// Expanded from a wildcard: the name itself must not exist.
+			if s, err = r.validateAuthority(ctx, st, res.Authority, zone, depth); s != secSecure {
+				return s, err
+			}
+			if s, err = provesWildcardExpansion(res.Authority, rrs[0].Name, int(sig.Labels)); s == secBogus {
+				return s, err
+			}
+		}
+		status = status.worse(s)
+	}
+
+	// A CNAME leaving the zone is followed elsewhere; there is nothing
+	// for this zone to deny.
+	name, answered := chainEnd(res, qname, qtype)
+	if answered || qtype == dnsTypeANY || !name.isSubdomainOf(zone) {
+		return status, nil
+	}
+	s, err := r.validateAuthority(ctx, st, res.Authority, zone, depth)
+	if status = status.worse(s); status != secSecure {
+		return status, err
+	}
+	return provesDenial(res.Authority, name, qtype, res.Rcode == rcodeNameError)
+}
+
+// validateAuthority checks the SOA, NSEC and NSEC3 records of authority,
+// the proof of a denial or a wildcard expansion.
+func (r *resolver) validateAuthority(ctx context.Context, st *lookupState, authority []dnsRR, zone dnsName, depth int) (secStatus, error) {
+	status := secSecure
+	for _, rrs := range splitRRsets(authority) {
+		switch rrs[0].Type {
+		case dnsTypeSOA, dnsTypeNSEC, dnsTypeNSEC3:
+		default:
+			continue
+		}
+		s, _, err := r.validateRRset(ctx, st, rrs, sigsFor(authority, rrs[0].Name, rrs[0].Type), zone, depth)
+		if s == secBogus {
+			return s, err
+		}
+		status = status.worse(s)
+	}
+	return status, nil
+}
+
+// validateRRset checks rrs against its RRSIGs. The signer must be zone,
+// the zone that answered, or a zone below it that contains the owner.
+func (r *resolver) validateRRset(ctx context.Context, st *lookupState, rrs, sigs []dnsRR, zone dnsName, depth int) (secStatus, *dnsRdataRRSIG, error) {
+	owner := rrs[0].Name
+	what := owner.String() + " " + typeString(rrs[0].Type)
+	if len(sigs) == 0 {
+		zk := r.zoneKeys(ctx, st, zone, depth)
+		switch zk.status {
+		case secSecure:
+			return secBogus, nil, newError("no RRSIG for " + what)
+		case secBogus:
+			return secBogus, nil, newError(zk.reason)
+		}
+		return zk.status, nil, nil
+	}
+
+	var err error = newError("no valid RRSIG for " + what)
+	now := r.validator.now()
+	for _, sigRR := range sigs {
+		rd, ok := sigRR.rdata()
+		if !ok {
+			continue
+		}
+		sig := rd.(*dnsRdataRRSIG)
+		signer := sig.SignerName
+		if !owner.isSubdomainOf(signer) || !signer.isSubdomainOf(zone) ||
+			(rrs[0].Type == dnsTypeDS && signer.equal(owner)) {
+			err = newError("RRSIG over " + what + " by unrelated signer " + signer.String())
+			continue
+		}
+		zk := r.zoneKeys(ctx, st, signer, depth)
+		switch zk.status {
+		case secInsecure:
+			return secInsecure, nil, nil
+		case secBogus:
+			return secBogus, nil, newError(zk.reason)
+		}
+		if !sigValidAt(sig, now) {
+			err = newError("RRSIG over " + what + " expired or not yet valid")
+			continue
+		}
+		for _, key := range zk.keys {
+			if key.Algorithm != sig.Algorithm || keyTag(key) != sig.KeyTag {
+				continue
+			}
+			if e := verifyRRSIG(sig, key, rrs); e != nil {
+				err = e
+				continue
+			}
+			return secSecure, sig, nil
+		}
+	}
+	return secBogus, nil, err
+}
+
+// nsec3Set holds the NSEC3 records of one response, which must share
+// their parameters.
+type nsec3Set struct {
+	zone       dnsName
+	iterations uint16
+	salt       []byte
+	owners     [][]byte
+	records    []*dnsRdataNSEC3
+}
+
+func newNSEC3Set(rrs []dnsRR) (*nsec3Set, bool) {
+	s := new(nsec3Set)
+	for _, rr := range rrs {
+		if rr.Type != dnsTypeNSEC3 {
+			continue
+		}
+		rd, ok := rr.rdata()
+		if !ok {
+			continue
+		}
+		n3 := rd.(*dnsRdataNSEC3)
+		owner, err := base32Hex.DecodeString(strings.ToUpper(rr.Name.firstLabel()))
+		if err != nil {
+			continue
+		}
+		if signer, ok := proofSigner(rrs, rr); !ok || !signer.equal(rr.Name.parent()) {
+			continue
+		}
+		if len(s.records) == 0 {
+			s.zone, s.iterations, s.salt = rr.Name.parent(), n3.Iterations, n3.Salt
+		} else if n3.Iterations != s.iterations || string(n3.Salt) != string(s.salt) || !rr.Name.parent().equal(s.zone) {
+			continue
+		}
+		s.owners = append(s.owners, owner)
+		s.records = append(s.records, n3)
+	}
+	return s, len(s.records) > 0
+}
+
+// match and cover find the NSEC3 at or covering name, which must be in
+// the zone of s.
+func (s *nsec3Set) match(name dnsName) *dnsRdataNSEC3 {
+	if !name.isSubdomainOf(s.zone) {
+		return nil
+	}
+	h := nsec3Hash(name, s.iterations, s.salt)
+	for i, owner := range s.owners {
+		if string(owner) == string(h) {
+			return s.records[i]
+		}
+	}
+	return nil
+}
+
+func (s *nsec3Set) cover(name dnsName) *dnsRdataNSEC3 {
+	if !name.isSubdomainOf(s.zone) {
+		return nil
+	}
+	h := nsec3Hash(name, s.iterations, s.salt)
+	for i, owner := range s.owners {
+		if hashCovers(owner, s.records[i].NextHashed, h) {
+			return s.records[i]
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds the closest encloser proof of RFC 5155 section
+// 8.3: the longest existing ancestor of name and an NSEC3 covering the
+// next closer name.
+func (s *nsec3Set) closestEncloser(name dnsName) (ce dnsName, cover *dnsRdataNSEC3, ok bool) {
+	for i := name.labelCount() - 1; i >= s.zone.labelCount(); i-- {
+		ce = name.suffix(i)
+		n := s.match(ce)
+		if n == nil {
+			continue
+		}
+		if aboveCut(n.TypeBitmap, ce, name, 0) {
+			return "", nil, false
+		}
+		if cover = s.cover(name.suffix(i + 1)); cover == nil {
+			return "", nil, false
+		}
+		return ce, cover, true
+	}
+	return "", nil, false
+}
+
+// nsecRecord is an NSEC with its owner and the zone that signed it,
+// which is all it can speak for.
+type nsecRecord struct {
+	owner  dnsName
+	signer dnsName
+	*dnsRdataNSEC
+}
+
+func nsecRecords(rrs []dnsRR) []nsecRecord {
+	var out []nsecRecord
+	for _, rr := range rrs {
+		if rr.Type != dnsTypeNSEC {
+			continue
+		}
+		signer, ok := proofSigner(rrs, rr)
+		if !ok {
+			continue
+		}
+		if rd, ok := rr.rdata(); ok {
+			out = append(out, nsecRecord{rr.Name, signer, rd.(*dnsRdataNSEC)})
+		}
+	}
+	return out
+}
+
+// proofSigner returns the signer of the RRSIGs over rr in rrs. A record
+// whose RRSIGs name different signers, as a forged one added beside the
+// real ones would, has none.
+func proofSigner(rrs []dnsRR, rr dnsRR) (dnsName, bool) {
+	var signer dnsName
+	found := false
+	for _, sigRR := range sigsFor(rrs, rr.Name, rr.Type) {
+		rd, ok := sigRR.rdata()
+		if !ok {
+			return "", false
+		}
+		sig := rd.(*dnsRdataRRSIG)
+		if found && !sig.SignerName.equal(signer) {
+			return "", false
+		}
+		signer, found = sig.SignerName, true
+	}
+	return signer, found
+}
+
+// nsecCovering and nsecAt find the NSEC covering or at name, from the
+// zone that holds name.
+func nsecCovering(nsecs []nsecRecord, name dnsName) *nsecRecord {
+	for i := range nsecs {
+		if !name.isSubdomainOf(nsecs[i].signer) {
+			continue
+		}
+		if nsecCovers(nsecs[i].owner, nsecs[i].NextDomain, name) {
+			return &nsecs[i]
+		}
+	}
+	return nil
+}
+
+func nsecAt(nsecs []nsecRecord, name dnsName) *nsecRecord {
+	for i := range nsecs {
+		if nsecs[i].owner.equal(name) && name.isSubdomainOf(nsecs[i].signer) {
+			return &nsecs[i]
+		}
+	}
+	return nil
+}
+
+// aboveCut reports whether an NSEC or NSEC3 at owner with bitmap is the
+// parent side of a delegation, or a DNAME, at or above name, and so says
+// nothing about qtype at name (RFC 6840 section 4.1). Of the names at a
+// cut, the parent holds only the DS.
+func aboveCut(bitmap []byte, owner, name dnsName, qtype uint16) bool {
+	if !name.isSubdomainOf(owner) {
+		return false
+	}
+	if bitmapHas(bitmap, dnsTypeNS) && !bitmapHas(bitmap, dnsTypeSOA) {
+		return !name.equal(owner) || qtype != dnsTypeDS
+	}
+	return bitmapHas(bitmap, dnsTypeDNAME) && !name.equal(owner)
+}
+
+// commonAncestor returns the longest name both a and b are under.
+func commonAncestor(a, b dnsName) dnsName {
+	n := min(a.labelCount(), b.labelCount())
+	for ; n > 0; n-- {
+		if a.suffix(n).equal(b.suffix(n)) {
+			break
+		}
+	}
+	return a.suffix(n)
+}
+
+// provesDenial checks that the NSEC or NSEC3 records in authority, which
+// have been validated, show that name has no qtype data (NODATA) or does
+// not exist at all (NXDOMAIN). Opt-out spans make the answer insecure.
+func provesDenial(authority []dnsRR, name dnsName, qtype uint16, nxdomain bool) (secStatus, error) {
+	what := name.String() + " " + typeString(qtype)
+	lacks := func(bitmap []byte) bool {
+		return !bitmapHas(bitmap, qtype) && !bitmapHas(bitmap, dnsTypeCNAME) &&
+			!(qtype == dnsTypeDS && bitmapHas(bitmap, dnsTypeSOA) && !name.isRoot())
+	}
+
+	if nsecs := nsecRecords(authority); len(nsecs) > 0 {
+		cover := nsecCovering(nsecs, name)
+		if n := nsecAt(nsecs, name); nxdomain && n != nil && bitmapHas(n.TypeBitmap, dnsTypeNXNAME) {
+			return secSecure, nil // compact denial (RFC 9824)
+		}
+		if cover != nil && aboveCut(cover.TypeBitmap, cover.owner, name, qtype) {
+			return secBogus, newError("NSEC from above a delegation for " + what)
+		}
+		if !nxdomain {
+			if n := nsecAt(nsecs, name); n != nil {
+				if aboveCut(n.TypeBitmap, name, name, qtype) {
+					return secBogus, newError("NSEC from above a delegation for " + what)
+				}
+				if lacks(n.TypeBitmap) {
+					return secSecure, nil
+				}
+				return secBogus, newError("NSEC shows the data exists for " + what)
+			}
+			if cover != nil && cover.NextDomain.isSubdomainOf(name) {
+				return secSecure, nil // empty non-terminal
+			}
+		}
+		if cover == nil {
+			return secBogus, newError("no NSEC covers " + what)
+		}
+		ce := commonAncestor(name, cover.owner)
+		if c := commonAncestor(name, cover.NextDomain); c.labelCount() > ce.labelCount() {
+			ce = c
+		}
+		wild, _ := ce.prepend("*")
+		if nxdomain {
+			if n := nsecCovering(nsecs, wild); n != nil && !aboveCut(n.TypeBitmap, n.owner, wild, qtype) {
+				return secSecure, nil
+			}
+			return secBogus, newError("no NSEC denies the wildcard for " + what)
+		}
+		if n := nsecAt(nsecs, wild); n != nil && lacks(n.TypeBitmap) && !aboveCut(n.TypeBitmap, wild, wild, qtype) {
+			return secSecure, nil
+		}
+		return secBogus, newError("no NSEC proves NODATA for " + what)
+	}
+
+	s, ok := newNSEC3Set(authority)
+	if !ok {
+		return secBogus, newError("no NSEC or NSEC3 for " + what)
+	}
+	if s.records[0].HashAlg != nsec3HashSHA1 || s.iterations > maxNSEC3Iterations {
+		return secInsecure, nil
+	}
+	if !nxdomain {
+		if n := s.match(name); n != nil {
+			if aboveCut(n.TypeBitmap, name, name, qtype) {
+				return secBogus, newError("NSEC3 from above a delegation for " + what)
+			}
+			if lacks(n.TypeBitmap) {
+				return secSecure, nil
+			}
+			return secBogus, newError("NSEC3 shows the data exists for " + what)
+		}
+	}
+	ce, cover, ok := s.closestEncloser(name)
+	if !ok {
+		return secBogus, newError("no closest encloser proof for " + what)
+	}
+	optOut := cover.Flags&nsec3OptOut != 0
+	if !nxdomain && qtype == dnsTypeDS && optOut {
+		return secInsecure, nil // an unsigned delegation may be there
+	}
+	wild, _ := ce.prepend("*")
+	if nxdomain {
+		if s.cover(wild) == nil {
+			return secBogus, newError("no NSEC3 denies the wildcard for " + what)
+		}
+		if optOut {
+			return secInsecure, nil
+		}
+		return secSecure, nil
+	}
+	if n := s.match(wild); n != nil && lacks(n.TypeBitmap) && !aboveCut(n.TypeBitmap, wild, wild, qtype) {
+		return secSecure, nil
+	}
+	return secBogus, newError("no NSEC3 proves NODATA for " + what)
+}
+
+// provesWildcardExpansion checks that owner, answered from a wildcard
+// with labels labels, does not exist itself.
+func provesWildcardExpansion(authority []dnsRR, owner dnsName, labels int) (secStatus, error) {
+	if nsecs := nsecRecords(authority); len(nsecs) > 0 {
+		if n := nsecCovering(nsecs, owner); n != nil && !aboveCut(n.TypeBitmap, n.owner, owner, 0) {
+			return secSecure, nil
+		}
+	} else if s, ok := newNSEC3Set(authority); ok {
+		if s.iterations > maxNSEC3Iterations {
+			return secInsecure, nil
+		}
+		if c := s.cover(owner.suffix(labels + 1)); c != nil {
+			if c.Flags&nsec3OptOut != 0 {
+				return secInsecure, nil
+			}
+			return secSecure, nil
+		}
+	}
+	return secBogus, newError("no proof that " + owner.String() + " does not exist besides the wildcard")
+}
+
+// provesInsecureDelegation checks that authority, from a secure NODATA
+// answer for zone/DS, shows a delegation at zone without DS.
+func provesInsecureDelegation(authority []dnsRR, zone dnsName) bool {
+	if n := nsecAt(nsecRecords(authority), zone); n != nil {
+		return bitmapHas(n.TypeBitmap, dnsTypeNS) && !bitmapHas(n.TypeBitmap, dnsTypeDS) &&
+			!bitmapHas(n.TypeBitmap, dnsTypeSOA)
+	}
+	s, ok := newNSEC3Set(authority)
+	if !ok {
+		return false
+	}
+	if n := s.match(zone); n != nil {
+		return bitmapHas(n.TypeBitmap, dnsTypeNS) && !bitmapHas(n.TypeBitmap, dnsTypeDS) &&
+			!bitmapHas(n.TypeBitmap, dnsTypeSOA)
+	}
+	_, cover, ok := s.closestEncloser(zone)
+	return ok && cover.Flags&nsec3OptOut != 0
+}
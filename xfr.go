@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+)
+
+// Outbound zone transfers: AXFR (RFC 5936) and IXFR (RFC 1995), over TCP
+// only. IXFR is answered from the zone's journal of recent changes and
+// falls back to the whole zone when the journal does not reach back to
+// the client's serial.
+
+// Responses of a transfer are filled up to about this size.
+const transferMessageSize = 16384
+
+// zoneDiff is one change of a zone's serial: the SOAs before and after,
+// the records removed and the records added.
+type zoneDiff struct {
+	from, to dnsRR
+	deleted  []dnsRR
+	added    []dnsRR
+}
+
+// zoneJournal holds the latest changes of a zone, oldest first, each
+// ending at the serial the next one starts from. Changes are dropped
+// once together they hold more records than the zone: the zone itself
+// is then the cheaper transfer.
+type zoneJournal struct {
+	diffs []*zoneDiff
+	size  int  // records in diffs
+	stale bool // the data changed without a new serial
+}
+
+// serialBefore compares SOA serials (RFC 1982).
+func serialBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func soaSerial(rr dnsRR) (uint32, bool) {
+	rd, ok := rr.rdata()
+	if !ok {
+		return 0, false
+	}
+	return rd.(*dnsRdataSOA).Serial, true
+}
+
+// record adds the change from old to t to the journal. Changes that the
+// serial does not show make the journal useless, so it starts afresh,
+// and the next change is left out too: it starts from data that clients
+// with its serial have never seen.
+func (j *zoneJournal) record(origin dnsName, old, t *zoneTree) {
+	fromSOA, toSOA := old.get(origin).rrset(dnsTypeSOA), t.get(origin).rrset(dnsTypeSOA)
+	if len(fromSOA) == 0 || len(toSOA) == 0 {
+		*j = zoneJournal{}
+		return
+	}
+	from, ok1 := soaSerial(fromSOA[0])
+	to, ok2 := soaSerial(toSOA[0])
+	d, total := diffTrees(old, t)
+	switch {
+	case !ok1 || !ok2:
+		*j = zoneJournal{}
+		return
+	case from == to:
+		if len(d.deleted)+len(d.added) > 0 {
+			*j = zoneJournal{stale: true}
+		}
+		return
+	case !serialBefore(from, to):
+		*j = zoneJournal{}
+		return
+	case j.stale:
+		j.stale = false
+		return
+	}
+	d.from, d.to = fromSOA[0], toSOA[0]
+	j.diffs = append(j.diffs, d)
+	j.size += len(d.deleted) + len(d.added)
+	for len(j.diffs) > 0 && j.size > total {
+		j.size -= len(j.diffs[0].deleted) + len(j.diffs[0].added)
+		j.diffs = j.diffs[1:]
+	}
+}
+
+// since returns the changes from serial on, false when the journal does
+// not go back that far.
+func (j *zoneJournal) since(serial uint32) ([]*zoneDiff, bool) {
+	for i, d := range j.diffs {
+		if s, _ := soaSerial(d.from); s == serial {
+			return j.diffs[i:], true
+		}
+	}
+	return nil, false
+}
+
+// walkRecords calls f with every record of t and its NSEC3 chain.
+func walkRecords(t *zoneTree, f func(rr dnsRR)) {
+	for _, tree := range []*zoneTree{t, t.nsec3} {
+		if tree == nil {
+			continue
+		}
+		tree.walk(func(n *zoneNode) bool {
+			for _, rrs := range n.rrsets {
+				for _, rr := range rrs {
+					f(rr)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// diffTrees returns what changed from old to t, apart from the SOA, and
+// the number of records in t.
+func diffTrees(old, t *zoneTree) (*zoneDiff, int) {
+	key := func(rr dnsRR) string {
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], rr.Type)
+		binary.BigEndian.PutUint16(fixed[2:], rr.Class)
+		binary.BigEndian.PutUint32(fixed[4:], rr.Ttl)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.Rdata)))
+		return rr.Name.key() + string(fixed[:]) + string(rr.Rdata)
+	}
+	before := make(map[string]dnsRR)
+	walkRecords(old, func(rr dnsRR) {
+		if rr.Type != dnsTypeSOA {
+			before[key(rr)] = rr
+		}
+	})
+	d := new(zoneDiff)
+	total := 0
+	walkRecords(t, func(rr dnsRR) {
+		total++
+		if rr.Type == dnsTypeSOA {
+			return
+		}
+		k := key(rr)
+		if _, ok := before[k]; ok {
+			delete(before, k)
+			return
+		}
+		d.added = append(d.added, rr)
+	})
+	for _, rr := range before {
+		d.deleted = append(d.deleted, rr)
+	}
+	return d, total
+}
+
+// transfer answers AXFR and IXFR for the clients a zone's transfer ACL
+// allows.
+func (srv *authServer) transfer(req *dnsMessage, client net.IP, send func(*dnsMessage) error) error {
+	q := req.Question[0]
+	fail := func(err error) error {
+		log.Print(err)
+		res := newResponse(req)
+		res.Rcode = errorRcode(err)
+		return send(res)
+	}
+	z := srv.zones.get(q.Qname)
+	if z == nil {
+		metricTransfersRefused.Add(1)
+		return fail(newRefusedError(q.Qname.String() + " is not a served zone"))
+	}
+	if !z.transfer.allowsKey(client, req.keyName()) {
+		metricTransfersRefused.Add(1)
+		return fail(newRefusedError("transfer of " + z.origin.String() + " refused to " + client.String()))
+	}
+
+	if !z.serving() {
+		return fail(newRcodeError(z.origin.String()+" has no fresh copy", rcodeServerFailure))
+	}
+	t, diffs := z.snapshotWithJournal()
+	soa := t.get(z.origin).rrset(dnsTypeSOA)
+	if len(soa) == 0 {
+		return fail(newRcodeError(z.origin.String()+" has no SOA", rcodeServerFailure))
+	}
+	current := soa[0]
+	var rrs []dnsRR
+	if q.Qtype == dnsTypeIXFR {
+		var clientSOA *dnsRR
+		for i := range req.Authority {
+			if rr := &req.Authority[i]; rr.Type == dnsTypeSOA && rr.Name.equal(z.origin) {
+				clientSOA = rr
+			}
+		}
+		if clientSOA == nil {
+			return fail(newFormatError("IXFR without the client's SOA", headerLen))
+		}
+		serial, ok := soaSerial(*clientSOA)
+		if !ok {
+			return fail(newFormatError("bad SOA in IXFR", headerLen))
+		}
+		rrs = incrementalRecords(current, serial, diffs)
+	}
+	if rrs == nil {
+		rrs = append(rrs, current)
+		walkRecords(t, func(rr dnsRR) {
+			if rr.Type != dnsTypeSOA {
+				rrs = append(rrs, rr)
+			}
+		})
+		rrs = append(rrs, current)
+	}
+	metricTransfers.Add(1)
+	log.Printf("%s of %s to %s: %d records", typeString(q.Qtype), z.origin, client, len(rrs))
+	return sendRecords(req, rrs, send)
+}
+
+// incrementalRecords is the answer to an IXFR from serial: the current
+// SOA alone when the client is up to date, nil when the journal does not
+// reach back to serial.
+func incrementalRecords(current dnsRR, serial uint32, diffs *zoneJournal) []dnsRR {
+	if cur, _ := soaSerial(current); !serialBefore(serial, cur) {
+		return []dnsRR{current}
+	}
+	chain, ok := diffs.since(serial)
+	if !ok {
+		return nil
+	}
+	rrs := []dnsRR{current}
+	for _, d := range chain {
+		rrs = append(rrs, d.from)
+		rrs = append(rrs, d.deleted...)
+		rrs = append(rrs, d.to)
+		rrs = append(rrs, d.added...)
+	}
+	return append(rrs, current)
+}
+
+// sendRecords sends rrs in as many responses as it takes. Only the first
+// carries the question.
+func sendRecords(req *dnsMessage, rrs []dnsRR, send func(*dnsMessage) error) error {
+	res := newResponse(req)
+	res.AA = true
+	size := headerLen + req.Question[0].len()
+	for _, rr := range rrs {
+		l := rr.dnsRRHeader.len() + len(rr.Rdata)
+		if len(res.Answer) > 0 && size+l > transferMessageSize {
+			if err := send(res); err != nil {
+				return err
+			}
+			res = newResponse(req)
+			res.AA = true
+			res.Question = nil
+			size = headerLen
+		}
+		res.Answer = append(res.Answer, rr)
+		size += l
+	}
+	return send(res)
+}
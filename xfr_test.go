@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestTCP serves h over TCP on the loopback and returns the address.
+func startTestTCP(t *testing.T, h dnsHandler) string {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveTCP(ln, h)
+	return ln.Addr().String()
+}
+
+// testTransfer sends req over a new connection and reads responses until
+// the transfer ends with the SOA it began with.
+func testTransfer(t *testing.T, addr string, req *dnsMessage) []*dnsMessage {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reqBytes, _ := req.Pack()
+	if err := writeTCPMessage(conn, reqBytes); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*dnsMessage
+	var first *dnsRR
+	for {
+		resBytes, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := new(dnsMessage)
+		if err := res.Unpack(resBytes); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, res)
+		if !isTransfer(req) || res.Rcode != rcodeSuccess || len(res.Answer) == 0 {
+			return msgs
+		}
+		if first == nil {
+			first = &res.Answer[0]
+			if len(res.Answer) == 1 && req.Question[0].Qtype == dnsTypeIXFR {
+				return msgs // up to date
+			}
+			if len(res.Answer) == 1 {
+				continue
+			}
+		}
+		if last := res.Answer[len(res.Answer)-1]; last.Type == dnsTypeSOA && string(last.Rdata) == string(first.Rdata) {
+			return msgs
+		}
+	}
+}
+
+func answers(msgs []*dnsMessage) []dnsRR {
+	var rrs []dnsRR
+	for _, m := range msgs {
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs
+}
+
+func testIXFR(zone string, serial uint32) *dnsMessage {
+	req := testQuery(zone, dnsTypeIXFR)
+	soa := testSOA(zone, 3600, 300)
+	rd, _ := soa.rdata()
+	rd.(*dnsRdataSOA).Serial = serial
+	req.Authority = []dnsRR{newRR(soa.Name, dnsTypeSOA, 3600, rd)}
+	return req
+}
+
+// bumpSerial deletes del from z, adds rrs and increases its serial.
+func bumpSerial(t *testing.T, z *zone, del []dnsRR, rrs ...dnsRR) {
+	t.Helper()
+	err := z.update(func(x *zoneTxn) error {
+		soa := x.tree().get(z.origin).rrset(dnsTypeSOA)[0]
+		rd, _ := soa.rdata()
+		data := *rd.(*dnsRdataSOA)
+		data.Serial++
+		x.deleteRRset(z.origin, dnsTypeSOA)
+		x.addRR(newRR(z.origin, dnsTypeSOA, soa.Ttl, &data))
+		for _, rr := range del {
+			x.deleteRR(rr)
+		}
+		for _, rr := range rrs {
+			x.addRR(rr)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serialOf(t *testing.T, rr dnsRR) uint32 {
+	t.Helper()
+	if rr.Type != dnsTypeSOA {
+		t.Fatalf("%s where an SOA belongs", rr.String())
+	}
+	serial, _ := soaSerial(rr)
+	return serial
+}
+
+func TestTransfer(t *testing.T) {
+	var text strings.Builder
+	text.WriteString(testAuthZone)
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&text, "t%d\tTXT\t\"%s\"\n", i, strings.Repeat("x", 50))
+	}
+	origin := mustParseName("example.")
+	rrs, err := parseZone(strings.NewReader(text.String()), "test", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := newZone(origin, rrs)
+	z.transfer, _ = parseACL([]string{"127.0.0.0/8"})
+	closed := newZone(mustParseName("other."), []dnsRR{testSOA("other.", 3600, 300)})
+	srv := &authServer{zones: newZoneSet()}
+	srv.zones.add(z)
+	srv.zones.add(closed)
+	addr := startTestTCP(t, srv)
+
+	msgs := testTransfer(t, addr, testQuery("example.", dnsTypeAXFR))
+	all := answers(msgs)
+	if len(msgs) < 2 {
+		t.Errorf("AXFR of %d records in %d message", len(all), len(msgs))
+	}
+	if len(all) != len(rrs)+1 || serialOf(t, all[0]) != 1 || serialOf(t, all[len(all)-1]) != 1 {
+		t.Errorf("AXFR of %d records, want %d between SOAs", len(all), len(rrs)+1)
+	}
+	if len(msgs[0].Question) != 1 || len(msgs[1].Question) != 0 || !msgs[0].AA {
+		t.Error("question or AA of the AXFR responses")
+	}
+
+	if msgs := testTransfer(t, addr, testQuery("other.", dnsTypeAXFR)); msgs[0].Rcode != rcodeRefused {
+		t.Errorf("transfer without ACL: rcode %d", msgs[0].Rcode)
+	}
+	if res := srv.serve(testQuery("example.", dnsTypeAXFR), testClient); res.Rcode != rcodeNotImplemented {
+		t.Errorf("AXFR outside TCP: rcode %d", res.Rcode)
+	}
+	// Plain queries work over TCP too.
+	if msgs := testTransfer(t, addr, testQuery("www.example.", dnsTypeA)); len(msgs[0].Answer) != 1 {
+		t.Errorf("query over TCP: %d answers", len(msgs[0].Answer))
+	}
+
+	// Two changes, then IXFR from each serial.
+	bumpSerial(t, z, nil, testA("new.example.", 3600, 1))
+	bumpSerial(t, z, nil, testA("new.example.", 3600, 2))
+	if err := z.update(func(x *zoneTxn) error {
+		x.deleteRR(testA("new.example.", 3600, 1))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bumpSerial(t, z, nil)
+
+	all = answers(testTransfer(t, addr, testIXFR("example.", 4)))
+	if len(all) != 1 || serialOf(t, all[0]) != 4 {
+		t.Errorf("IXFR when up to date: %d records", len(all))
+	}
+	// The change without a new serial lost the history before it.
+	all = answers(testTransfer(t, addr, testIXFR("example.", 2)))
+	if len(all) != len(rrs)+2 {
+		t.Errorf("IXFR from a serial out of the journal: %d records", len(all))
+	}
+	// So did the serial it changed under.
+	if all = answers(testTransfer(t, addr, testIXFR("example.", 3))); len(all) != len(rrs)+2 {
+		t.Errorf("IXFR from the serial of a silent change: %d records", len(all))
+	}
+	bumpSerial(t, z, nil)
+	all = answers(testTransfer(t, addr, testIXFR("example.", 4)))
+	want := []uint32{5, 4, 5, 5}
+	if len(all) != len(want) {
+		t.Fatalf("IXFR from 4: %d records", len(all))
+	}
+	for i, serial := range want {
+		if got := serialOf(t, all[i]); got != serial {
+			t.Errorf("IXFR from 4: SOA %d is %d, want %d", i, got, serial)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	z := newZone(mustParseName("example."), []dnsRR{testSOA("example.", 3600, 300), testA("www.example.", 300, 1)})
+	bumpSerial(t, z, nil, testA("a.example.", 300, 1))
+	bumpSerial(t, z, nil, testA("b.example.", 300, 1))
+	_, j := z.snapshotWithJournal()
+	diffs, ok := j.since(1)
+	if !ok || len(diffs) != 2 {
+		t.Fatalf("changes since 1: %d, %v", len(diffs), ok)
+	}
+	if len(diffs[1].added) != 1 || !diffs[1].added[0].Name.equal(mustParseName("b.example.")) || len(diffs[1].deleted) != 0 {
+		t.Errorf("second change %v", diffs[1])
+	}
+	// Changes with more records than the zone push out the older ones.
+	bumpSerial(t, z, []dnsRR{testA("a.example.", 300, 1), testA("b.example.", 300, 1)})
+	_, j = z.snapshotWithJournal()
+	if _, ok := j.since(1); ok {
+		t.Error("journal kept more records than the zone")
+	}
+	if _, ok := j.since(3); !ok {
+		t.Error("journal lost the latest change")
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Zone database.
+//
+// Names are stored in a crit-bit tree keyed by treeKey: the labels in
+// reverse order, lowercased, each one terminated by a zero octet. Byte
+// order of the keys is then exactly the canonical DNS order, and every
+// name's key is a prefix of the keys of its descendants, so exact match,
+// closest encloser and predecessor are all single descents whose cost
+// grows with the length of the name, not with the size of the zone.
+//
+// Trees are persistent: a zoneTxn copies the nodes on the paths it
+// touches and commit returns a new tree. Readers keep using whichever
+// snapshot they loaded, so reloads and updates never block them.
+
+// zoneNode holds the RRsets of one owner name. It is immutable once
+// published in a tree.
+type zoneNode struct {
+	name   dnsName
+	rrsets map[uint16][]dnsRR
+}
+
+// rrset returns the records of type t, nil when there are none.
+func (n *zoneNode) rrset(t uint16) []dnsRR {
+	if n == nil {
+		return nil
+	}
+	return n.rrsets[t]
+}
+
+// treeKey encodes n so that byte order is canonical order. Label octets
+// 0x00 and 0x01 are escaped as 0x01 0x01 and 0x01 0x02, which keeps their
+// order and leaves 0x00 free to terminate labels.
+func treeKey(n dnsName) string {
+	labels := n.canonical().labels()
+	size := 0
+	for _, l := range labels {
+		size += len(l) + 1
+	}
+	key := make([]byte, 0, size)
+	for i := len(labels) - 1; i >= 0; i-- {
+		for j := 0; j < len(labels[i]); j++ {
+			switch c := labels[i][j]; c {
+			case 0x00, 0x01:
+				key = append(key, 0x01, c+1)
+			default:
+				key = append(key, c)
+			}
+		}
+		key = append(key, 0x00)
+	}
+	return string(key)
+}
+
+// critNode is either a leaf (value != nil) or an internal node that
+// splits on bit number crit, counted from the most significant bit of
+// the first octet. Keys are virtually padded with zero octets.
+type critNode struct {
+	crit  int
+	child [2]*critNode
+	key   string
+	value *zoneNode
+}
+
+func keyBit(key string, bit int) int {
+	i := bit >> 3
+	if i >= len(key) {
+		return 0
+	}
+	return int(key[i]>>(7-uint(bit&7))) & 1
+}
+
+// firstDiff returns the first bit where a and b differ, -1 if equal.
+func firstDiff(a, b string) int {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		var x, y byte
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if d := x ^ y; d != 0 {
+			bit := 0
+			for d&0x80 == 0 {
+				d <<= 1
+				bit++
+			}
+			return i*8 + bit
+		}
+	}
+	return -1
+}
+
+// zoneTree is an immutable snapshot of a zone's names.
+type zoneTree struct {
+	root  *critNode
+	count int
+	nsec3 *zoneTree // the NSEC3 chain of a signed zone, by hashed owner
+}
+
+// bestLeaf returns the leaf reached by following key's bits. No other
+// leaf shares a longer prefix with key.
+func (t *zoneTree) bestLeaf(key string) *critNode {
+	p := t.root
+	if p == nil {
+		return nil
+	}
+	for p.value == nil {
+		p = p.child[keyBit(key, p.crit)]
+	}
+	return p
+}
+
+// get returns the node of name n, nil if n owns no data.
+func (t *zoneTree) get(n dnsName) *zoneNode {
+	key := treeKey(n)
+	if leaf := t.bestLeaf(key); leaf != nil && leaf.key == key {
+		return leaf.value
+	}
+	return nil
+}
+
+// exists reports whether n owns data or is an empty non-terminal.
+func (t *zoneTree) exists(n dnsName) bool {
+	key := treeKey(n)
+	leaf := t.bestLeaf(key)
+	return leaf != nil && len(leaf.key) >= len(key) && leaf.key[:len(key)] == key
+}
+
+// closestEncloser returns the longest ancestor of n (n included) that
+// exists in the tree, empty non-terminals counting as existing (RFC 4592).
+// It returns the root when nothing matches.
+func (t *zoneTree) closestEncloser(n dnsName) dnsName {
+	key := treeKey(n)
+	leaf := t.bestLeaf(key)
+	if leaf == nil {
+		return rootName
+	}
+	// Length of the common prefix in octets.
+	common := len(key)
+	if d := firstDiff(key, leaf.key); d >= 0 {
+		common = d >> 3
+	}
+	// Keep whole labels only: cut after the last terminator in the prefix
+	// that is also a terminator in the leaf.
+	labels := 0
+	for i := 0; i < common && i < len(leaf.key); i++ {
+		if key[i] == 0x00 {
+			labels++
+		}
+	}
+	return n.suffix(labels)
+}
+
+// nextCloser returns the ancestor of n one label longer than its closest
+// encloser ce, or n itself when n exists.
+func (t *zoneTree) nextCloser(n, ce dnsName) dnsName {
+	if n.labelCount() == ce.labelCount() {
+		return n
+	}
+	return n.suffix(ce.labelCount() + 1)
+}
+
+// predecessor returns the node with the greatest name that sorts
+// canonically before n, nil if there is none.
+func (t *zoneTree) predecessor(n dnsName) *zoneNode {
+	key := treeKey(n)
+	leaf := t.bestLeaf(key)
+	if leaf == nil {
+		return nil
+	}
+	crit := firstDiff(key, leaf.key)
+	if crit < 0 {
+		// n itself is present. Every key splitting off at or beyond its
+		// end has n as a prefix and sorts after it.
+		crit = len(key) * 8
+	}
+	if p := floorNode(t.root, key, crit); p != nil {
+		return p.value
+	}
+	return nil
+}
+
+// floorNode returns the greatest leaf below p whose key is smaller than
+// key. crit is where key leaves the tree, i.e. the first bit in which it
+// differs from every stored key sharing its longest prefix.
+func floorNode(p *critNode, key string, crit int) *critNode {
+	if p.value != nil || p.crit >= crit {
+		// Every key below p agrees with key before crit and differs at
+		// it, unless p is the leaf of key itself.
+		if p.value != nil && p.key == key {
+			return nil
+		}
+		if keyBit(key, crit) == 1 {
+			return maxLeaf(p)
+		}
+		return nil
+	}
+	if keyBit(key, p.crit) == 1 {
+		if l := floorNode(p.child[1], key, crit); l != nil {
+			return l
+		}
+		return maxLeaf(p.child[0])
+	}
+	return floorNode(p.child[0], key, crit)
+}
+
+// last returns the node that sorts last, nil in an empty tree.
+func (t *zoneTree) last() *zoneNode {
+	if t.root == nil {
+		return nil
+	}
+	return maxLeaf(t.root).value
+}
+
+func maxLeaf(p *critNode) *critNode {
+	for p.value == nil {
+		p = p.child[1]
+	}
+	return p
+}
+
+// walk calls f for every node in canonical order until f returns false.
+func (t *zoneTree) walk(f func(n *zoneNode) bool) {
+	if t.root != nil {
+		walkNode(t.root, f)
+	}
+}
+
+func walkNode(p *critNode, f func(n *zoneNode) bool) bool {
+	if p.value != nil {
+		return f(p.value)
+	}
+	return walkNode(p.child[0], f) && walkNode(p.child[1], f)
+}
+
+// zoneTxn accumulates changes to a tree. Nodes created by the
+// transaction are tracked so each one is copied at most once.
+type zoneTxn struct {
+	root  *critNode
+	count int
+	owned map[*critNode]bool
+	nodes map[*zoneNode]bool
+}
+
+func (t *zoneTree) begin() *zoneTxn {
+	return &zoneTxn{root: t.root, count: t.count,
+		owned: make(map[*critNode]bool), nodes: make(map[*zoneNode]bool)}
+}
+
+// commit freezes the transaction into a new snapshot.
+func (x *zoneTxn) commit() *zoneTree {
+	t := &zoneTree{root: x.root, count: x.count}
+	x.owned, x.nodes = nil, nil
+	return t
+}
+
+func (x *zoneTxn) own(p *critNode) *critNode {
+	if x.owned[p] {
+		return p
+	}
+	c := *p
+	x.owned[&c] = true
+	return &c
+}
+
+// tree gives a read view of the transaction's current state.
+func (x *zoneTxn) tree() *zoneTree {
+	return &zoneTree{root: x.root, count: x.count}
+}
+
+// mutableNode returns a private copy of the node of n, creating it.
+func (x *zoneTxn) mutableNode(n dnsName) *zoneNode {
+	key := treeKey(n)
+	if x.root == nil {
+		leaf := &critNode{key: key, value: x.newNode(n, nil)}
+		x.owned[leaf] = true
+		x.root = leaf
+		x.count++
+		return leaf.value
+	}
+
+	leaf := x.tree().bestLeaf(key)
+	crit := firstDiff(key, leaf.key)
+	if crit < 0 {
+		// Copy the path down to the existing leaf.
+		pp := &x.root
+		for {
+			*pp = x.own(*pp)
+			p := *pp
+			if p.value != nil {
+				if !x.nodes[p.value] {
+					p.value = x.newNode(p.value.name, p.value.rrsets)
+				}
+				return p.value
+			}
+			pp = &p.child[keyBit(key, p.crit)]
+		}
+	}
+
+	// Insert a new internal node at the first position splitting on crit.
+	newLeaf := &critNode{key: key, value: x.newNode(n, nil)}
+	x.owned[newLeaf] = true
+	pp := &x.root
+	for {
+		p := *pp
+		if p.value != nil || p.crit > crit {
+			break
+		}
+		*pp = x.own(p)
+		pp = &(*pp).child[keyBit(key, p.crit)]
+	}
+	inner := &critNode{crit: crit}
+	x.owned[inner] = true
+	dir := keyBit(key, crit)
+	inner.child[dir] = newLeaf
+	inner.child[1-dir] = *pp
+	*pp = inner
+	x.count++
+	return newLeaf.value
+}
+
+func (x *zoneTxn) newNode(n dnsName, rrsets map[uint16][]dnsRR) *zoneNode {
+	node := &zoneNode{name: n, rrsets: make(map[uint16][]dnsRR, len(rrsets))}
+	for t, rrs := range rrsets {
+		node.rrsets[t] = rrs
+	}
+	x.nodes[node] = true
+	return node
+}
+
+// remove deletes the node of n.
+func (x *zoneTxn) remove(n dnsName) {
+	key := treeKey(n)
+	if leaf := x.tree().bestLeaf(key); leaf == nil || leaf.key != key {
+		return
+	}
+	pp := &x.root
+	var parent **critNode
+	for {
+		p := *pp
+		if p.value != nil {
+			break
+		}
+		*pp = x.own(p)
+		parent = pp
+		pp = &(*pp).child[keyBit(key, p.crit)]
+	}
+	if parent == nil {
+		x.root = nil
+	} else {
+		p := *parent
+		if p.child[0] == *pp {
+			*parent = p.child[1]
+		} else {
+			*parent = p.child[0]
+		}
+	}
+	x.count--
+}
+
+// addRR adds rr to its RRset, replacing an identical record. The TTL of
+// the whole RRset follows the new record (RFC 2181 5.2).
+func (x *zoneTxn) addRR(rr dnsRR) {
+	node := x.mutableNode(rr.Name)
+	old := node.rrsets[rr.Type]
+	rrs := make([]dnsRR, 0, len(old)+1)
+	for _, o := range old {
+		if string(o.Rdata) != string(rr.Rdata) {
+			o.Ttl = rr.Ttl
+			rrs = append(rrs, o)
+		}
+	}
+	node.rrsets[rr.Type] = append(rrs, rr)
+}
+
+// deleteRR removes the record with rr's type and rdata.
+func (x *zoneTxn) deleteRR(rr dnsRR) {
+	old := x.tree().get(rr.Name).rrset(rr.Type)
+	if old == nil {
+		return
+	}
+	node := x.mutableNode(rr.Name)
+	var rrs []dnsRR
+	for _, o := range old {
+		if string(o.Rdata) != string(rr.Rdata) {
+			rrs = append(rrs, o)
+		}
+	}
+	x.setRRset(node, rr.Type, rrs)
+}
+
+// deleteRRset removes every record of type t at n.
+func (x *zoneTxn) deleteRRset(n dnsName, t uint16) {
+	if x.tree().get(n).rrset(t) == nil {
+		return
+	}
+	x.setRRset(x.mutableNode(n), t, nil)
+}
+
+func (x *zoneTxn) setRRset(node *zoneNode, t uint16, rrs []dnsRR) {
+	if len(rrs) > 0 {
+		node.rrsets[t] = rrs
+		return
+	}
+	delete(node.rrsets, t)
+	if len(node.rrsets) == 0 {
+		x.remove(node.name)
+	}
+}
+
+// newZoneTree builds a snapshot from a list of records.
+func newZoneTree(rrs []dnsRR) *zoneTree {
+	x := new(zoneTree).begin()
+	for _, rr := range rrs {
+		x.addRR(rr)
+	}
+	return x.commit()
+}
+
+// zone is one authoritative zone. Readers call snapshot; writers go
+// through update, which serializes them.
+type zone struct {
+	origin dnsName
+	file   string
+	data   atomic.Pointer[zoneTree]
+	mu     sync.Mutex
+
+	signer   *zoneSigner // nil for unsigned zones
+	resignAt time.Time
+
+	query    acl // who may query; everyone when nil
+	transfer acl // who may AXFR and IXFR
+	updaters acl // who may UPDATE
+	journal  zoneJournal
+
+	journalFile  string // changes since the zone file was written; "" for none
+	journalDirty bool   // the journal file holds changes
+
+	secondary *secondary // nil for primary zones
+	notify    []string   // secondaries to NOTIFY, "address:port"
+	key       *tsigKey   // signs transfers in and NOTIFYs, when set
+}
+
+func newZone(origin dnsName, rrs []dnsRR) *zone {
+	z := &zone{origin: origin}
+	z.data.Store(newZoneTree(rrs))
+	return z
+}
+
+func (z *zone) snapshot() *zoneTree {
+	return z.data.Load()
+}
+
+// update applies f to a transaction on the current data and publishes
+// the result, signed again, unless f fails.
+func (z *zone) update(f func(x *zoneTxn) error) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	x := z.snapshot().begin()
+	if err := f(x); err != nil {
+		return err
+	}
+	t := x.commit()
+	if z.signer != nil {
+		var err error
+		if t, err = z.signer.signTree(t, false); err != nil {
+			return err
+		}
+	}
+	return z.publish(t)
+}
+
+// replace publishes an entirely new set of records, e.g. after a reload.
+func (z *zone) replace(rrs []dnsRR) error {
+	t := newZoneTree(rrs)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.publish(t)
+}
+
+// publish makes t the zone's data once the change is in the journal
+// file, noting it in the in-memory journal and telling the secondaries.
+// The caller holds z.mu.
+func (z *zone) publish(t *zoneTree) error {
+	old := z.snapshot()
+	if z.journalFile != "" {
+		if err := z.writeJournal(old, t); err != nil {
+			return err
+		}
+	}
+	z.data.Store(t)
+	z.journal.record(z.origin, old, t)
+	z.notifyChange(old, t)
+	return nil
+}
+
+// snapshotWithJournal returns the current data and the changes that led
+// to it.
+func (z *zone) snapshotWithJournal() (*zoneTree, *zoneJournal) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	j := z.journal
+	return z.snapshot(), &j
+}
+
+// soa returns the SOA record of the zone.
+func (z *zone) soa() (dnsRR, *dnsRdataSOA, bool) {
+	rrs := z.snapshot().get(z.origin).rrset(dnsTypeSOA)
+	if len(rrs) == 0 {
+		return dnsRR{}, nil, false
+	}
+	rd, ok := rrs[0].rdata()
+	if !ok {
+		return dnsRR{}, nil, false
+	}
+	return rrs[0], rd.(*dnsRdataSOA), true
+}
+
+// zoneSet maps origins to zones. It is replaced as a whole when the set
+// of zones changes.
+type zoneSet struct {
+	zones map[string]*zone
+}
+
+func newZoneSet() *zoneSet {
+	return &zoneSet{zones: make(map[string]*zone)}
+}
+
+func (zs *zoneSet) add(z *zone) {
+	zs.zones[z.origin.key()] = z
+}
+
+// find returns the most specific zone containing n.
+func (zs *zoneSet) find(n dnsName) *zone {
+	for {
+		if z, ok := zs.zones[n.key()]; ok {
+			return z
+		}
+		if n.isRoot() {
+			return nil
+		}
+		n = n.parent()
+	}
+}
+
+// get returns the zone with exactly origin n.
+func (zs *zoneSet) get(n dnsName) *zone {
+	return zs.zones[n.key()]
+}
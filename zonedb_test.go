@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func testRR(name string, t uint16, rd Walker) dnsRR {
+	return newRR(mustParseName(name), t, 3600, rd)
+}
+
+func TestZoneTreeLookups(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	labels := []string{"a", "b", "Z", "*", "yljkjljk", "\x00", "\x01", "\x80"}
+	var names []dnsName
+	x := new(zoneTree).begin()
+	for i := 0; i < 300; i++ {
+		n := mustParseName("example.")
+		for d := rng.Intn(4); d >= 0; d-- {
+			n, _ = n.prepend(labels[rng.Intn(len(labels))])
+		}
+		names = append(names, n)
+		x.addRR(newRR(n, dnsTypeA, 60, &dnsRdataA{[]byte{192, 0, 2, byte(i)}}))
+	}
+	tree := x.commit()
+
+	// Reference: the sorted, deduplicated owner names.
+	sort.Slice(names, func(i, j int) bool { return compareName(names[i], names[j]) < 0 })
+	var owners []dnsName
+	for _, n := range names {
+		if len(owners) == 0 || !owners[len(owners)-1].equal(n) {
+			owners = append(owners, n)
+		}
+	}
+	if tree.count != len(owners) {
+		t.Fatalf("count %d, want %d", tree.count, len(owners))
+	}
+	i := 0
+	tree.walk(func(n *zoneNode) bool {
+		if !n.name.equal(owners[i]) {
+			t.Fatalf("walk position %d: %v, want %v", i, n.name, owners[i])
+		}
+		i++
+		return true
+	})
+
+	exists := func(q dnsName) bool {
+		for _, o := range owners {
+			if o.isSubdomainOf(q) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 2000; i++ {
+		q := mustParseName("example.")
+		if rng.Intn(10) == 0 {
+			q = mustParseName("other.")
+		}
+		for d := rng.Intn(5); d >= 0; d-- {
+			q, _ = q.prepend(labels[rng.Intn(len(labels))])
+		}
+
+		var pred dnsName
+		for _, o := range owners {
+			if compareName(o, q) < 0 {
+				pred = o
+			}
+		}
+		if p := tree.predecessor(q); (p == nil) != (pred == "") || p != nil && !p.name.equal(pred) {
+			t.Errorf("predecessor(%v) = %v, want %v", q, p, pred)
+		}
+
+		ce := q
+		for !exists(ce) && !ce.isRoot() {
+			ce = ce.parent()
+		}
+		if got := tree.closestEncloser(q); !got.equal(ce) {
+			t.Errorf("closestEncloser(%v) = %v, want %v", q, got, ce)
+		}
+		if got := tree.exists(q); got != exists(q) {
+			t.Errorf("exists(%v) = %v", q, got)
+		}
+	}
+}
+
+func TestZoneTreeSnapshots(t *testing.T) {
+	www := mustParseName("www.example.")
+	before := newZoneTree([]dnsRR{testRR("www.example.", dnsTypeA, &dnsRdataA{[]byte{192, 0, 2, 1}})})
+
+	x := before.begin()
+	x.addRR(testRR("mail.example.", dnsTypeA, &dnsRdataA{[]byte{192, 0, 2, 2}}))
+	x.addRR(testRR("WWW.example.", dnsTypeA, &dnsRdataA{[]byte{192, 0, 2, 3}}))
+	after := x.commit()
+
+	if n := len(before.get(www).rrset(dnsTypeA)); n != 1 {
+		t.Errorf("old snapshot changed: %d records", n)
+	}
+	if n := len(after.get(www).rrset(dnsTypeA)); n != 2 {
+		t.Errorf("new snapshot has %d records", n)
+	}
+	if before.get(mustParseName("mail.example.")) != nil {
+		t.Error("old snapshot sees the new name")
+	}
+
+	x = after.begin()
+	x.deleteRRset(www, dnsTypeA)
+	removed := x.commit()
+	if removed.get(www) != nil || removed.count != 1 {
+		t.Errorf("name not removed, %d names left", removed.count)
+	}
+	if after.get(www) == nil {
+		t.Error("delete leaked into the previous snapshot")
+	}
+}
+
+var (
+	benchTree     *zoneTree
+	benchTreeOnce sync.Once
+)
+
+const benchRecords = 1000000
+
+// millionZone is a delegation-heavy zone of a million records spread
+// over two levels below example.
+func millionZone() *zoneTree {
+	benchTreeOnce.Do(func() {
+		x := new(zoneTree).begin()
+		for i := 0; i < benchRecords; i++ {
+			n := mustParseName(fmt.Sprintf("host%d.sub%d.example.", i, i%1000))
+			x.addRR(newRR(n, dnsTypeA, 3600, &dnsRdataA{[]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}}))
+		}
+		benchTree = x.commit()
+	})
+	return benchTree
+}
+
+func benchNames(b *testing.B, format string) []dnsName {
+	names := make([]dnsName, 4096)
+	for i := range names {
+		j := rand.Intn(benchRecords)
+		names[i] = mustParseName(fmt.Sprintf(format, j, j%1000))
+	}
+	b.ResetTimer()
+	return names
+}
+
+func BenchmarkZoneExactMatch(b *testing.B) {
+	t := millionZone()
+	names := benchNames(b, "host%d.sub%d.example.")
+	for i := 0; i < b.N; i++ {
+		if t.get(names[i%len(names)]) == nil {
+			b.Fatal("miss")
+		}
+	}
+}
+
+func BenchmarkZoneClosestEncloser(b *testing.B) {
+	t := millionZone()
+	names := benchNames(b, "nx.host%d.sub%d.example.")
+	for i := 0; i < b.N; i++ {
+		ce := t.closestEncloser(names[i%len(names)])
+		t.nextCloser(names[i%len(names)], ce)
+	}
+}
+
+func BenchmarkZonePredecessor(b *testing.B) {
+	t := millionZone()
+	names := benchNames(b, "host%dx.sub%d.example.")
+	for i := 0; i < b.N; i++ {
+		if t.predecessor(names[i%len(names)]) == nil {
+			b.Fatal("miss")
+		}
+	}
+}
+
+// Cost of publishing a one-record change to the million-record zone.
+func BenchmarkZoneUpdateSnapshot(b *testing.B) {
+	t := millionZone()
+	names := benchNames(b, "new%d.sub%d.example.")
+	for i := 0; i < b.N; i++ {
+		x := t.begin()
+		x.addRR(newRR(names[i%len(names)], dnsTypeA, 60, &dnsRdataA{[]byte{192, 0, 2, 1}}))
+		x.commit()
+	}
+}
+
+func BenchmarkZoneLoad(b *testing.B) {
+	rrs := make([]dnsRR, 100000)
+	for i := range rrs {
+		rrs[i] = newRR(mustParseName(fmt.Sprintf("host%d.example.", i)), dnsTypeA, 3600, &dnsRdataA{[]byte{10, 0, byte(i >> 8), byte(i)}})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newZoneTree(rrs)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Master file parser (RFC 1035 section 5).
+//
+// Supported: $ORIGIN, $TTL, $INCLUDE, "@", relative names, owner
+// inheritance from leading whitespace, parentheses, comments, TTL and
+// class in either order, BIND style TTL units (1h30m), the RFC 3597
+// generic "\# len hex" rdata, and Unicode names, which are converted to
+// A-labels.
+
+type zoneParser struct {
+	file    string
+	line    int
+	origin  dnsName
+	ttl     uint32 // $TTL
+	hasTTL  bool
+	owner   dnsName // last owner, inherited by lines starting with blanks
+	lastTTL uint32
+	class   uint16
+	depth   int // $INCLUDE nesting
+	records []dnsRR
+}
+
+// loadZoneFile parses the master file at path.
+func loadZoneFile(path string, origin dnsName) ([]dnsRR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer f.Close()
+	return parseZone(f, path, origin)
+}
+
+// parseZone parses a master file read from r; file is used in errors
+// and to resolve $INCLUDE paths.
+func parseZone(r io.Reader, file string, origin dnsName) ([]dnsRR, error) {
+	p := &zoneParser{file: file, origin: origin, owner: origin, class: dnsClassINET}
+	if err := p.parse(r); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+func (p *zoneParser) errorf(format string, args ...interface{}) error {
+	return newError(fmt.Sprintf("%s:%d: ", p.file, p.line) + fmt.Sprintf(format, args...))
+}
+
+func (p *zoneParser) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var tokens []string
+	blankStart := false
+	parens := 0
+	startLine := 0
+	for scanner.Scan() {
+		p.line++
+		text := scanner.Text()
+		if parens == 0 {
+			blankStart = len(text) > 0 && (text[0] == ' ' || text[0] == '\t')
+			startLine = p.line
+		}
+		var err error
+		tokens, parens, err = tokenizeZoneLine(text, tokens, parens)
+		if err != nil {
+			return p.errorf("%v", err)
+		}
+		if parens > 0 {
+			continue
+		}
+		if len(tokens) > 0 {
+			line := p.line
+			p.line = startLine
+			if err := p.entry(tokens, blankStart); err != nil {
+				return err
+			}
+			p.line = line
+		}
+		tokens = tokens[:0]
+	}
+	if err := scanner.Err(); err != nil {
+		return wrapError(err)
+	}
+	if parens > 0 {
+		return p.errorf("unbalanced parentheses")
+	}
+	return nil
+}
+
+// tokenizeZoneLine appends the tokens of one physical line and returns
+// the updated parenthesis depth. Quotes are removed from quoted strings
+// but escapes are left for the consumer.
+func tokenizeZoneLine(text string, tokens []string, parens int) ([]string, int, error) {
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, parens, nil
+		case c == '(':
+			parens++
+			i++
+		case c == ')':
+			if parens == 0 {
+				return nil, 0, newError("unbalanced parentheses")
+			}
+			parens--
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(text) && text[j] != '"'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return nil, 0, newError("unterminated string")
+			}
+			tokens = append(tokens, text[i+1:j])
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(text); j++ {
+				if text[j] == '\\' {
+					j++
+					continue
+				}
+				if strings.IndexByte(" \t\r;()\"", text[j]) >= 0 {
+					break
+				}
+			}
+			if j > len(text) {
+				j = len(text)
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+	return tokens, parens, nil
+}
+
+func (p *zoneParser) entry(tokens []string, blankStart bool) error {
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return p.errorf("$ORIGIN takes one name")
+		}
+		origin, err := parseZoneName(tokens[1], p.origin)
+		if err != nil {
+			return p.errorf("%v", err)
+		}
+		p.origin = origin
+		return nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return p.errorf("$TTL takes one value")
+		}
+		ttl, err := parseTTL(tokens[1])
+		if err != nil {
+			return p.errorf("%v", err)
+		}
+		p.ttl, p.hasTTL = ttl, true
+		return nil
+	case "$INCLUDE":
+		return p.include(tokens[1:])
+	}
+
+	if !blankStart {
+		owner, err := parseZoneName(tokens[0], p.origin)
+		if err != nil {
+			return p.errorf("%v", err)
+		}
+		p.owner = owner
+		tokens = tokens[1:]
+	}
+
+	// [TTL] [class] type, TTL and class in either order.
+	ttl, hasTTL := p.lastTTL, false
+	if p.hasTTL {
+		ttl = p.ttl
+	}
+	class := p.class
+	for i := 0; i < 2 && len(tokens) > 0; i++ {
+		if t, err := parseTTL(tokens[0]); err == nil && !hasTTL {
+			ttl, hasTTL = t, true
+			tokens = tokens[1:]
+		} else if c, ok := parseClass(tokens[0]); ok {
+			class = c
+			tokens = tokens[1:]
+		}
+	}
+	if len(tokens) == 0 {
+		return p.errorf("missing type")
+	}
+	t, ok := parseType(tokens[0])
+	if !ok {
+		return p.errorf("unknown type %s", tokens[0])
+	}
+	tokens = tokens[1:]
+	if !hasTTL && !p.hasTTL && len(p.records) == 0 && t != dnsTypeSOA {
+		return p.errorf("no TTL given and no $TTL in effect")
+	}
+
+	rr := dnsRR{dnsRRHeader: dnsRRHeader{Name: p.owner, Type: t, Class: class, Ttl: ttl}}
+	if len(tokens) > 0 && tokens[0] == `\#` {
+		if err := p.genericRdata(&rr, tokens[1:]); err != nil {
+			return err
+		}
+	} else {
+		rd := newRdata(t)
+		if rd == nil {
+			return p.errorf("type %s needs the \\# rdata format", typeString(t))
+		}
+		if err := parseRdata(rd, tokens, p.origin); err != nil {
+			return p.errorf("%v", err)
+		}
+		if !rr.setRdata(rd) {
+			return p.errorf("rdata too long")
+		}
+	}
+	// RFC 2308: without $TTL the SOA minimum was the default TTL.
+	if !hasTTL && !p.hasTTL && t == dnsTypeSOA {
+		if rd, ok := rr.rdata(); ok {
+			rr.Ttl = rd.(*dnsRdataSOA).Minttl
+		}
+	}
+	p.lastTTL, p.class = rr.Ttl, class
+	p.records = append(p.records, rr)
+	return nil
+}
+
+// genericRdata parses the RFC 3597 form: \# length hex...
+func (p *zoneParser) genericRdata(rr *dnsRR, tokens []string) error {
+	if len(tokens) == 0 {
+		return p.errorf("missing rdata length")
+	}
+	n, err := strconv.Atoi(tokens[0])
+	if err != nil || n < 0 || n > 0xffff {
+		return p.errorf("bad rdata length %s", tokens[0])
+	}
+	var rd []byte
+	if n > 0 {
+		if err := parseRdata(&dnsRdataGeneric{&rd}, tokens[1:], p.origin); err != nil {
+			return p.errorf("%v", err)
+		}
+	}
+	if len(rd) != n {
+		return p.errorf("rdata length %d does not match %d octets", n, len(rd))
+	}
+	rr.Rdata, rr.Rdlength = rd, uint16(n)
+	return nil
+}
+
+type dnsRdataGeneric struct {
+	data *[]byte
+}
+
+func (rd *dnsRdataGeneric) Walk(f func(field interface{}, name, tag string) bool) bool {
+	return f(rd.data, "Data", "hex")
+}
+
+func (p *zoneParser) include(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return p.errorf("$INCLUDE takes a file name and an optional origin")
+	}
+	if p.depth >= 10 {
+		return p.errorf("$INCLUDE nested too deeply")
+	}
+	path := args[0]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(p.file), path)
+	}
+	origin := p.origin
+	if len(args) == 2 {
+		var err error
+		if origin, err = parseZoneName(args[1], p.origin); err != nil {
+			return p.errorf("%v", err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return p.errorf("%v", err)
+	}
+	defer f.Close()
+
+	sub := &zoneParser{file: path, origin: origin, owner: origin, ttl: p.ttl, hasTTL: p.hasTTL,
+		lastTTL: p.lastTTL, class: p.class, depth: p.depth + 1, records: p.records}
+	if err := sub.parse(f); err != nil {
+		return err
+	}
+	// The origin and owner revert after an $INCLUDE (RFC 1035 section 5.1).
+	p.records = sub.records
+	return nil
+}
+
+// parseZoneName parses a possibly relative, possibly Unicode name.
+func parseZoneName(s string, origin dnsName) (dnsName, error) {
+	ascii, err := idnaToASCII(s)
+	if err != nil {
+		return "", err
+	}
+	return parseNameOrigin(ascii, origin)
+}
+
+// parseTTL parses seconds or BIND style units such as 1w2d3h4m5s.
+func parseTTL(s string) (uint32, error) {
+	if s == "" {
+		return 0, newError("empty TTL")
+	}
+	if i, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(i), nil
+	}
+	var total, cur uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) {
+			cur = cur*10 + uint64(c-'0')
+			digits = true
+			if cur > 1<<32 {
+				return 0, newError("TTL out of range: " + s)
+			}
+			continue
+		}
+		if !digits {
+			return 0, newError("bad TTL: " + s)
+		}
+		switch c {
+		case 'w', 'W':
+			total += cur * 7 * 86400
+		case 'd', 'D':
+			total += cur * 86400
+		case 'h', 'H':
+			total += cur * 3600
+		case 'm', 'M':
+			total += cur * 60
+		case 's', 'S':
+			total += cur
+		default:
+			return 0, newError("bad TTL: " + s)
+		}
+		cur, digits = 0, false
+	}
+	if digits {
+		return 0, newError("bad TTL: " + s)
+	}
+	if total > 1<<32-1 {
+		return 0, newError("TTL out of range: " + s)
+	}
+	return uint32(total), nil
+}
+
+// writeZoneFile saves the records of t at path, SOA first and the types
+// in omit left out, replacing the file only once the new one is complete
+// and on disk.
+func writeZoneFile(path string, origin dnsName, t *zoneTree, omit []uint16) error {
+	var b strings.Builder
+	for _, rr := range t.get(origin).rrset(dnsTypeSOA) {
+		b.WriteString(rr.String() + "\n")
+	}
+	walkRecords(t, func(rr dnsRR) {
+		if rr.Type != dnsTypeSOA && !slices.Contains(omit, rr.Type) {
+			b.WriteString(rr.String() + "\n")
+		}
+	})
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b.String(), os.O_TRUNC); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return wrapError(err)
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h 1h 2w 5m )
+	IN	NS	ns1
+	IN	NS	ns2.example.net.
+	IN	MX	10 mail
+ns1	300	A	192.0.2.53
+mail	IN 300	AAAA	2001:db8::25
+www	CNAME	@
+txt	TXT	"hello world" "semi;colon" \"quoted\"
+_sip._udp	SRV	0 5 5060 sip
+bücher	A	192.0.2.80
+ünï.example.org.	A	192.0.2.81
+unknown	TYPE65280	\# 3 0a0b0c
+`
+
+func TestParseZone(t *testing.T) {
+	rrs, err := parseZone(strings.NewReader(testZone), "test", rootName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"example.com.\t3600\tIN\tNS\tns2.example.net.",
+		"example.com.\t3600\tIN\tMX\t10 mail.example.com.",
+		"ns1.example.com.\t300\tIN\tA\t192.0.2.53",
+		"mail.example.com.\t300\tIN\tAAAA\t2001:db8::25",
+		"www.example.com.\t3600\tIN\tCNAME\texample.com.",
+		"txt.example.com.\t3600\tIN\tTXT\t\"hello world\" \"semi;colon\" \"\\\"quoted\\\"\"",
+		"_sip._udp.example.com.\t3600\tIN\tSRV\t0 5 5060 sip.example.com.",
+		"xn--bcher-kva.example.com.\t3600\tIN\tA\t192.0.2.80",
+		"xn--n-nga1b.example.org.\t3600\tIN\tA\t192.0.2.81",
+		"unknown.example.com.\t3600\tIN\tTYPE65280\t\\# 3 0a0b0c",
+	}
+	if len(rrs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(rrs), len(want))
+	}
+	for i := range rrs {
+		if got := rrs[i].String(); got != want[i] {
+			t.Errorf("record %d:\n got %s\nwant %s", i, got, want[i])
+		}
+	}
+	if got := rrs[9].format(true); !strings.HasPrefix(got, "bücher.example.com.\t") {
+		t.Errorf("unicode form: %s", got)
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	for _, zone := range []string{
+		"www A 192.0.2.1\n", // no TTL
+		"$TTL 60\nwww A 192.0.2.256\n",
+		"$TTL 60\nwww A 192.0.2.1 extra\n",
+		"$TTL 60\nwww MX ( 10\n",
+		"$TTL 60\nwww BOGUS x\n",
+		"$TTL 60\nwww TYPE999 \\# 2 00\n",
+		"$TTL 60\nwww A \"unterminated\n",
+		"$TTL 60\nwww.ü☃ A 192.0.2.1\n",
+		"$TTL 60\n-bad-ü A 192.0.2.1\n",
+	} {
+		if _, err := parseZone(strings.NewReader(zone), "test", mustParseName("example.")); err == nil {
+			t.Errorf("parsed: %q", zone)
+		}
+	}
+}
+
+func FuzzParseZone(f *testing.F) {
+	f.Add(testZone)
+	f.Add("$TTL 60\n@ SOA a b 1 2 3 4 5\n")
+	f.Fuzz(func(t *testing.T, zone string) {
+		if strings.Contains(strings.ToUpper(zone), "$INCLUDE") {
+			return // may open anything, /dev/stdin included
+		}
+		rrs, err := parseZone(strings.NewReader(zone), "fuzz", mustParseName("example."))
+		if err != nil {
+			return
+		}
+		// Whatever parses must print as something that parses to the same.
+		var b strings.Builder
+		for i := range rrs {
+			b.WriteString(rrs[i].String() + "\n")
+		}
+		rrs2, err := parseZone(strings.NewReader(b.String()), "fuzz", rootName)
+		if err != nil {
+			t.Fatalf("printed zone does not parse: %v\n%s", err, b.String())
+		}
+		if len(rrs2) != len(rrs) {
+			t.Fatalf("printed zone has %d records, want %d", len(rrs2), len(rrs))
+		}
+		for i := range rrs {
+			if rrs[i].String() != rrs2[i].String() {
+				t.Fatalf("record %d: %s != %s", i, rrs[i].String(), rrs2[i].String())
+			}
+		}
+	})
+}